@@ -0,0 +1,223 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/casaplatform/casa"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// A light of an alias, named by the Namespace of the bridge it is on
+type aliasMember struct {
+	Bridge string
+	Light  string
+}
+
+func (m aliasMember) String() string {
+	return m.Bridge + "/" + m.Light
+}
+
+// Parses the Aliases config key, which maps each alias to the lights it
+// spans, such as {Downstairs: [{Bridge: Upstairs, Light: Desk}]}. Every
+// member must be on one of the bridges in namespaces. The aliases are keyed
+// in lower case, as viper reads them.
+func parseAliases(config *viper.Viper, namespaces map[string]bool) (map[string][]aliasMember, error) {
+	aliases := make(map[string][]aliasMember)
+	for alias := range config.GetStringMap("Aliases") {
+		entries, err := cast.ToSliceE(config.Get("Aliases." + alias))
+		if err != nil || len(entries) == 0 {
+			return nil, errors.New("Alias " + alias + " must list its Bridge and Light pairs")
+		}
+
+		members := make([]aliasMember, len(entries))
+		for i, entry := range entries {
+			settings, err := entrySettings(entry)
+			if err != nil || settings["light"] == "" {
+				return nil, errors.New("Alias " + alias + " entry " + strconv.Itoa(i) +
+					" must be a map of Bridge and Light")
+			}
+			if !namespaces[settings["bridge"]] {
+				return nil, errors.New("Alias " + alias + " entry " + strconv.Itoa(i) +
+					" names a Bridge not listed under Bridges: " + settings["bridge"])
+			}
+			members[i] = aliasMember{Bridge: settings["bridge"], Light: settings["light"]}
+		}
+		aliases[strings.ToLower(alias)] = members
+	}
+	return aliases, nil
+}
+
+// Returns the settings of a list entry in config keyed in lower case, as
+// viper only lower cases the keys of maps outside of lists
+func entrySettings(entry interface{}) (map[string]string, error) {
+	settings, err := cast.ToStringMapStringE(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	lower := make(map[string]string, len(settings))
+	for key, value := range settings {
+		lower[strings.ToLower(key)] = value
+	}
+	return lower, nil
+}
+
+// Connects a client of the Multibridge's own to the broker, to receive the
+// commands sent to the aliases under {Root}/Alias
+func (mb *Multibridge) serveAliases(config *viper.Viper, aliases map[string][]aliasMember) error {
+	client, err := connectBroker(config)
+	if err != nil {
+		return err
+	}
+
+	mb.m.Lock()
+	mb.client = client
+	mb.root = topicRoot(config)
+	mb.aliases = aliases
+	mb.stopping = false
+	mb.m.Unlock()
+
+	client.Handle(mb.handler)
+	return client.Subscribe(mb.root + "/Alias/#")
+}
+
+// Handles the commands sent to {Root}/Alias/{Alias}/{Endpoint}/Set
+func (mb *Multibridge) handler(msg *casa.Message, err error) {
+	switch {
+	case err != nil:
+		mb.Log(err)
+		return
+	case msg == nil:
+		return
+	}
+
+	mb.m.Lock()
+	if mb.stopping {
+		mb.m.Unlock()
+		return
+	}
+	mb.inflight.Add(1)
+	prefix := mb.root + "/Alias/"
+	mb.m.Unlock()
+	defer mb.inflight.Done()
+
+	m := strings.Split(strings.TrimPrefix(msg.Topic, prefix), "/")
+	if !strings.HasPrefix(msg.Topic, prefix) || len(m) < 3 || m[len(m)-1] != "Set" {
+		return
+	}
+
+	_, err = mb.SetAlias(m[0], strings.Join(m[1:len(m)-1], "/"), string(msg.Payload))
+	if err != nil {
+		mb.Log(err)
+	}
+}
+
+// SetAlias sets the endpoint named by the topic segment to payload on every
+// light of the alias at once, across their bridges, as a command to
+// Alias/{Alias}/{Endpoint}/Set does. Members are reported by bridge Namespace
+// and light name. A failing member does not stop the command from being
+// applied to the rest, and the outcome is published to
+// Alias/{Alias}/{Endpoint}/Result.
+func (mb *Multibridge) SetAlias(alias, segment, payload string) (*BulkResult, error) {
+	mb.m.Lock()
+	members, ok := mb.aliases[strings.ToLower(alias)]
+	client, root := mb.client, mb.root
+	bridges := make(map[string]*Bridge, len(mb.named))
+	for namespace, b := range mb.named {
+		bridges[namespace] = b
+	}
+	mb.m.Unlock()
+
+	if !ok {
+		return nil, errors.New("Unknown alias: " + alias)
+	}
+
+	var (
+		m      sync.Mutex
+		wg     sync.WaitGroup
+		result = &BulkResult{
+			Succeeded: []string{},
+			Failed:    make(map[string]string),
+		}
+	)
+	for _, member := range members {
+		wg.Add(1)
+		go func(member aliasMember) {
+			defer wg.Done()
+
+			err := errors.New("Hue bridge " + member.Bridge + " isn't running")
+			if b := bridges[member.Bridge]; b != nil {
+				err = b.setLightEndpoint(member.Light, segment, payload)
+			}
+
+			m.Lock()
+			defer m.Unlock()
+			if err != nil {
+				result.Failed[member.String()] = err.Error()
+				return
+			}
+			result.Succeeded = append(result.Succeeded, member.String())
+		}(member)
+	}
+	wg.Wait()
+
+	sort.Strings(result.Succeeded)
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return result, err
+	}
+
+	if client == nil {
+		return result, ErrNotConnected
+	}
+	return result, client.PublishMessage(casa.Message{
+		Topic:   root + "/Alias/" + alias + "/" + segment + "/Result",
+		Payload: data,
+	})
+}
+
+// Sets the endpoint named by the topic segment to payload on the named light,
+// as a command to the light's own topic does
+func (b *Bridge) setLightEndpoint(name, segment, payload string) error {
+	for _, point := range singleLightEndpoints {
+		if segment == b.topicName(point) {
+			return errors.New(point + " can't be sent to an alias")
+		}
+	}
+
+	b.m.RLock()
+	defer b.m.RUnlock()
+
+	light := b.lightByName(name)
+	if light == nil {
+		return errors.New("Unknown light " + name)
+	}
+
+	endpoint := light.endpointName(segment)
+	err := light.setEndpointState(endpoint, payload)
+	if perr := light.publishError(endpoint, err); perr != nil {
+		b.Log(perr)
+	}
+	return err
+}
@@ -0,0 +1,203 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/casaplatform/casa"
+	"github.com/casaplatform/mqtt"
+)
+
+func TestAliasFansOutAcrossBridges(t *testing.T) {
+	upstairs := newFakeBridge(t)
+	upstairs.addLight("1", "Desk", "Extended color light")
+	b1, _, _ := startBridge(t, upstairs, map[string]interface{}{"TopicNamespace": "Upstairs"})
+
+	downstairs := newFakeBridge(t)
+	downstairs.addLight("1", "Hall", "Extended color light")
+	downstairs.addLight("2", "Porch", "Extended color light")
+	b2, _, _ := startBridge(t, downstairs, map[string]interface{}{"TopicNamespace": "Downstairs"})
+
+	config := testConfig(map[string]interface{}{
+		"Aliases": map[string]interface{}{
+			"Everywhere": []interface{}{
+				map[string]interface{}{"Bridge": "Upstairs", "Light": "Desk"},
+				map[string]interface{}{"Bridge": "Downstairs", "Light": "Hall"},
+				map[string]interface{}{"Bridge": "Downstairs", "Light": "Attic"},
+				map[string]interface{}{"Bridge": "Garden", "Light": "Path"},
+			},
+		},
+	})
+	aliases, err := parseAliases(config, map[string]bool{
+		"Upstairs": true, "Downstairs": true, "Garden": true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &fakeClient{}
+	oldClient := newClient
+	newClient = func(uri string, options ...mqtt.Option) (casa.MessageClient, error) {
+		return client, nil
+	}
+	defer func() { newClient = oldClient }()
+
+	// The Garden bridge failed to start
+	mb := &Multibridge{
+		bridges: []*Bridge{b1, b2},
+		named:   map[string]*Bridge{"Upstairs": b1, "Downstairs": b2},
+	}
+	mb.UseLogger(&testLogger{})
+	err = mb.serveAliases(config, aliases)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(client.subscribed, []string{"Service/Hue/Alias/#"}) {
+		t.Errorf("Subscribed to %v, want the alias topics", client.subscribed)
+	}
+
+	client.send("Service/Hue/Alias/Everywhere/On/Set", "true")
+
+	for _, light := range []struct {
+		f    *fakeBridge
+		id   string
+		want bool
+	}{
+		{upstairs, "1", true},
+		{downstairs, "1", true},
+		{downstairs, "2", false},
+	} {
+		if got := light.f.state(light.id)["on"]; got != light.want {
+			t.Errorf("Light %s on = %v, want %v", light.id, got, light.want)
+		}
+	}
+
+	var result BulkResult
+	err = json.Unmarshal([]byte(client.waitFor(t, "Service/Hue/Alias/Everywhere/On/Result")), &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Downstairs/Hall", "Upstairs/Desk"}; !reflect.DeepEqual(result.Succeeded, want) {
+		t.Errorf("Succeeded = %v, want %v", result.Succeeded, want)
+	}
+	if len(result.Failed) != 2 ||
+		!strings.Contains(result.Failed["Downstairs/Attic"], "Unknown light") ||
+		!strings.Contains(result.Failed["Garden/Path"], "isn't running") {
+		t.Errorf("Failed = %v, want the unknown light and the stopped bridge", result.Failed)
+	}
+
+	if _, err := mb.SetAlias("Nowhere", "On", "true"); err == nil {
+		t.Error("SetAlias accepted an unknown alias")
+	}
+	result2, err := mb.SetAlias("everywhere", "Rename", "Lamp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result2.Succeeded) != 0 {
+		t.Errorf("Rename was sent to %v through an alias", result2.Succeeded)
+	}
+}
+
+func TestParseAliases(t *testing.T) {
+	namespaces := map[string]bool{"Upstairs": true}
+	tests := []struct {
+		name    string
+		aliases interface{}
+		ok      bool
+	}{
+		{"valid", map[string]interface{}{
+			"Downstairs": []interface{}{map[string]interface{}{"Bridge": "Upstairs", "Light": "Desk"}},
+		}, true},
+		{"unknown bridge", map[string]interface{}{
+			"Downstairs": []interface{}{map[string]interface{}{"Bridge": "Cellar", "Light": "Desk"}},
+		}, false},
+		{"no light", map[string]interface{}{
+			"Downstairs": []interface{}{map[string]interface{}{"Bridge": "Upstairs"}},
+		}, false},
+		{"no members", map[string]interface{}{"Downstairs": []interface{}{}}, false},
+		{"not a list", map[string]interface{}{"Downstairs": "Desk"}, false},
+	}
+
+	for _, test := range tests {
+		aliases, err := parseAliases(testConfig(map[string]interface{}{"Aliases": test.aliases}), namespaces)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: parseAliases returned %v, want ok %v", test.name, err, test.ok)
+		}
+		if test.ok && len(aliases["downstairs"]) != 1 {
+			t.Errorf("%s: parsed %v", test.name, aliases)
+		}
+	}
+}
+
+func TestMultibridgeStopWhileHandlingAliases(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	b, _, _ := startBridge(t, f, map[string]interface{}{"TopicNamespace": "Upstairs"})
+
+	client := &fakeClient{}
+	oldClient := newClient
+	newClient = func(uri string, options ...mqtt.Option) (casa.MessageClient, error) {
+		return client, nil
+	}
+	defer func() { newClient = oldClient }()
+
+	mb := &Multibridge{
+		bridges: []*Bridge{b},
+		named:   map[string]*Bridge{"Upstairs": b},
+	}
+	mb.UseLogger(&testLogger{})
+	err := mb.serveAliases(testConfig(nil), map[string][]aliasMember{
+		"everywhere": {{Bridge: "Upstairs", Light: "Desk"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				client.send("Service/Hue/Alias/Everywhere/On/Set", "true")
+			}
+		}()
+	}
+
+	err = mb.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	client.m.Lock()
+	unsubscribed, closed := client.unsubscribed, client.closed
+	client.m.Unlock()
+	if !reflect.DeepEqual(unsubscribed, []string{"Service/Hue/Alias/#"}) || !closed {
+		t.Errorf("Unsubscribed from %v, closed %v, want the alias topics and a closed client",
+			unsubscribed, closed)
+	}
+
+	client.reset()
+	client.send("Service/Hue/Alias/Everywhere/On/Set", "false")
+	if got, ok := client.last("Service/Hue/Alias/Everywhere/On/Result"); ok {
+		t.Errorf("An alias command after Stop published %s", got)
+	}
+}
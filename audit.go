@@ -0,0 +1,80 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// An entry written to the audit writer for each command to an endpoint
+type auditEntry struct {
+	Time     string `json:"time"`
+	Light    string `json:"light"`
+	Endpoint string `json:"endpoint"`
+	Payload  string `json:"payload"`
+	Success  bool   `json:"success"`
+	Error    string `json:"error,omitempty"`
+}
+
+// SetAuditWriter makes every command to a light or group endpoint, whether
+// sent over MQTT or through the Go API, write an entry to w as a line of JSON.
+// Passing nil stops auditing.
+func (b *Bridge) SetAuditWriter(w io.Writer) error {
+	b.auditM.Lock()
+	defer b.auditM.Unlock()
+	b.audit = w
+	return nil
+}
+
+// Reports whether an audit writer is set
+func (b *Bridge) auditing() bool {
+	b.auditM.Lock()
+	defer b.auditM.Unlock()
+	return b.audit != nil
+}
+
+// Writes an audit entry for a command to the endpoint of l, if an audit
+// writer is set
+func (b *Bridge) auditCommand(l *Light, endpoint, payload string, err error) {
+	entry := auditEntry{
+		Time:     time.Now().Format(time.RFC3339),
+		Light:    l.name,
+		Endpoint: endpoint,
+		Payload:  payload,
+		Success:  err == nil,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	data, merr := json.Marshal(entry)
+	if merr != nil {
+		b.Log(merr)
+		return
+	}
+
+	b.auditM.Lock()
+	defer b.auditM.Unlock()
+	if b.audit == nil {
+		return
+	}
+
+	_, werr := b.audit.Write(append(data, '\n'))
+	if werr != nil {
+		b.Log("Unable to write Hue audit entry:", werr)
+	}
+}
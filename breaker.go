@@ -0,0 +1,152 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/spf13/viper"
+)
+
+// Defaults for the circuit breaker around bridge calls
+const (
+	defaultBreakerThreshold = 5
+	defaultBreakerReset     = 30 * time.Second
+)
+
+// ErrBridgeUnavailable is returned without contacting the bridge while the
+// circuit breaker is open.
+var ErrBridgeUnavailable = errors.New("Hue bridge unavailable after repeated failures")
+
+// Returns the CircuitBreakerThreshold and CircuitBreakerResetSeconds settings
+// from config
+func breakerSettings(config *viper.Viper) (int, time.Duration) {
+	threshold := defaultBreakerThreshold
+	if n := config.GetInt("CircuitBreakerThreshold"); n > 0 {
+		threshold = n
+	}
+
+	reset := defaultBreakerReset
+	if seconds := config.GetInt("CircuitBreakerResetSeconds"); seconds > 0 {
+		reset = time.Duration(seconds) * time.Second
+	}
+	return threshold, reset
+}
+
+// Stops calls to the bridge after threshold consecutive transport or server
+// failures. Once reset has passed a single probe call is let through, which
+// closes the breaker if the bridge answers it.
+type breaker struct {
+	m         sync.Mutex
+	threshold int
+	reset     time.Duration
+	failures  int
+	open      bool
+	openedAt  time.Time
+	probing   bool
+}
+
+// Changes the failure threshold and reset time
+func (c *breaker) configure(threshold int, reset time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.threshold = threshold
+	c.reset = reset
+}
+
+// Returns ErrBridgeUnavailable if a call may not be made now
+func (c *breaker) allow() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if !c.open {
+		return nil
+	}
+	if c.probing || time.Since(c.openedAt) < c.reset {
+		return ErrBridgeUnavailable
+	}
+	c.probing = true
+	return nil
+}
+
+// Records the outcome of an allowed call and reports whether it opened or
+// closed the breaker. Only failures retryable reports count: an error about
+// the request itself means the bridge answered.
+func (c *breaker) record(err error) (opened, closed bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if errors.Cause(err) == context.Canceled {
+		// Stopped before the bridge answered
+		c.probing = false
+		return false, false
+	}
+	if err == nil || !retryable(err) {
+		closed = c.open
+		c.open = false
+		c.probing = false
+		c.failures = 0
+		return false, closed
+	}
+
+	c.failures++
+	if c.probing {
+		c.probing = false
+		c.openedAt = time.Now()
+		return false, false
+	}
+	if !c.open && c.failures >= c.threshold {
+		c.open = true
+		c.openedAt = time.Now()
+		return true, false
+	}
+	return false, false
+}
+
+// Makes the bridge call fn through the circuit breaker, publishing a
+// "degraded" Status when it opens and "online" when it closes again.
+func (b *Bridge) guard(fn func() error) error {
+	err := b.breaker.allow()
+	if err != nil {
+		return err
+	}
+
+	err = fn()
+	b.trackConnection(err)
+	b.recordCall(err)
+	return err
+}
+
+// Records the outcome of a call let through by the breaker, publishing a
+// "degraded" Status when it opens the breaker and "online" when it closes it.
+func (b *Bridge) recordCall(err error) {
+	opened, closed := b.breaker.record(err)
+	switch {
+	case opened:
+		b.Log("Hue bridge failing, pausing requests:", err)
+		if perr := b.publishStatus("degraded"); perr != nil {
+			b.Log(perr)
+		}
+	case closed:
+		b.Log("Hue bridge responding again")
+		if perr := b.publishStatus("online"); perr != nil {
+			b.Log(perr)
+		}
+	}
+}
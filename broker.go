@@ -0,0 +1,282 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/url"
+	"time"
+
+	"github.com/casaplatform/casa"
+	"github.com/casaplatform/mqtt"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// MQTT broker used when MQTTBroker isn't configured
+const defaultBroker = "tcp://127.0.0.1:1883"
+
+// Connects to the MQTT broker set by the MQTTBroker, MQTTUsername and
+// MQTTPassword config keys, with any additional client options. The older
+// MQTT.User and MQTT.Pass keys are used when MQTTUsername isn't set.
+func connectBroker(config *viper.Viper, options ...mqtt.Option) (casa.MessageClient, error) {
+	broker := defaultBroker
+	if config.IsSet("MQTTBroker") {
+		broker = config.GetString("MQTTBroker")
+	}
+
+	uri, err := url.Parse(broker)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid MQTTBroker")
+	}
+
+	user, pass := config.GetString("MQTTUsername"), config.GetString("MQTTPassword")
+	if user == "" {
+		user, pass = config.GetString("MQTT.User"), config.GetString("MQTT.Pass")
+	}
+	if user != "" {
+		uri.User = url.UserPassword(user, pass)
+	}
+
+	tlsConfig, err := brokerTLS(config)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		options = append(options, mqtt.TLS(tlsConfig))
+	}
+
+	return newClient(uri.String(), options...)
+}
+
+// Connects an MQTT client to the broker at uri. Replaced by tests.
+var newClient = func(uri string, options ...mqtt.Option) (casa.MessageClient, error) {
+	client, err := mqtt.NewClient(uri, options...)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// Returns the TLS configuration for the broker connection from the MQTTCACert,
+// MQTTClientCert and MQTTClientKey config keys, or nil if none are set. Setting
+// the client certificate and key enables mutual authentication.
+func brokerTLS(config *viper.Viper) (*tls.Config, error) {
+	ca := config.GetString("MQTTCACert")
+	cert := config.GetString("MQTTClientCert")
+	key := config.GetString("MQTTClientKey")
+
+	if ca == "" && cert == "" && key == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{}
+
+	if ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to read MQTTCACert")
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificates found in MQTTCACert " + ca)
+		}
+	}
+
+	if cert != "" || key != "" {
+		if cert == "" || key == "" {
+			return nil, errors.New("MQTTClientCert and MQTTClientKey must be set together")
+		}
+
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to load MQTT client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+
+	return tlsConfig, nil
+}
+
+// Delays between attempts to reconnect to the MQTT broker
+const (
+	brokerRetryBaseDelay = time.Second
+	brokerRetryMaxDelay  = 2 * time.Minute
+)
+
+// Called by the MQTT client when the broker connection drops. Asks the broker
+// reconnect loop to take over.
+func (b *Bridge) brokerLost(err error) {
+	b.Log("Lost connection to MQTT broker:", err)
+
+	b.cm.Lock()
+	b.brokerConnected = false
+	b.cm.Unlock()
+
+	select {
+	case b.brokerDown <- struct{}{}:
+	default:
+	}
+}
+
+// Reconnects to the MQTT broker whenever the connection drops, retrying with
+// exponential backoff, until ctx is done.
+func (b *Bridge) brokerLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-b.brokerDown:
+		}
+
+		delay := brokerRetryBaseDelay
+		for {
+			err := b.reconnectBroker(ctx)
+			if err == nil {
+				b.Log("Reconnected to MQTT broker")
+				break
+			}
+			b.Log("Unable to reconnect to MQTT broker, retrying in "+delay.String()+":", err)
+
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			delay *= 2
+			if delay > brokerRetryMaxDelay {
+				delay = brokerRetryMaxDelay
+			}
+		}
+	}
+}
+
+// Connects a new MQTT client, subscribes and handles messages with it in place
+// of the lost one, then publishes every retained topic again.
+func (b *Bridge) reconnectBroker(ctx context.Context) error {
+	b.m.RLock()
+	config := b.config
+	b.m.RUnlock()
+
+	client, err := connectBroker(config, b.brokerOptions...)
+	if err != nil {
+		return err
+	}
+
+	err = client.Subscribe(b.root + "/#")
+	if err != nil {
+		client.Close()
+		return err
+	}
+
+	b.cm.Lock()
+	select {
+	case <-ctx.Done():
+		// Stopped while reconnecting
+		b.cm.Unlock()
+		return client.Close()
+	default:
+	}
+	old := b.client
+	b.client = client
+	b.brokerConnected = true
+	b.cm.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+
+	client.Handle(b.handler)
+	return b.republish()
+}
+
+// Publishes every retained topic again, as when starting
+func (b *Bridge) republish() error {
+	err := b.publishStatus("online")
+	if err != nil {
+		return err
+	}
+
+	err = b.publishInfo()
+	if err != nil {
+		return err
+	}
+
+	err = b.publishWhitelist()
+	if err != nil {
+		return err
+	}
+
+	err = b.publishScenes()
+	if err != nil {
+		return err
+	}
+
+	err = b.publishSceneIDs()
+	if err != nil {
+		return err
+	}
+
+	err = b.publishColors()
+	if err != nil {
+		return err
+	}
+
+	err = b.publishSchedules()
+	if err != nil {
+		return err
+	}
+
+	err = b.publishDevices()
+	if err != nil {
+		return err
+	}
+
+	return b.publishDiscoveryComplete()
+}
+
+// Publishes the endpoints of every light and group and the readings of every
+// sensor
+func (b *Bridge) publishDevices() error {
+	b.m.RLock()
+	defer b.m.RUnlock()
+
+	for _, light := range b.lights {
+		err := light.publishEndpoints()
+		if err != nil {
+			return err
+		}
+	}
+	for _, group := range b.groups {
+		err := group.publishEndpoints()
+		if err != nil {
+			return err
+		}
+	}
+	for _, sensor := range b.sensors {
+		err := sensor.publishAll()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
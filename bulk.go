@@ -0,0 +1,182 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/casaplatform/casa"
+)
+
+// BulkResult summarizes a command applied to every light on the bridge. A
+// failing light does not stop the command from being applied to the rest.
+type BulkResult struct {
+	Succeeded []string          `json:"succeeded"`
+	Failed    map[string]string `json:"failed"`
+}
+
+// Runs a command addressed to the bridge rather than to a single light
+func (b *Bridge) bridgeCommand(command, payload string) error {
+	switch command {
+	case "AllOn":
+		_, err := b.AllOn()
+		return err
+	case "AllOff":
+		_, err := b.AllOff()
+		return err
+	case "Fade":
+		return b.fadeCommand(payload)
+	case "Whitelist":
+		return b.publishWhitelist()
+	case "WhitelistDelete":
+		return b.DeleteWhitelistEntry(payload)
+	case "Colors/Reload":
+		return b.reloadColors()
+	}
+	return errors.New("Unknown bridge command: " + command)
+}
+
+// AllOn turns on every light on the bridge at once, as a command to
+// AllOn/Set does, and publishes the result to AllOn/Result and the failures to
+// AllOn/Errors.
+func (b *Bridge) AllOn() (*BulkResult, error) {
+	return b.applyToAll(b.topicName("On"), "true", b.path+"/AllOn")
+}
+
+// AllOff turns off every light on the bridge at once, as a command to
+// AllOff/Set does, and publishes the result to AllOff/Result and the failures
+// to AllOff/Errors.
+func (b *Bridge) AllOff() (*BulkResult, error) {
+	return b.applyToAll(b.topicName("On"), "false", b.path+"/AllOff")
+}
+
+// Endpoints that only make sense for one light at a time, such as Rename,
+// which would give every light the same name
+var singleLightEndpoints = []string{"Rename"}
+
+// Sets the endpoint named by the topic segment to payload on every light at
+// once, for commands sent to All/{Endpoint}/Set, and publishes the outcome to
+// All/{Endpoint}/Result and All/{Endpoint}/Errors.
+func (b *Bridge) setAllEndpoint(segment, payload string) (*BulkResult, error) {
+	return b.applyToAll(segment, payload, b.path+"/All/"+segment)
+}
+
+// Sets the endpoint named by the topic segment to payload on every light at
+// once, continuing through failures, and publishes the outcome. {topic}/Result
+// gets the whole BulkResult, and {topic}/Errors a JSON object of the error of
+// each light that failed, keyed by light name, which is empty when none did.
+// The lights share a burst beyond the rate limit. Nothing is sent to the
+// lights without a client to report the outcome through.
+func (b *Bridge) applyToAll(segment, payload, topic string) (*BulkResult, error) {
+	if !b.connected() {
+		return nil, ErrNotConnected
+	}
+
+	for _, point := range singleLightEndpoints {
+		if segment == b.topicName(point) {
+			return nil, errors.New(point + " can't be sent to every light")
+		}
+	}
+
+	var (
+		m      sync.Mutex
+		wg     sync.WaitGroup
+		result = &BulkResult{
+			Succeeded: []string{},
+			Failed:    make(map[string]string),
+		}
+	)
+
+	b.m.RLock()
+	lights := make([]*Light, 0, len(b.lights))
+	for _, light := range b.lights {
+		lights = append(lights, light)
+	}
+
+	b.withBurst(lights, len(lights), func() {
+		for _, light := range lights {
+			wg.Add(1)
+			go func(light *Light) {
+				defer wg.Done()
+
+				endpoint := light.endpointName(segment)
+				err := light.setEndpointState(endpoint, payload)
+				if perr := light.publishError(endpoint, err); perr != nil {
+					b.Log(perr)
+				}
+
+				m.Lock()
+				defer m.Unlock()
+				if err != nil {
+					result.Failed[light.name] = err.Error()
+					return
+				}
+				result.Succeeded = append(result.Succeeded, light.name)
+			}(light)
+		}
+		wg.Wait()
+	})
+	b.m.RUnlock()
+
+	sort.Strings(result.Succeeded)
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return result, err
+	}
+
+	err = b.publish(casa.Message{
+		Topic:   topic + "/Result",
+		Payload: data,
+	})
+	if err != nil {
+		return result, err
+	}
+
+	data, err = json.Marshal(result.Failed)
+	if err != nil {
+		return result, err
+	}
+
+	return result, b.publish(casa.Message{
+		Topic:   topic + "/Errors",
+		Payload: data,
+	})
+}
+
+// Runs fn as a bulk operation setting the lights, granting the rate limiter a
+// burst of up to requests on top of the steady rate. Only state changes of
+// these lights made while fn runs may use the burst, so commands to other
+// lights, and every command once fn returns, stay limited.
+func (b *Bridge) withBurst(lights []*Light, requests int, fn func()) {
+	for _, light := range lights {
+		light.m.Lock()
+		light.bulk++
+		light.m.Unlock()
+	}
+	defer func() {
+		for _, light := range lights {
+			light.m.Lock()
+			light.bulk--
+			light.m.Unlock()
+		}
+	}()
+
+	b.limiter.grantBurst(requests)
+	fn()
+}
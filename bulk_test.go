@@ -0,0 +1,109 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestAllOnContinuesThroughFailures(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	f.addLight("2", "Hall", "Extended color light")
+	f.addLight("3", "Porch", "Extended color light")
+	_, client, _ := startBridge(t, f, nil)
+
+	f.m.Lock()
+	f.intercept = func(r *http.Request) (int, string, bool) {
+		if r.Method == "PUT" && r.URL.Path == "/api/test/lights/2/state" {
+			return http.StatusOK, `[{"error":{"type":201,"address":"/lights/2/state/on","description":"device is set to off"}}]`, true
+		}
+		return 0, "", false
+	}
+	f.m.Unlock()
+
+	tests := []struct {
+		command string
+		on      bool
+	}{
+		{"/AllOn", true},
+		{"/AllOff", false},
+		{"/All/On", true},
+	}
+
+	for _, test := range tests {
+		client.reset()
+		client.send(testPath+test.command+"/Set", strconv.FormatBool(test.on))
+
+		var result BulkResult
+		payloads := client.payloads(testPath + test.command + "/Result")
+		if len(payloads) != 1 {
+			t.Fatalf("%s published %d results, want 1", test.command, len(payloads))
+		}
+		err := json.Unmarshal([]byte(payloads[0]), &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(result.Succeeded, []string{"Desk", "Porch"}) ||
+			len(result.Failed) != 1 || result.Failed["Hall"] == "" {
+			t.Errorf("%s result = %+v, want Hall to fail", test.command, result)
+		}
+		if f.state("1")["on"] != test.on || f.state("3")["on"] != test.on {
+			t.Errorf("%s didn't switch the other lights", test.command)
+		}
+		if got, _ := client.last(testPath + "/Light/Hall/On/Error"); got == "" {
+			t.Errorf("%s didn't publish the failure of Hall", test.command)
+		}
+	}
+}
+
+func TestAllEndpoint(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	f.addLight("2", "Hall", "Dimmable light")
+	b, client, _ := startBridge(t, f, nil)
+
+	client.send(testPath+"/All/Brightness/Set", "50")
+	for _, id := range []string{"1", "2"} {
+		if got := f.state(id)["bri"]; got != float64(127) {
+			t.Errorf("Light %s bri = %v, want 127", id, got)
+		}
+	}
+	if got, _ := client.last(testPath + "/All/Brightness/Errors"); got != "{}" {
+		t.Errorf("All/Brightness/Errors = %q, want {}", got)
+	}
+
+	result, err := b.setAllEndpoint("Hue", "1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Succeeded) != 1 || result.Failed["Hall"] == "" {
+		t.Errorf("Hue result = %+v, want the dimmable light to fail", result)
+	}
+
+	var failed map[string]string
+	payload, _ := client.last(testPath + "/All/Hue/Errors")
+	err = json.Unmarshal([]byte(payload), &failed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed["Hall"] != result.Failed["Hall"] {
+		t.Errorf("All/Hue/Errors = %s, want the error of Hall", payload)
+	}
+}
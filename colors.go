@@ -0,0 +1,528 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/casaplatform/casa"
+	"github.com/inhies/GoHue"
+	"github.com/spf13/viper"
+)
+
+// Gamut is the triangle of xy colors a light is able to display, given by its
+// red, green and blue corners.
+type Gamut struct {
+	Red   [2]float32 `json:"red"`
+	Green [2]float32 `json:"green"`
+	Blue  [2]float32 `json:"blue"`
+}
+
+// The color gamuts of Hue lights, from
+// http://www.developers.meethue.com/documentation/supported-lights
+var gamuts = map[string]Gamut{
+	"A": {
+		Red:   [2]float32{0.704, 0.296},
+		Green: [2]float32{0.2151, 0.7106},
+		Blue:  [2]float32{0.138, 0.08},
+	},
+	"B": {
+		Red:   [2]float32{0.675, 0.322},
+		Green: [2]float32{0.409, 0.518},
+		Blue:  [2]float32{0.167, 0.04},
+	},
+	"C": {
+		Red:   [2]float32{0.692, 0.308},
+		Green: [2]float32{0.17, 0.7},
+		Blue:  [2]float32{0.153, 0.048},
+	},
+}
+
+// The gamut of each known Hue light model
+var modelGamuts = map[string]string{
+	"LST001": "A", "LLC005": "A", "LLC006": "A", "LLC007": "A",
+	"LLC010": "A", "LLC011": "A", "LLC012": "A", "LLC013": "A",
+	"LLC014": "A",
+
+	"LCT001": "B", "LCT002": "B", "LCT003": "B", "LCT007": "B",
+	"LLM001": "B",
+
+	"LCT010": "C", "LCT011": "C", "LCT012": "C", "LCT014": "C",
+	"LCT015": "C", "LCT016": "C", "LLC020": "C", "LST002": "C",
+}
+
+// DetectGamut returns the gamut, "A", "B" or "C", of the Hue light model, or
+// an empty string if the model is unknown.
+func DetectGamut(modelID string) string {
+	return modelGamuts[modelID]
+}
+
+// Returns the gamut of the light as JSON, or "None" if it isn't known
+func (l *Light) gamutState() (string, error) {
+	name := DetectGamut(l.Light.ModelID)
+	if name == "" {
+		return "None", nil
+	}
+
+	data, err := json.Marshal(struct {
+		Name string `json:"gamut"`
+		Gamut
+	}{name, gamuts[name]})
+	return string(data), err
+}
+
+// Returns the gamut of the light, or gamut C, which most current lights use,
+// if the model is unknown
+func (l *Light) gamut() Gamut {
+	if gam, ok := gamuts[DetectGamut(l.Light.ModelID)]; ok {
+		return gam
+	}
+	return gamuts["C"]
+}
+
+// Returns a uniformly random xy color inside the gamut, by picking random
+// barycentric coordinates and folding those outside the triangle back in.
+func (g Gamut) random() [2]float32 {
+	u, v := rand.Float32(), rand.Float32()
+	if u+v > 1 {
+		u, v = 1-u, 1-v
+	}
+
+	return [2]float32{
+		g.Red[0] + u*(g.Green[0]-g.Red[0]) + v*(g.Blue[0]-g.Red[0]),
+		g.Red[1] + u*(g.Green[1]-g.Red[1]) + v*(g.Blue[1]-g.Red[1]),
+	}
+}
+
+// Formats an xy color as the "x,y" payload used by the XY Color endpoint
+func formatXY(xy [2]float32) string {
+	return strconv.FormatFloat(float64(xy[0]), 'f', -1, 32) + "," +
+		strconv.FormatFloat(float64(xy[1]), 'f', -1, 32)
+}
+
+// Returns the cross product of the vectors a->b and a->p, which is positive
+// when p is to the left of the line from a to b.
+func cross(a, b, p [2]float32) float64 {
+	return float64(b[0]-a[0])*float64(p[1]-a[1]) -
+		float64(b[1]-a[1])*float64(p[0]-a[0])
+}
+
+// Reports whether the xy color p is inside the gamut
+func (g Gamut) contains(p [2]float32) bool {
+	d1 := cross(g.Red, g.Green, p)
+	d2 := cross(g.Green, g.Blue, p)
+	d3 := cross(g.Blue, g.Red, p)
+
+	negative := d1 < 0 || d2 < 0 || d3 < 0
+	positive := d1 > 0 || d2 > 0 || d3 > 0
+	return !(negative && positive)
+}
+
+// Returns the point on the line segment from a to b closest to p
+func closestOnSegment(a, b, p [2]float32) [2]float32 {
+	ax, ay := float64(a[0]), float64(a[1])
+	dx, dy := float64(b[0])-ax, float64(b[1])-ay
+
+	t := ((float64(p[0])-ax)*dx + (float64(p[1])-ay)*dy) / (dx*dx + dy*dy)
+	t = math.Max(0, math.Min(1, t))
+	return [2]float32{float32(ax + t*dx), float32(ay + t*dy)}
+}
+
+// Returns p if it is inside the gamut, otherwise the closest color on the
+// edge of the gamut.
+func (g Gamut) closest(p [2]float32) [2]float32 {
+	if g.contains(p) {
+		return p
+	}
+
+	var best [2]float32
+	bestDist := math.Inf(1)
+	for _, edge := range [][2][2]float32{
+		{g.Red, g.Green}, {g.Green, g.Blue}, {g.Blue, g.Red},
+	} {
+		q := closestOnSegment(edge[0], edge[1], p)
+		dist := math.Hypot(float64(q[0]-p[0]), float64(q[1]-p[1]))
+		if dist < bestDist {
+			best, bestDist = q, dist
+		}
+	}
+	return best
+}
+
+// Reverses the sRGB gamma companding of a color component from 0-1
+func linearize(c float64) float64 {
+	if c > 0.04045 {
+		return math.Pow((c+0.055)/1.055, 2.4)
+	}
+	return c / 12.92
+}
+
+// RGBToXY converts an sRGB color to xy coordinates using the conversion
+// recommended by Philips, moving the result inside the gamut ("A", "B" or
+// "C") if it falls outside. Colors are left unclamped for unknown gamuts.
+func RGBToXY(r, g, b uint8, gamut string) [2]float32 {
+	red := linearize(float64(r) / 255)
+	green := linearize(float64(g) / 255)
+	blue := linearize(float64(b) / 255)
+
+	X := red*0.664511 + green*0.154324 + blue*0.162028
+	Y := red*0.283881 + green*0.668433 + blue*0.047685
+	Z := red*0.000088 + green*0.072310 + blue*0.986039
+
+	// Black has no chromaticity, so use the white point
+	if X+Y+Z == 0 {
+		return *hue.WHITE
+	}
+
+	xy := [2]float32{float32(X / (X + Y + Z)), float32(Y / (X + Y + Z))}
+	if gam, ok := gamuts[gamut]; ok {
+		xy = gam.closest(xy)
+	}
+	return xy
+}
+
+// The color temperature range of Hue lights, in mireds
+const (
+	minMireds = 153
+	maxMireds = 500
+)
+
+// KelvinToMireds converts a color temperature in Kelvin to mireds. Color
+// temperatures below 16K, which are beyond the range of mireds, convert to the
+// largest mired value.
+func KelvinToMireds(k float64) uint16 {
+	m := math.Floor(1000000/k + 0.5)
+	if !(k > 0) || m > math.MaxUint16 {
+		return math.MaxUint16
+	}
+	return uint16(m)
+}
+
+// MiredsToKelvin converts a color temperature in mireds to Kelvin
+func MiredsToKelvin(m uint16) float64 {
+	return 1000000 / float64(m)
+}
+
+// Returns the range of color temperatures, in mireds, the light supports. The
+// range of Hue lights in general is used if the bridge didn't report one.
+func (l *Light) ctRange() (min, max uint16) {
+	if l.ctMin == 0 || l.ctMax == 0 {
+		return minMireds, maxMireds
+	}
+	return l.ctMin, l.ctMax
+}
+
+// The capabilities and configuration of each light reported by the lights API,
+// keyed by Hue light ID
+type lightCapabilities map[string]struct {
+	Capabilities struct {
+		Control struct {
+			CT struct {
+				Min uint16 `json:"min"`
+				Max uint16 `json:"max"`
+			} `json:"ct"`
+		} `json:"control"`
+	} `json:"capabilities"`
+	Config struct {
+		Startup struct {
+			Mode string `json:"mode"`
+		} `json:"startup"`
+	} `json:"config"`
+}
+
+// Reads the color temperature range and power on behavior of each light from
+// the bridge. Older bridges don't report capabilities, leaving the lights with
+// the general range and an unknown power on behavior.
+func (b *Bridge) loadCapabilities() error {
+	err := b.requireV2("Reading light capabilities")
+	if err != nil {
+		return err
+	}
+
+	var body []byte
+	err = b.guard(func() (err error) {
+		body, _, err = b.hueBridge().Get("/api/" + b.User + "/lights")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	var caps lightCapabilities
+	err = json.Unmarshal(body, &caps)
+	if err != nil {
+		return err
+	}
+
+	for id, light := range b.lights {
+		light.m.Lock()
+		light.powerOn = caps[id].Config.Startup.Mode
+		light.m.Unlock()
+
+		ct := caps[id].Capabilities.Control.CT
+		if ct.Min == 0 || ct.Max < ct.Min {
+			continue
+		}
+		light.ctMin, light.ctMax = ct.Min, ct.Max
+	}
+	return nil
+}
+
+// Returns ct within the color temperature range of the light. If it is outside
+// the range, it is clamped to the range when ClampColorTemp is set, otherwise
+// an error is returned.
+func (l *Light) checkCT(ct uint16) (uint16, error) {
+	min, max := l.ctRange()
+	if ct >= min && ct <= max {
+		return ct, nil
+	}
+
+	if !l.bridge.clampColorTemp {
+		return ct, errors.New("Color temperature must be from " +
+			strconv.Itoa(int(min)) + "-" + strconv.Itoa(int(max)) + " mireds")
+	}
+
+	clamped := min
+	if ct > max {
+		clamped = max
+	}
+	l.bridge.Log("Warning: clamping color temperature " + strconv.Itoa(int(ct)) +
+		" for " + l.Light.Name + " to " + strconv.Itoa(int(clamped)))
+	return clamped, nil
+}
+
+// Returns the canonical name and xy coordinates of the named color from
+// Colors, ignoring case. The error for unknown names lists the valid ones.
+func lookupColor(name string) (string, *[2]float32, error) {
+	colorsM.RLock()
+	defer colorsM.RUnlock()
+
+	names := make([]string, 0, len(Colors))
+	for known, xy := range Colors {
+		if strings.EqualFold(known, name) {
+			return known, xy, nil
+		}
+		names = append(names, known)
+	}
+
+	sort.Strings(names)
+	return "", nil, errors.New("Invalid color name " + strconv.Quote(name) +
+		"; valid names are: " + strings.Join(names, ", "))
+}
+
+// Default furthest xy distance at which a color is named after the nearest
+// entry in Colors
+const defaultColorNameThreshold = 0.05
+
+// Returns the ColorNameThreshold setting from config
+func colorNameThreshold(config *viper.Viper) float64 {
+	threshold := config.GetFloat64("ColorNameThreshold")
+	if threshold <= 0 {
+		return defaultColorNameThreshold
+	}
+	return threshold
+}
+
+// Returns the name of the color in Colors nearest to xy, or "None" if none is
+// within threshold.
+func nearestColor(xy [2]float32, threshold float64) string {
+	colorsM.RLock()
+	defer colorsM.RUnlock()
+
+	nearest := "None"
+	for name, c := range Colors {
+		d := math.Hypot(float64(xy[0]-c[0]), float64(xy[1]-c[1]))
+		if d <= threshold {
+			nearest, threshold = name, d
+		}
+	}
+	return nearest
+}
+
+// The colors Colors starts with, which every colors file is loaded on top of
+var builtinColors = func() map[string]*[2]float32 {
+	c := make(map[string]*[2]float32, len(Colors))
+	for name, xy := range Colors {
+		c[name] = xy
+	}
+	return c
+}()
+
+// LoadColors replaces Colors with the built in colors plus those in the JSON
+// file at path, which replace built in colors of the same name. Colors from a
+// previously loaded file are dropped. The file maps names to [x, y] pairs, as
+// in {"Teal": [0.17, 0.34]}.
+func LoadColors(path string) error {
+	loaded, err := readColors(path)
+	if err != nil {
+		return err
+	}
+	setColors(loaded)
+	return nil
+}
+
+// Reads and validates the colors file at path without changing Colors
+func readColors(path string) (map[string]*[2]float32, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.New("Unable to read colors file: " + err.Error())
+	}
+
+	var file map[string][]float64
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, errors.New("Invalid colors file " + path + ": " + err.Error())
+	}
+
+	loaded := make(map[string]*[2]float32, len(file))
+	for name, xy := range file {
+		if len(xy) != 2 || xy[0] < 0 || xy[0] > 1 || xy[1] < 0 || xy[1] > 1 {
+			return nil, errors.New("Invalid colors file " + path + ": " + name +
+				" must be an [x, y] pair from 0-1")
+		}
+		loaded[name] = &[2]float32{float32(xy[0]), float32(xy[1])}
+	}
+	return loaded, nil
+}
+
+// Replaces Colors with the built in colors plus loaded
+func setColors(loaded map[string]*[2]float32) {
+	colors := make(map[string]*[2]float32, len(builtinColors)+len(loaded))
+	for name, xy := range builtinColors {
+		colors[name] = xy
+	}
+	for name, xy := range loaded {
+		// Names match ignoring case, so replace the color under any casing
+		for known := range colors {
+			if strings.EqualFold(known, name) {
+				delete(colors, known)
+			}
+		}
+		colors[name] = xy
+	}
+
+	colorsM.Lock()
+	Colors = colors
+	colorsM.Unlock()
+}
+
+// ListColors returns the sorted names of the colors in Colors
+func ListColors() []string {
+	colorsM.RLock()
+	defer colorsM.RUnlock()
+
+	names := make([]string, 0, len(Colors))
+	for name := range Colors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Publishes the color names as a JSON array to the Colors topic
+func (b *Bridge) publishColors() error {
+	payload, err := json.Marshal(ListColors())
+	if err != nil {
+		return err
+	}
+
+	return b.publish(casa.Message{
+		Topic:   b.path + "/Colors",
+		Payload: payload,
+		Retain:  true,
+	})
+}
+
+// Loads the ColorsFile again and publishes the resulting color names
+func (b *Bridge) reloadColors() error {
+	b.m.RLock()
+	path := b.config.GetString("ColorsFile")
+	b.m.RUnlock()
+
+	if path == "" {
+		return errors.New("Unable to reload colors, ColorsFile is not set")
+	}
+
+	err := LoadColors(path)
+	if err != nil {
+		return err
+	}
+	return b.publishColors()
+}
+
+// Converts a color with hue h from 0-360 and saturation s and lightness l from
+// 0-100 to a light state. The hue and saturation carry over to the Hue scales,
+// and the brightness is the HSV value of the color.
+func hslState(h, s, l float64) hue.LightState {
+	s, l = s/100, l/100
+	value := l + s*math.Min(l, 1-l)
+
+	bri := uint8(math.Round(value * 254))
+	if bri < 1 {
+		bri = 1
+	}
+
+	return hue.LightState{
+		Hue: uint16(math.Round(h * 65535 / 360)),
+		Sat: uint8(math.Round(s * 254)),
+		Bri: bri,
+		On:  true,
+	}
+}
+
+// Named color temperatures in mireds. Presets sharing a temperature are
+// reported by the name listed first.
+var ctPresets = []struct {
+	Name string
+	CT   uint16
+}{
+	{"warm", 370},
+	{"candle", 370},
+	{"sunset", 285},
+	{"neutral", 233},
+	{"cool", 182},
+	{"daylight", 153},
+}
+
+// Returns the name and mireds of the named color temperature preset, ignoring
+// case. The error for unknown names lists the valid ones.
+func ctPresetValue(name string) (string, uint16, error) {
+	names := make([]string, len(ctPresets))
+	for i, preset := range ctPresets {
+		if strings.EqualFold(preset.Name, name) {
+			return preset.Name, preset.CT, nil
+		}
+		names[i] = preset.Name
+	}
+	return "", 0, errors.New("Invalid color temperature preset " + strconv.Quote(name) +
+		"; valid presets are: " + strings.Join(names, ", "))
+}
+
+// Returns the name of the preset at ct mireds, or "None" if there is none
+func ctPresetName(ct uint16) string {
+	for _, preset := range ctPresets {
+		if preset.CT == ct {
+			return preset.Name
+		}
+	}
+	return "None"
+}
@@ -0,0 +1,285 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Reports whether the xy colors are within tolerance of each other
+func closeXY(a, b [2]float32, tolerance float64) bool {
+	return math.Abs(float64(a[0]-b[0])) <= tolerance &&
+		math.Abs(float64(a[1]-b[1])) <= tolerance
+}
+
+func TestDetectGamut(t *testing.T) {
+	tests := map[string]string{
+		"LST001": "A",
+		"LCT001": "B",
+		"LCT015": "C",
+		"LWB010": "",
+	}
+
+	for model, want := range tests {
+		if got := DetectGamut(model); got != want {
+			t.Errorf("DetectGamut(%s) = %q, want %q", model, got, want)
+		}
+	}
+}
+
+func TestRGBToXY(t *testing.T) {
+	tests := []struct {
+		name    string
+		r, g, b uint8
+		gamut   string
+		want    [2]float32
+	}{
+		{"red", 255, 0, 0, "", [2]float32{0.7006, 0.2993}},
+		{"green", 0, 255, 0, "", [2]float32{0.1724, 0.7468}},
+		{"blue", 0, 0, 255, "", [2]float32{0.1355, 0.0399}},
+		{"white", 255, 255, 255, "", [2]float32{0.3227, 0.329}},
+		{"black", 0, 0, 0, "", [2]float32{0.3227, 0.329}},
+		{"red in gamut C", 255, 0, 0, "C", [2]float32{0.6915, 0.3083}},
+	}
+
+	for _, test := range tests {
+		got := RGBToXY(test.r, test.g, test.b, test.gamut)
+		if !closeXY(got, test.want, 0.002) {
+			t.Errorf("%s: RGBToXY = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestKelvinToMireds(t *testing.T) {
+	tests := []struct {
+		kelvin float64
+		want   uint16
+	}{
+		{2000, 500},
+		{2700, 370},
+		{6500, 154},
+		{6536, 153},
+		{1000000, 1},
+		// Below 16K the result no longer fits in a uint16
+		{15.26, 65531},
+		{15.19, math.MaxUint16},
+		{1, math.MaxUint16},
+		{0, math.MaxUint16},
+		{-2700, math.MaxUint16},
+		{math.NaN(), math.MaxUint16},
+	}
+
+	for _, test := range tests {
+		if got := KelvinToMireds(test.kelvin); got != test.want {
+			t.Errorf("KelvinToMireds(%v) = %d, want %d", test.kelvin, got, test.want)
+		}
+	}
+}
+
+func TestMiredsToKelvin(t *testing.T) {
+	tests := []struct {
+		mireds uint16
+		want   float64
+	}{
+		{500, 2000},
+		{250, 4000},
+		{153, 6535.95},
+	}
+
+	for _, test := range tests {
+		if got := MiredsToKelvin(test.mireds); math.Abs(got-test.want) > 0.01 {
+			t.Errorf("MiredsToKelvin(%d) = %v, want %v", test.mireds, got, test.want)
+		}
+	}
+}
+
+func TestLookupColor(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"Red", "Red", true},
+		{"red", "Red", true},
+		{"PURPLE", "Purple", true},
+		{"Chartreuse", "", false},
+	}
+
+	for _, test := range tests {
+		got, xy, err := lookupColor(test.name)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("lookupColor(%q) = %q, %v, want %q, ok %v",
+				test.name, got, err, test.want, test.ok)
+		}
+		if test.ok && xy == nil {
+			t.Errorf("lookupColor(%q) returned no coordinates", test.name)
+		}
+		if !test.ok && (err == nil || !strings.Contains(err.Error(), "Red")) {
+			t.Errorf("lookupColor(%q) error %v doesn't list the valid names", test.name, err)
+		}
+	}
+}
+
+func TestNearestColor(t *testing.T) {
+	tests := []struct {
+		xy   [2]float32
+		want string
+	}{
+		{[2]float32{0.6915, 0.3083}, "Red"},
+		{[2]float32{0.68, 0.31}, "Red"},
+		{[2]float32{0.45, 0.2}, "None"},
+	}
+
+	for _, test := range tests {
+		if got := nearestColor(test.xy, defaultColorNameThreshold); got != test.want {
+			t.Errorf("nearestColor(%v) = %q, want %q", test.xy, got, test.want)
+		}
+	}
+}
+
+func TestLoadColors(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		err := ioutil.WriteFile(path, []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	defer setColors(nil)
+
+	first := write("first.json", `{"Teal": [0.17, 0.34], "red": [0.7, 0.3]}`)
+	err := LoadColors(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := lookupColor("Teal"); err != nil {
+		t.Error("Loaded color missing:", err)
+	}
+	if name, xy, _ := lookupColor("Red"); name != "red" || *xy != [2]float32{0.7, 0.3} {
+		t.Errorf("Red = %s %v, want the loaded color", name, xy)
+	}
+
+	// A second file replaces the first rather than adding to it
+	second := write("second.json", `{"Amber": [0.58, 0.41]}`)
+	err = LoadColors(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := lookupColor("Teal"); err == nil {
+		t.Error("Colors of the previous file were kept")
+	}
+	if name, xy, _ := lookupColor("Red"); name != "Red" || xy != Colors["Red"] {
+		t.Errorf("Red = %s %v, want the built in color", name, xy)
+	}
+
+	for _, content := range []string{`{"Bad": [0.5]}`, `{"Bad": [1.5, 0.2]}`, `not json`} {
+		err := LoadColors(write("bad.json", content))
+		if err == nil {
+			t.Errorf("LoadColors accepted %s", content)
+		}
+		if _, _, err := lookupColor("Amber"); err != nil {
+			t.Errorf("Rejected file %s changed the colors", content)
+		}
+	}
+}
+
+func TestListColors(t *testing.T) {
+	names := ListColors()
+	if len(names) != len(builtinColors) {
+		t.Fatalf("ListColors = %v, want the %d built in colors", names, len(builtinColors))
+	}
+	for i := 1; i < len(names); i++ {
+		if names[i-1] > names[i] {
+			t.Fatalf("ListColors = %v, not sorted", names)
+		}
+	}
+}
+
+func TestHSLState(t *testing.T) {
+	tests := []struct {
+		h, s, l  float64
+		hue      uint16
+		sat, bri uint8
+	}{
+		{0, 100, 50, 0, 254, 254},
+		{120, 100, 50, 21845, 254, 254},
+		{360, 0, 100, 65535, 0, 254},
+		{240, 50, 25, 43690, 127, 95},
+		{0, 0, 0, 0, 0, 1},
+	}
+
+	for _, test := range tests {
+		got := hslState(test.h, test.s, test.l)
+		if got.Hue != test.hue || got.Sat != test.sat || got.Bri != test.bri || !got.On {
+			t.Errorf("hslState(%v, %v, %v) = hue %d sat %d bri %d, want %d %d %d",
+				test.h, test.s, test.l, got.Hue, got.Sat, got.Bri,
+				test.hue, test.sat, test.bri)
+		}
+	}
+}
+
+func TestCTPresets(t *testing.T) {
+	for _, preset := range ctPresets {
+		name, ct, err := ctPresetValue(strings.ToUpper(preset.Name))
+		if err != nil || name != preset.Name || ct != preset.CT {
+			t.Errorf("ctPresetValue(%s) = %s %d %v", preset.Name, name, ct, err)
+		}
+	}
+	if ctPresetName(370) != "warm" {
+		t.Errorf("ctPresetName(370) = %s, want the first preset listed", ctPresetName(370))
+	}
+	if ctPresetName(300) != "None" {
+		t.Errorf("ctPresetName(300) = %s, want None", ctPresetName(300))
+	}
+	if _, _, err := ctPresetValue("tepid"); err == nil {
+		t.Error("ctPresetValue accepted an unknown preset")
+	}
+}
+
+func TestGamutRandom(t *testing.T) {
+	gamut := gamuts["C"]
+	for i := 0; i < 1000; i++ {
+		p := gamut.random()
+		if !gamut.contains(gamut.closest(p)) || !closeXY(p, gamut.closest(p), 1e-6) {
+			t.Fatalf("Random color %v is outside gamut C", p)
+		}
+	}
+}
+
+func TestGamutClosest(t *testing.T) {
+	for name, gamut := range gamuts {
+		// The corners and a point inside are left alone
+		inside := [2]float32{0.35, 0.35}
+		for _, p := range [][2]float32{gamut.Red, gamut.Green, gamut.Blue, inside} {
+			if got := gamut.closest(p); got != p {
+				t.Errorf("Gamut %s moved %v inside it to %v", name, p, got)
+			}
+		}
+
+		// Points outside end up on an edge
+		for _, p := range [][2]float32{{0.8, 0.2}, {0, 0}, {0.1, 0.9}} {
+			got := gamut.closest(p)
+			if !gamut.contains(got) && !closeXY(got, gamut.closest(got), 1e-6) {
+				t.Errorf("Gamut %s moved %v to %v, outside it", name, p, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// ConfigError lists the invalid settings found by ValidateConfig
+type ConfigError struct {
+	// Problems with each setting, keyed by setting name
+	Fields map[string]string
+}
+
+func (e *ConfigError) Error() string {
+	names := make([]string, 0, len(e.Fields))
+	for name := range e.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	problems := make([]string, len(names))
+	for i, name := range names {
+		problems[i] = name + ": " + e.Fields[name]
+	}
+	return "Invalid Hue config: " + strings.Join(problems, "; ")
+}
+
+// Settings that must be whole numbers of zero or more when set
+var countKeys = []string{"PollIntervalSeconds", "MaxBridgeRPS", "RetryAttempts",
+	"RetryBaseDelayMs", "CircuitBreakerThreshold", "CircuitBreakerResetSeconds", "InitWorkers", "SimStepMs", "SimMinBrightnessPercent", "SimMaxBrightnessPercent",
+	"SimMinIntervalSeconds", "SimMaxIntervalSeconds", "UndoDepth",
+	"DebounceMs", "StopDrainTimeoutSeconds", "HistoryDepth"}
+
+// Settings that must be booleans when set
+var flagKeys = []string{"LogUnknownTopics", "NormalizeTopicNames",
+	"AllowWhitelistDelete", "EchoCommands", "SnapshotOnStop", "RestoreOnStart",
+	"ClampColorTemp", "ReapplyOnRecovery"}
+
+// Settings that must be TCP port numbers when set
+var portKeys = []string{"MetricsPort", "HealthPort"}
+
+// Settings for MQTT QoS levels, which casa.Message and the MQTT client have no
+// way to pass on yet
+var qosKeys = []string{"MQTTPublishQoS", "MQTTSubscribeQoS"}
+
+// Matches a DNS hostname made of dot separated labels
+var hostnamePattern = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// ValidateConfig checks the settings in config without contacting the bridge
+// or the broker. It returns a *ConfigError describing every invalid setting,
+// or nil if there are none. MQTTPublishQoS and MQTTSubscribeQoS are rejected
+// until the MQTT client supports choosing a QoS level.
+func ValidateConfig(config *viper.Viper) error {
+	e := &ConfigError{Fields: make(map[string]string)}
+
+	if strings.TrimSpace(config.GetString("User")) == "" {
+		e.Fields["User"] = "must be set to a user registered with the Hue bridge"
+	}
+
+	if config.IsSet("BridgeIP") {
+		ip := config.GetString("BridgeIP")
+		if net.ParseIP(ip).To4() == nil && !hostnamePattern.MatchString(ip) {
+			e.Fields["BridgeIP"] = "must be an IPv4 address or hostname, not " + ip
+		}
+	}
+
+	for _, key := range countKeys {
+		if !config.IsSet(key) {
+			continue
+		}
+		n, err := cast.ToIntE(config.Get(key))
+		if err != nil || n < 0 {
+			e.Fields[key] = "must be a whole number of zero or more"
+		}
+	}
+
+	for _, key := range portKeys {
+		if !config.IsSet(key) {
+			continue
+		}
+		port, err := cast.ToIntE(config.Get(key))
+		if err != nil || port < 1 || port > 65535 {
+			e.Fields[key] = "must be a port number from 1-65535"
+		}
+	}
+
+	if config.IsSet("MetricsPort") && config.IsSet("HealthPort") &&
+		config.GetInt("MetricsPort") == config.GetInt("HealthPort") {
+		e.Fields["HealthPort"] = "must differ from MetricsPort"
+	}
+
+	if config.IsSet("ColorNameThreshold") {
+		threshold, err := cast.ToFloat64E(config.Get("ColorNameThreshold"))
+		if err != nil || threshold < 0 {
+			e.Fields["ColorNameThreshold"] = "must be a number of zero or more"
+		}
+	}
+
+	if config.IsSet("LowBatteryPercent") {
+		n, err := cast.ToIntE(config.Get("LowBatteryPercent"))
+		if err != nil || n < 0 || n > 100 {
+			e.Fields["LowBatteryPercent"] = "must be a percentage from 0-100"
+		}
+	}
+
+	for _, key := range flagKeys {
+		if !config.IsSet(key) {
+			continue
+		}
+		if _, err := cast.ToBoolE(config.Get(key)); err != nil {
+			e.Fields[key] = "must be true or false"
+		}
+	}
+
+	for _, key := range []string{"SvcPrefix", "TopicNamespace"} {
+		if config.IsSet(key) {
+			value := config.GetString(key)
+			if value == "" || strings.ContainsAny(value, "/+#") {
+				e.Fields[key] = "must be a single topic level without wildcards"
+			}
+		}
+	}
+
+	if (config.GetBool("SnapshotOnStop") || config.GetBool("RestoreOnStart")) &&
+		config.GetString("SnapshotFile") == "" {
+		e.Fields["SnapshotFile"] = "must be set to use SnapshotOnStop or RestoreOnStart"
+	}
+
+	if config.IsSet("MQTTBroker") {
+		uri, err := url.Parse(config.GetString("MQTTBroker"))
+		if err != nil || uri.Scheme == "" || uri.Host == "" {
+			e.Fields["MQTTBroker"] = "must be a URI such as " + defaultBroker
+		}
+	}
+
+	if (config.GetString("MQTTClientCert") == "") != (config.GetString("MQTTClientKey") == "") {
+		e.Fields["MQTTClientCert"] = "must be set together with MQTTClientKey"
+	}
+
+	for _, key := range qosKeys {
+		if config.IsSet(key) {
+			e.Fields[key] = "isn't supported yet; messages use the MQTT client's default QoS"
+		}
+	}
+
+	for name := range config.GetStringMap("Lights") {
+		key := "Lights." + name + ".OnBrightness"
+		if !config.IsSet(key) {
+			continue
+		}
+		n, err := cast.ToIntE(config.Get(key))
+		if err != nil || n < 0 || n > 100 {
+			e.Fields[key] = "must be a percentage from 0-100"
+		}
+	}
+
+	if len(e.Fields) > 0 {
+		return e
+	}
+	return nil
+}
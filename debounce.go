@@ -0,0 +1,112 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Returns the DebounceMs setting from config. Zero, the default, applies every
+// command as it arrives.
+func debounceDelay(config *viper.Viper) time.Duration {
+	return time.Duration(config.GetInt("DebounceMs")) * time.Millisecond
+}
+
+// A command waiting for the debounce delay to pass without another command to
+// the same endpoint
+type debounced struct {
+	timer   *time.Timer
+	payload string
+}
+
+// Debounces the commands sent to each endpoint that sets an absolute value, so
+// that a burst of commands, such as from a slider being dragged, calls the
+// bridge once with the last value.
+type debouncer struct {
+	m       sync.Mutex
+	pending map[string]*debounced // Keyed by light path and endpoint
+}
+
+// Sets the endpoint of light to payload once delay passes without another
+// command to it, replacing any command to the endpoint still waiting.
+// Endpoints that step, toggle or trigger something apply every command
+// straight away. b.m must be held.
+func (b *Bridge) debounce(light *Light, endpoint, payload string) {
+	delay := b.debounceDelay
+	point := light.endpoints[endpoint]
+	if delay <= 0 || point == nil || !point.Debounce {
+		b.applyCommand(light, endpoint, payload)
+		return
+	}
+
+	key := light.Path + "/" + endpoint
+	d := &debounced{payload: payload}
+
+	b.debouncer.m.Lock()
+	defer b.debouncer.m.Unlock()
+
+	if b.debouncer.pending == nil {
+		b.debouncer.pending = make(map[string]*debounced)
+	}
+	if old := b.debouncer.pending[key]; old != nil {
+		old.timer.Stop()
+	}
+	b.debouncer.pending[key] = d
+
+	d.timer = time.AfterFunc(delay, func() {
+		b.debouncer.m.Lock()
+		if b.debouncer.pending[key] != d {
+			// Replaced by a later command
+			b.debouncer.m.Unlock()
+			return
+		}
+		delete(b.debouncer.pending, key)
+		b.debouncer.m.Unlock()
+		if !b.beginCommand() {
+			return
+		}
+		defer b.inflight.Done()
+
+		b.m.RLock()
+		defer b.m.RUnlock()
+		b.applyCommand(light, endpoint, d.payload)
+	})
+}
+
+// Drops the commands still waiting for their debounce delay
+func (b *Bridge) cancelDebounced() {
+	b.debouncer.m.Lock()
+	defer b.debouncer.m.Unlock()
+
+	for key, d := range b.debouncer.pending {
+		d.timer.Stop()
+		delete(b.debouncer.pending, key)
+	}
+}
+
+// Sets the endpoint of light to payload and publishes the outcome to its
+// Error topic. b.m must be held.
+func (b *Bridge) applyCommand(light *Light, endpoint, payload string) {
+	err := light.setEndpointState(endpoint, payload)
+	if perr := light.publishError(endpoint, err); perr != nil {
+		b.Log(perr)
+	}
+	if err != nil {
+		b.Log(err)
+	}
+}
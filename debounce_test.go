@@ -0,0 +1,96 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDebounceCoalescesAbsoluteValues(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	_, client, _ := startBridge(t, f, map[string]interface{}{"DebounceMs": 50})
+
+	client.reset()
+	for _, percent := range []string{"10", "20", "30"} {
+		client.send(deskTopic("Brightness")+"/Set", percent)
+	}
+	if n := f.count("PUT", "/api/test/lights/1/state"); n != 0 {
+		t.Errorf("Sent %d states before the debounce delay passed", n)
+	}
+
+	if got := client.waitFor(t, deskTopic("Brightness")); got != "30" {
+		t.Errorf("Brightness = %q, want 30", got)
+	}
+	if n := f.count("PUT", "/api/test/lights/1/state"); n != 1 {
+		t.Errorf("Sent %d states for a burst of commands, want 1", n)
+	}
+	if got := f.state("1")["bri"]; got != float64(percentToBri(30)) {
+		t.Errorf("bri = %v, want the last command's %d", got, percentToBri(30))
+	}
+}
+
+func TestDebounceAppliesStepsImmediately(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	f.setState("1", map[string]interface{}{"on": true, "bri": float64(100)})
+	_, client, _ := startBridge(t, f, map[string]interface{}{"DebounceMs": 1000})
+
+	for i := 0; i < 3; i++ {
+		client.send(deskTopic("BrightnessUp")+"/Set", "10")
+	}
+	client.send(deskTopic("On")+"/Set", "true")
+
+	if n := f.count("PUT", "/api/test/lights/1/state"); n != 4 {
+		t.Errorf("Sent %d states for 4 step and toggle commands, want 4", n)
+	}
+	if got := f.state("1")["bri"]; got != float64(130) {
+		t.Errorf("bri = %v after three steps of 10 from 100, want 130", got)
+	}
+}
+
+func TestDebounceDefaultsToOff(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	b, client, _ := startBridge(t, f, nil)
+
+	if b.debounceDelay != 0 {
+		t.Errorf("Default debounce delay = %v, want 0", b.debounceDelay)
+	}
+
+	client.send(deskTopic("Brightness")+"/Set", "10")
+	client.send(deskTopic("Brightness")+"/Set", "20")
+	if n := f.count("PUT", "/api/test/lights/1/state"); n != 2 {
+		t.Errorf("Sent %d states without debouncing, want 2", n)
+	}
+}
+
+func TestStopDropsDebouncedCommands(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	b, client, _ := startBridge(t, f, map[string]interface{}{"DebounceMs": 50})
+
+	client.send(deskTopic("Brightness")+"/Set", "10")
+	err := b.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if n := f.count("PUT", "/api/test/lights/1/state"); n != 0 {
+		t.Error("A debounced command was sent after Stop")
+	}
+}
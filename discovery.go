@@ -0,0 +1,84 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// The Philips Hue discovery service, which lists the bridges registered from
+// the caller's public IP address.
+var discoveryURL = "https://discovery.meethue.com"
+
+// How long Start waits for bridge discovery
+const discoveryTimeout = 10 * time.Second
+
+// DiscoverBridges returns the IP addresses of the Hue bridges on the local
+// network, as reported by the Philips Hue discovery service.
+func DiscoverBridges(ctx context.Context) ([]string, error) {
+	req, err := http.NewRequest("GET", discoveryURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Hue discovery failed: " + resp.Status)
+	}
+
+	var found []struct {
+		ID string `json:"id"`
+		IP string `json:"internalipaddress"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&found)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]string, 0, len(found))
+	for _, bridge := range found {
+		ips = append(ips, bridge.IP)
+	}
+	return ips, nil
+}
+
+// Finds the IP of the Hue bridge to use when none is configured
+func (b *Bridge) discoverIP() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), discoveryTimeout)
+	defer cancel()
+
+	ips, err := DiscoverBridges(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(ips) == 0 {
+		return "", errors.New("No Hue bridge found, set BridgeIP in the config")
+	}
+
+	for _, ip := range ips[1:] {
+		b.Log("Warning: ignoring additional Hue bridge found at " + ip)
+	}
+	b.Log("Using discovered Hue bridge at " + ips[0])
+	return ips[0], nil
+}
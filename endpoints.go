@@ -15,94 +15,543 @@
 package hue
 
 import (
+	"context"
 	"errors"
+	"math"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/casaplatform/casa"
 	"github.com/inhies/GoHue"
 )
 
 // Endpoints are designed to be self documenting, hence the Params and Description
-// fields. A pointer to their parent Light is included so they can call other
-// endpoints, or call the parent Bridge's MessageBus client.
+// fields. SetState and GetState are passed the Light they act on so they can
+// call other endpoints, or call the parent Bridge's MessageBus client.
+// Metadata endpoints describe the light itself rather than its state, so they
+// are published without a New/ advertisement.
 type endpoint struct {
 	Params      string
 	Description string
-	SetState    func(light *Light, data string) error
-	GetState    func(light *Light, topic string) (string, error)
+	Metadata    bool
 
-	light *Light
+	// Sets an absolute value, so only the last of a burst of commands needs
+	// to reach the bridge
+	Debounce bool
+
+	SetState func(light *Light, data string) error
+	GetState func(light *Light, topic string) (string, error)
+}
+
+// Returns a copy of points for a single light, so that lights never share
+// endpoint values.
+func copyEndpoints(points map[string]*endpoint) map[string]*endpoint {
+	c := make(map[string]*endpoint, len(points))
+	for name, point := range points {
+		p := *point
+		c[name] = &p
+	}
+	return c
+}
+
+// Returns s with spaces, which some brokers reject in topics, replaced by
+// underscores
+func sanitizeTopic(s string) string {
+	return strings.Replace(s, " ", "_", -1)
+}
+
+// Returns the topic segment used for an endpoint. Endpoint names are human
+// readable, so spaces are replaced by underscores, e.g. "XY_Color". When the
+// NormalizeTopicNames option is set they are also lowercase, e.g. "xy_color".
+func (b *Bridge) topicName(point string) string {
+	name := sanitizeTopic(point)
+	if b.normalizeTopics {
+		name = strings.ToLower(name)
+	}
+	return name
+}
+
+// Returns the topic of the named endpoint
+func (l *Light) topic(point string) string {
+	return l.Path + "/" + l.bridge.topicName(point)
+}
+
+// Returns the name of the endpoint published under the topic segment, or the
+// segment itself if no endpoint uses it
+func (l *Light) endpointName(segment string) string {
+	for point := range l.endpoints {
+		if l.bridge.topicName(point) == segment {
+			return point
+		}
+	}
+	return segment
 }
 
+// ErrLocked is returned for commands to a light that has been locked through
+// its Lock endpoint.
+var ErrLocked = errors.New("Hue light is locked")
+
 // Sets the light endpoint to the specified state, returns an error if it
-// doesn't exist
+// doesn't exist. Commands to a locked light are rejected and published to
+// Lock/Rejected. Commands are recorded in the History, and successful changes
+// for Undo.
 func (l *Light) setEndpointState(endpoint, payload string) error {
+	return l.applyEndpointState(endpoint, payload, true)
+}
+
+// Sets the light endpoint as setEndpointState does, recording the change for
+// Undo only if record is set. The command is written to the audit writer, if
+// there is one.
+func (l *Light) applyEndpointState(endpoint, payload string, record bool) (err error) {
+	if l.bridge.auditing() {
+		defer func() { l.bridge.auditCommand(l, endpoint, payload, err) }()
+	}
+	if l.bridge.metrics != nil {
+		start := time.Now()
+		defer func() { l.bridge.metrics.observeCall(l.name, endpoint, err, time.Since(start)) }()
+	}
+
+	point := l.endpoints[endpoint]
+	if point == nil {
+		return errors.New("Unknown endpoint: " + endpoint)
+	}
+	if point.SetState == nil {
+		return errors.New("Endpoint is read only: " + endpoint)
+	}
+
+	l.m.RLock()
+	locked := l.locked
+	l.m.RUnlock()
+
+	if locked && endpoint != "Lock" {
+		err := l.bridge.publish(casa.Message{
+			Topic:   l.topic("Lock") + "/Rejected",
+			Payload: []byte(endpoint + ": " + payload),
+		})
+		if err != nil {
+			l.bridge.Log(err)
+		}
+		return ErrLocked
+	}
+
+	// The value before the command, for Undo and History
+	var old string
+	hasOld := false
+	if point.GetState != nil {
+		value, gerr := point.GetState(l, l.topic(endpoint))
+		old, hasOld = value, gerr == nil
+	}
+
+	err = point.SetState(l, payload)
+	l.recordHistory(endpoint, old, payload, err)
+	if err == nil && record && hasOld {
+		l.recordChange(endpoint, old)
+	}
+	if err != nil || !l.bridge.echoCommands || l.group != nil {
+		return err
+	}
+	return l.refreshState(endpoint)
+}
+
+// Publishes the current value of the endpoint, re-reading lights from the
+// bridge first. Returns an error if it doesn't exist
+func (l *Light) getEndpointState(endpoint string) error {
 	point := l.endpoints[endpoint]
 	if point == nil {
 		return errors.New("Unknown endpoint: " + endpoint)
 	}
-	return point.SetState(l, payload)
+	if point.GetState == nil {
+		return errors.New("Endpoint is write only: " + endpoint)
+	}
+
+	// Get always answers, even if the value hasn't changed
+	l.forgetPublished(endpoint)
+	if l.group != nil {
+		return l.publishState(endpoint)
+	}
+	return l.refreshState(endpoint)
+}
+
+// Stops the simulation started through the endpoint, for commands sent to
+// {Endpoint}/Stop/Set
+func (l *Light) stopEndpoint(endpoint string) error {
+	if l.endpoints[endpoint] == nil {
+		return errors.New("Unknown endpoint: " + endpoint)
+	}
+	l.stopSim()
+	return nil
+}
+
+// Publishes the failure of a command to the endpoint as the retained value of
+// its Error topic, or clears the topic once a command succeeds again.
+func (l *Light) publishError(endpoint string, err error) error {
+	if l.endpoints[endpoint] == nil {
+		return nil
+	}
+
+	l.m.Lock()
+	if err == nil && !l.failed[endpoint] {
+		l.m.Unlock()
+		return nil
+	}
+	if l.failed == nil {
+		l.failed = make(map[string]bool)
+	}
+	l.failed[endpoint] = err != nil
+	l.m.Unlock()
+
+	var payload []byte
+	if err != nil {
+		payload = []byte(err.Error())
+	}
+
+	return l.bridge.publish(casa.Message{
+		Topic:   l.topic(endpoint) + "/Error",
+		Payload: payload,
+		Retain:  true,
+	})
+}
+
+// Default transition time of the Hue bridge, in multiples of 100ms
+const defaultTransitionTime = 4
+
+// Returns a copy of the light as last read from or applied to the bridge. The
+// state is shared by the handler, the poll loop, fades and simulations, so it
+// is only read through here and only changed through changeState.
+func (l *Light) current() hue.Light {
+	l.m.RLock()
+	defer l.m.RUnlock()
+	return *l.Light
+}
+
+// Calls fn to change the light's state under the light's lock
+func (l *Light) changeState(fn func(cur *hue.Light)) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	fn(l.Light)
+}
+
+// Applies state to the light using the light's transition time, unless state
+// sets its own. Failed requests are retried, and accepted ones are recorded
+// for ReapplyOnRecovery. During a bulk operation the request may use the
+// operation's burst.
+func (l *Light) setState(state hue.LightState) error {
+	l.m.RLock()
+	if state.TransitionTime == "" {
+		state.TransitionTime = strconv.FormatUint(uint64(l.transitionTime), 10)
+	}
+	call := l.bridge.call
+	if l.bulk > 0 {
+		call = l.bridge.bulkCall
+	}
+	l.m.RUnlock()
+
+	err := call(func() error {
+		if l.group != nil {
+			return l.bridge.setGroupAction(l.group, groupAction(state))
+		}
+		light := l.current()
+		return light.SetState(state)
+	})
+	if err == nil {
+		l.recordCommand(state)
+	}
+	return err
+}
+
+// Re-reads the light from the bridge and publishes the confirmed values of
+// the named endpoints, which can differ from the requested ones when the
+// bridge clamps them.
+func (l *Light) refreshState(points ...string) error {
+	var fresh hue.Light
+	err := l.bridge.guard(func() (err error) {
+		fresh, err = l.bridge.hueBridge().GetLightByIndex(l.Light.Index)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	l.changeState(func(cur *hue.Light) { cur.State = fresh.State })
+	return l.publishState(points...)
+}
+
+// Publishes payload as the retained value of the named endpoint, unless it is
+// the value last published there
+func (l *Light) publish(point, payload string) error {
+	l.m.RLock()
+	last, ok := l.lastPublished[point]
+	l.m.RUnlock()
+	if ok && last == payload {
+		return nil
+	}
+
+	err := l.bridge.publish(casa.Message{
+		Topic:   l.topic(point),
+		Payload: []byte(payload),
+		Retain:  true,
+	})
+	if err != nil {
+		return err
+	}
+
+	l.m.Lock()
+	if l.lastPublished == nil {
+		l.lastPublished = make(map[string]string)
+	}
+	l.lastPublished[point] = payload
+	l.m.Unlock()
+
+	l.notify(point, payload)
+	return nil
+}
+
+// Forgets the last value published to each of the named endpoints, or to
+// every endpoint if none are named, so that the next publish goes through
+func (l *Light) forgetPublished(points ...string) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if len(points) == 0 {
+		l.lastPublished = nil
+		return
+	}
+	for _, point := range points {
+		delete(l.lastPublished, point)
+	}
+}
+
+// Publishes the current value of each of the named endpoints to their topics
+func (l *Light) publishState(points ...string) error {
+	for _, point := range points {
+		data := l.endpoints[point]
+		if data == nil || data.GetState == nil {
+			continue
+		}
+
+		payload, err := data.GetState(l, l.topic(point))
+		if err != nil {
+			return err
+		}
+
+		err = l.publish(point, payload)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Moves the brightness by the step in payload, in the direction of sign, and
+// publishes the step to point and the resulting brightness.
+func (l *Light) stepBrightness(point, payload string, sign int) error {
+	step, err := strconv.Atoi(payload)
+	if err != nil || step < 1 || step > 254 {
+		return errors.New("Brightness step must be from 1-254")
+	}
+
+	bri := int(l.current().State.Bri) + sign*step
+	if bri < 0 {
+		bri = 0
+	}
+	if bri > 254 {
+		bri = 254
+	}
+
+	state := hue.LightState{
+		Bri: uint8(bri),
+		On:  bri > 0,
+	}
+
+	err = l.setState(state)
+	if err != nil {
+		return err
+	}
+
+	l.changeState(func(cur *hue.Light) {
+		cur.State.Bri = state.Bri
+		cur.State.On = state.On
+	})
+
+	err = l.publish(point, payload)
+	if err != nil {
+		return err
+	}
+	return l.publishState("Brightness", "On")
+}
+
+// Applies a state holding a hue or saturation increment, publishes the step
+// to point and refreshes the Hue and Saturation topics from the bridge, which
+// is the only one to know the result of the increment.
+func (l *Light) stepColor(point, payload string, state hue.LightState) error {
+	err := l.setState(state)
+	if err != nil {
+		return err
+	}
+
+	err = l.publish(point, payload)
+	if err != nil || l.group != nil {
+		return err
+	}
+	return l.refreshState("Hue", "Saturation")
+}
+
+// Converts a brightness percentage to the 0-254 scale used by the bridge
+func percentToBri(percent int) uint8 {
+	return uint8(percent * 254 / 100)
+}
+
+// Converts a brightness on the 0-254 scale used by the bridge to a percentage
+func briToPercent(bri uint8) int {
+	return (int(bri)*100 + 127) / 254
+}
+
+// Effect names used on the topics, and the value the Hue API expects for each
+var effects = map[string]string{
+	"None":      "none",
+	"Colorloop": "colorloop",
+}
+
+// Returns the Hue API value for the named effect, ignoring case. The bridge
+// quietly ignores effects it doesn't know, so they are rejected here.
+func effectValue(name string) (string, error) {
+	for friendly, value := range effects {
+		if strings.EqualFold(name, friendly) {
+			return value, nil
+		}
+	}
+	return "", errors.New("Effect must be 'none' or 'colorloop'")
+}
+
+// Returns the effect name published for a Hue API effect value
+func effectName(value string) string {
+	for friendly, v := range effects {
+		if v == value {
+			return friendly
+		}
+	}
+	return value
+}
+
+// Alert names accepted on the topics in lower case, and the value the Hue API
+// expects for each
+var alerts = map[string]string{
+	"none":      "none",
+	"select":    "select",
+	"selected":  "select",
+	"lselect":   "lselect",
+	"lselected": "lselect",
+}
+
+// Returns the Hue API value for the named alert, ignoring case
+func alertValue(name string) (string, error) {
+	value, ok := alerts[strings.ToLower(name)]
+	if !ok {
+		return "", errors.New("Invalid alert " + strconv.Quote(name) +
+			", must be 'none', 'select' to flash once or 'lselect' to flash for 15 seconds")
+	}
+	return value, nil
 }
 
 // A list of all endpoints applicable to a hue.Light. Some might be missing.
 // Implemented just to get the package built and working.
 var endpoints = map[string]*endpoint{
 	"On": {
-		Params: "on bool", Description: "Turns the light on or off",
+		Params: "on bool", Description: "Turns the light on or off, at the configured OnBrightness if there is one",
 		SetState: func(l *Light, payload string) error {
 			on, err := strconv.ParseBool(payload)
 			if err != nil {
 				return err
 			}
-			if on {
-				err = l.Light.On()
-			} else {
-				err = l.Light.Off()
+
+			// Switching the light by hand ends any simulation
+			l.stopSim()
+
+			l.m.RLock()
+			brightness := l.onBrightness
+			l.m.RUnlock()
+
+			state := hue.LightState{
+				On: on,
+			}
+			if on && brightness > 0 {
+				state.Bri = percentToBri(brightness)
 			}
 
+			err = l.setState(state)
 			if err != nil {
 				return err
 			}
 
-			return l.bridge.client.PublishMessage(casa.Message{
-				Topic:   l.Path + "/On",
-				Payload: []byte(strconv.FormatBool(on)),
-				Retain:  true,
-			})
+			err = l.publish("On", strconv.FormatBool(on))
+			if err != nil || !on || brightness == 0 {
+				return err
+			}
+
+			return l.publish("Brightness", strconv.Itoa(brightness))
 
 		},
 		GetState: func(light *Light, topic string) (string, error) {
-			return strconv.FormatBool(light.Light.State.On), nil
+			return strconv.FormatBool(light.current().State.On), nil
 		}},
 
 	"Brightness": {
 		Params:      "percent int",
-		Description: "Sets the light brightness to `percent` percent",
+		Description: "Sets the light brightness to `percent` percent from 0-100, where 0 turns the light off",
+		Debounce:    true,
 		SetState: func(l *Light, payload string) error {
 			value, err := strconv.Atoi(payload)
 			if err != nil {
 				return err
 			}
 
-			err = l.Light.SetBrightness(value)
+			if value < 0 || value > 100 {
+				return errors.New("Brightness must be from 0-100")
+			}
+
+			state := hue.LightState{
+				Bri: percentToBri(value),
+				On:  value > 0,
+			}
+
+			err = l.setState(state)
 			if err != nil {
 				return err
 			}
 
-			return l.bridge.client.PublishMessage(casa.Message{
-				Topic:   l.Path + "/Brightness",
-				Payload: []byte(payload),
-				Retain:  true,
-			})
+			err = l.publish("Brightness", strconv.Itoa(value))
+			if err != nil {
+				return err
+			}
+
+			return l.publish("On", strconv.FormatBool(state.On))
 		},
 		GetState: func(light *Light, topic string) (string, error) {
-			return strconv.FormatUint(uint64(light.Light.State.Bri), 10), nil
+			if !light.current().State.On {
+				return "0", nil
+			}
+			return strconv.Itoa(briToPercent(light.current().State.Bri)), nil
+		}},
+
+	"BrightnessUp": {
+		Params:      "step int",
+		Description: "Raises the brightness by `step` from 1-254 on the bridge's 0-254 scale",
+		SetState: func(l *Light, payload string) error {
+			return l.stepBrightness("BrightnessUp", payload, 1)
+		}},
+
+	"BrightnessDown": {
+		Params:      "step int",
+		Description: "Lowers the brightness by `step` from 1-254 on the bridge's 0-254 scale, turning the light off at 0",
+		SetState: func(l *Light, payload string) error {
+			return l.stepBrightness("BrightnessDown", payload, -1)
 		}},
 
 	"Hue": {
 		Params:      "value uint16",
 		Description: "Sets the hue to the specified value from 1-65535",
+		Debounce:    true,
 		SetState: func(l *Light, payload string) error {
 			if h, err := strconv.ParseUint(payload, 10, 16); err == nil {
 				state := hue.LightState{
@@ -110,27 +559,54 @@ var endpoints = map[string]*endpoint{
 					On:  true,
 				}
 
-				err = l.Light.SetState(state)
+				err = l.setState(state)
 				if err != nil {
 					return err
 				}
-				return l.bridge.client.PublishMessage(casa.Message{
-					Topic:   l.Path + "/Hue",
-					Payload: []byte(payload),
-					Retain:  true,
-				})
+				return l.publish("Hue", payload)
 
 			}
 
 			return errors.New("Invalid payload " + payload)
 		},
 		GetState: func(light *Light, topic string) (string, error) {
-			return strconv.FormatUint(uint64(light.Light.State.Hue), 10), nil
+			return strconv.FormatUint(uint64(light.current().State.Hue), 10), nil
+		}},
+
+	"HueStep": {
+		Params:      "step int",
+		Description: "Moves the hue by the signed `step` from -65534 to 65534",
+		SetState: func(l *Light, payload string) error {
+			step, err := strconv.ParseInt(payload, 10, 32)
+			if err != nil || step < -65534 || step > 65534 {
+				return errors.New("Hue step must be from -65534 to 65534")
+			}
+
+			return l.stepColor("HueStep", payload, hue.LightState{
+				HueIncrement: int32(step),
+				On:           true,
+			})
+		}},
+
+	"SaturationStep": {
+		Params:      "step int",
+		Description: "Moves the saturation by the signed `step` from -254 to 254",
+		SetState: func(l *Light, payload string) error {
+			step, err := strconv.ParseInt(payload, 10, 16)
+			if err != nil || step < -254 || step > 254 {
+				return errors.New("Saturation step must be from -254 to 254")
+			}
+
+			return l.stepColor("SaturationStep", payload, hue.LightState{
+				SaturationIncrement: int16(step),
+				On:                  true,
+			})
 		}},
 
 	"Saturation": {
 		Params:      "value uint",
 		Description: "Sets the saturation to the specified value from 0-254",
+		Debounce:    true,
 		SetState: func(l *Light, payload string) error {
 			if h, err := strconv.ParseUint(payload, 10, 8); err == nil {
 				state := hue.LightState{
@@ -138,51 +614,49 @@ var endpoints = map[string]*endpoint{
 					On:  true,
 				}
 
-				err = l.Light.SetState(state)
+				err = l.setState(state)
 				if err != nil {
 					return err
 				}
-				return l.bridge.client.PublishMessage(casa.Message{
-					Topic:   l.Path + "/Saturation",
-					Payload: []byte(payload),
-					Retain:  true,
-				})
+				return l.publish("Saturation", payload)
 
 			}
 
 			return errors.New("Invalid payload " + payload)
 		},
 		GetState: func(light *Light, topic string) (string, error) {
-			return strconv.FormatUint(uint64(light.Light.State.Saturation), 10), nil
+			return strconv.FormatUint(uint64(light.current().State.Saturation), 10), nil
 		}},
 
 	"Effect": {
 		Params:      "effect string",
 		Description: "Sets the effect mode. Acceptable values are 'Colorloop' or 'None'",
 		SetState: func(l *Light, payload string) error {
+			effect, err := effectValue(payload)
+			if err != nil {
+				return err
+			}
+
 			state := new(hue.LightState)
-			state.Effect = payload
+			state.Effect = effect
 			state.On = true
 
-			err := l.Light.SetState(*state)
+			err = l.setState(*state)
 			if err != nil {
 				return err
 			}
 
-			return l.bridge.client.PublishMessage(casa.Message{
-				Topic:   l.Path + "/Effect",
-				Payload: []byte(payload),
-				Retain:  true,
-			})
+			return l.publish("Effect", effectName(state.Effect))
 
 		},
 		GetState: func(light *Light, topic string) (string, error) {
-			return light.Light.State.Effect, nil
+			return effectName(light.current().State.Effect), nil
 		}},
 
 	"XY Color": {
 		Params:      "x,y float",
 		Description: "Sets the light to the  `x,y` positions on the HSL color spectrum",
+		Debounce:    true,
 		SetState: func(l *Light, payload string) error {
 			colors := strings.Split(payload, ",")
 			if len(colors) != 2 {
@@ -199,133 +673,506 @@ var endpoints = map[string]*endpoint{
 				return err
 			}
 
-			err = l.Light.SetColor(&[2]float32{float32(x), float32(y)})
+			if x < 0 || x > 1 || y < 0 || y > 1 {
+				return errors.New("XY coordinates must be from 0-1")
+			}
+
+			// Move colors the light can't show to the nearest one it can
+			xy := [2]float32{float32(x), float32(y)}
+			if gam, ok := gamuts[DetectGamut(l.Light.ModelID)]; ok && !gam.contains(xy) {
+				xy = gam.closest(xy)
+				payload = formatXY(xy)
+				l.bridge.Log("Warning: " + colors[0] + "," + colors[1] +
+					" is outside the gamut of " + l.Light.Name + ", using " + payload)
+			}
+
+			err = l.setState(hue.LightState{
+				XY: &xy,
+				On: true,
+			})
+			if err != nil {
+				return err
+			}
+
+			err = l.publish("XY Color", payload)
 			if err != nil {
 				return err
 			}
 
-			return l.bridge.client.PublishMessage(casa.Message{
+			// The light no longer shows a named color
+			return l.publish("Color Name", "None")
 
-				Topic:   l.Path + "/XY Color",
-				Payload: []byte(payload),
-				Retain:  true,
+		},
+		GetState: func(light *Light, topic string) (string, error) {
+			return formatXY(light.current().State.XY), nil
+		}},
+
+	"RGB": {
+		Params:      "r,g,b uint8",
+		Description: "Sets the light to the `r,g,b` color, adjusted to the colors the light can display",
+		Debounce:    true,
+		SetState: func(l *Light, payload string) error {
+			parts := strings.Split(payload, ",")
+			if len(parts) != 3 {
+				return errors.New("Invalid payload " + payload)
+			}
+
+			var rgb [3]uint8
+			for i, part := range parts {
+				c, err := strconv.ParseUint(strings.TrimSpace(part), 10, 8)
+				if err != nil {
+					return errors.New("Invalid payload " + payload)
+				}
+				rgb[i] = uint8(c)
+			}
+
+			xy := RGBToXY(rgb[0], rgb[1], rgb[2], DetectGamut(l.Light.ModelID))
+			err := l.setState(hue.LightState{
+				XY: &xy,
+				On: true,
 			})
 			if err != nil {
 				return err
 			}
 
-			return l.bridge.client.PublishMessage(casa.Message{
+			err = l.publish("XY Color", formatXY(xy))
+			if err != nil {
+				return err
+			}
 
-				Topic:   l.Path + "/Color Name",
-				Payload: []byte("None"),
-				Retain:  true,
+			err = l.publish("Color Name", "None")
+			if err != nil {
+				return err
+			}
+
+			return l.publish("RGB", payload)
+		}},
+
+	"RandomColor": {
+		Params:      "any",
+		Description: "Sets the light to a random color it is able to display. The payload is ignored",
+		SetState: func(l *Light, payload string) error {
+			xy := l.gamut().random()
+			err := l.setState(hue.LightState{
+				XY: &xy,
+				On: true,
 			})
+			if err != nil {
+				return err
+			}
 
-		},
-		GetState: func(light *Light, topic string) (string, error) {
-			return strconv.FormatFloat(float64(light.Light.State.XY[0]), 'f', -1, 32) +
-				"," + strconv.FormatFloat(float64(light.Light.State.XY[1]), 'f', -1, 32), nil
+			l.changeState(func(cur *hue.Light) { cur.State.XY = xy })
+			return l.publishState("XY Color", "Color Name")
+		}},
+
+	"HSL": {
+		Params:      "h,s,l float",
+		Description: "Sets the light to the color with hue `h` from 0-360 and saturation `s` and lightness `l` from 0-100",
+		Debounce:    true,
+		SetState: func(l *Light, payload string) error {
+			parts := strings.Split(payload, ",")
+			if len(parts) != 3 {
+				return errors.New("Invalid payload " + payload)
+			}
+
+			var hsl [3]float64
+			for i, part := range parts {
+				v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+				if err != nil {
+					return errors.New("Invalid payload " + payload)
+				}
+				hsl[i] = v
+			}
+			if hsl[0] < 0 || hsl[0] > 360 || hsl[1] < 0 || hsl[1] > 100 ||
+				hsl[2] < 0 || hsl[2] > 100 {
+				return errors.New("HSL must be h from 0-360 and s and l from 0-100")
+			}
+
+			state := hslState(hsl[0], hsl[1], hsl[2])
+			err := l.setState(state)
+			if err != nil {
+				return err
+			}
+
+			err = l.publish("Hue", strconv.FormatUint(uint64(state.Hue), 10))
+			if err != nil {
+				return err
+			}
+
+			err = l.publish("Saturation", strconv.FormatUint(uint64(state.Sat), 10))
+			if err != nil {
+				return err
+			}
+
+			err = l.publish("Brightness", strconv.Itoa(briToPercent(state.Bri)))
+			if err != nil {
+				return err
+			}
+
+			return l.publish("HSL", payload)
 		}},
 
 	"Color Name": {
-		Params:      "name string",
-		Description: "Sets the light to the predefined color",
+		Params:      "name[:percent] string",
+		Description: "Sets the light to the predefined color, optionally at `percent` brightness",
+		Debounce:    true,
 		SetState: func(l *Light, payload string) error {
 			// Check to ensure the named color exists in our map
 			if payload == "None" || payload == "" {
-				return l.bridge.client.PublishMessage(casa.Message{
+				return l.publish("Color Name", "None")
+			}
 
-					Topic:   l.Path + "/Color Name",
-					Payload: []byte("None"),
-					Retain:  true,
-				})
+			// The name may be followed by a brightness percentage, as in
+			// "Red:40", to set both in a single call to the bridge
+			parts := strings.SplitN(payload, ":", 2)
+			name, xy, err := lookupColor(parts[0])
+			if err != nil {
+				return err
+			}
+
+			state := hue.LightState{
+				XY: xy,
+				On: true,
 			}
 
-			if Colors[payload] == nil {
-				return errors.New("Invalid color name")
+			var brightness string
+			if len(parts) == 2 {
+				brightness = parts[1]
+				percent, err := strconv.Atoi(brightness)
+				if err != nil || percent < 1 || percent > 100 {
+					return errors.New("Invalid brightness " + brightness)
+				}
+				state.Bri = percentToBri(percent)
 			}
 
 			// Set the light to the color
-			err := l.Light.SetColor(Colors[payload])
+			err = l.setState(state)
 			if err != nil {
 				return err
 			}
 
 			// Update the MQTT topic for the light color
-			err = l.bridge.client.PublishMessage(casa.Message{
-
-				Topic:   l.Path + "/Color Name",
-				Payload: []byte(payload),
-				Retain:  true,
-			})
+			err = l.publish("Color Name", name)
 			if err != nil {
 				return err
 			}
 
 			// Update the XY Color topic with these colors
+			err = l.publish("XY Color", formatXY(*xy))
+			if err != nil || brightness == "" {
+				return err
+			}
 
-			return l.bridge.client.PublishMessage(casa.Message{
-
-				Topic:   l.Path + "/XY Color",
-				Payload: []byte(strconv.FormatFloat(float64(Colors[payload][0]), 'f', -1, 32) + "," + strconv.FormatFloat(float64(Colors[payload][1]), 'f', -1, 32)),
-				Retain:  true,
-			})
+			return l.publish("Brightness", brightness)
 		},
-		GetState: func(light *Light, topic string) (string, error) {
-			return "", nil
+		GetState: func(l *Light, topic string) (string, error) {
+			return nearestColor(l.current().State.XY, l.bridge.colorNameThreshold), nil
 		}},
 
 	"Color Temp": {
 		Params:      "value int",
 		Description: "Sets the mired color temperature to the specified value",
+		Debounce:    true,
 		SetState: func(l *Light, payload string) error {
 			if h, err := strconv.ParseUint(payload, 10, 16); err == nil {
+				ct, err := l.checkCT(uint16(h))
+				if err != nil {
+					return err
+				}
+
 				state := new(hue.LightState)
-				state.CT = uint16(h)
+				state.CT = ct
 				state.On = true
 
-				err := l.Light.SetState(*state)
+				err = l.setState(*state)
 				if err != nil {
 					return err
 				}
-				return l.bridge.client.PublishMessage(casa.Message{
-
-					Topic:   l.Path + "/Color Temp",
-					Payload: []byte(payload),
-					Retain:  true,
-				})
+				return l.publish("Color Temp", strconv.FormatUint(uint64(ct), 10))
 
 			}
 
 			return errors.New("Invalid payload " + payload)
 		},
 		GetState: func(light *Light, topic string) (string, error) {
-			return strconv.FormatUint(uint64(light.Light.State.Saturation), 8), nil
+			return strconv.FormatUint(uint64(light.current().State.CT), 10), nil
+		}},
+
+	"ColorTempKelvin": {
+		Params:      "kelvin float",
+		Description: "Sets the color temperature to the specified value in Kelvin, e.g. 2700 for warm white",
+		Debounce:    true,
+		SetState: func(l *Light, payload string) error {
+			k, err := strconv.ParseFloat(payload, 64)
+			if err != nil || !(k > 0) || math.IsInf(k, 0) {
+				return errors.New("Invalid payload " + payload)
+			}
+
+			// Checked before converting, as very low temperatures are
+			// beyond the range of mireds
+			min, max := l.ctRange()
+			mireds := math.Floor(1000000/k + 0.5)
+			if mireds < float64(min) || mireds > float64(max) {
+				return errors.New("Color temperature must be from " +
+					strconv.Itoa(int(MiredsToKelvin(max)+0.5)) + "-" +
+					strconv.Itoa(int(MiredsToKelvin(min)+0.5)) + "K")
+			}
+
+			ct := uint16(mireds)
+			err = l.setState(hue.LightState{
+				CT: ct,
+				On: true,
+			})
+			if err != nil {
+				return err
+			}
+
+			err = l.publish("Color Temp", strconv.FormatUint(uint64(ct), 10))
+			if err != nil {
+				return err
+			}
+
+			return l.publish("ColorTempKelvin", payload)
+		},
+		GetState: func(light *Light, topic string) (string, error) {
+			if light.current().State.CT == 0 {
+				return "0", nil
+			}
+			return strconv.FormatFloat(math.Floor(MiredsToKelvin(light.current().State.CT)+0.5), 'f', -1, 64), nil
+		}},
+
+	"CycleColors": {
+		Params:      "names,ms string",
+		Description: "Cycles through the comma separated color names, showing each for `ms` milliseconds, as in 'Red,Blue,500'. An empty payload or CycleColors/Stop stops cycling",
+		SetState: func(l *Light, payload string) error {
+			if payload == "" {
+				l.stopSim()
+				return l.publish("CycleColors", "")
+			}
+
+			names, step, err := parseCycle(payload)
+			if err != nil {
+				return err
+			}
+
+			l.startSim(func(ctx context.Context) {
+				l.cycleColors(ctx, names, step)
+			})
+			return l.publish("CycleColors", payload)
+		}},
+
+	"Strobe": {
+		Params:      "count,ms int",
+		Description: "Flashes the light on and off `count` times, up to 100, switching every `ms` milliseconds, then restores it",
+		SetState: func(l *Light, payload string) error {
+			count, interval, err := parseStrobe(payload)
+			if err != nil {
+				return err
+			}
+
+			l.startSim(func(ctx context.Context) {
+				l.strobe(ctx, count, interval)
+			})
+			return nil
+		}},
+
+	"Simulate": {
+		Params:      "minutes float",
+		Description: "Simulates someone being home for `minutes` by changing the light at random, then restores it. Simulate/Stop ends the simulation early",
+		SetState: func(l *Light, payload string) error {
+			duration, err := parseMinutes(payload)
+			if err != nil {
+				return err
+			}
+
+			l.startSim(func(ctx context.Context) {
+				l.simulate(ctx, duration)
+			})
+			return l.publish("Simulate", payload)
+		}},
+
+	"Sunset": {
+		Params:      "minutes float",
+		Description: "Dims the light to off over `minutes`, publishing the progress to SunsetProgress",
+		SetState: func(l *Light, payload string) error {
+			duration, err := parseMinutes(payload)
+			if err != nil {
+				return err
+			}
+
+			l.startSim(func(ctx context.Context) {
+				l.sunset(ctx, duration)
+			})
+			return l.publish("Sunset", payload)
+		}},
+
+	"Sunrise": {
+		Params:      "minutes float",
+		Description: "Brightens the light from dim warm white to full daylight over `minutes`, publishing the progress to SunriseProgress",
+		SetState: func(l *Light, payload string) error {
+			duration, err := parseMinutes(payload)
+			if err != nil {
+				return err
+			}
+
+			l.startSim(func(ctx context.Context) {
+				l.sunrise(ctx, duration)
+			})
+			return l.publish("Sunrise", payload)
+		}},
+
+	"ColorTempPreset": {
+		Params:      "preset string",
+		Description: "Sets the color temperature to a named preset: 'candle', 'warm', 'sunset', 'neutral', 'cool' or 'daylight'",
+		SetState: func(l *Light, payload string) error {
+			name, ct, err := ctPresetValue(payload)
+			if err != nil {
+				return err
+			}
+
+			min, max := l.ctRange()
+			if ct < min || ct > max {
+				return errors.New("Color temperature preset " + name + " is outside the range of the light")
+			}
+
+			err = l.setState(hue.LightState{
+				CT: ct,
+				On: true,
+			})
+			if err != nil {
+				return err
+			}
+
+			err = l.publish("Color Temp", strconv.FormatUint(uint64(ct), 10))
+			if err != nil {
+				return err
+			}
+
+			return l.publish("ColorTempPreset", name)
+		},
+		GetState: func(l *Light, topic string) (string, error) {
+			return ctPresetName(l.current().State.CT), nil
 		}},
 
 	"Alert": {
-		Params:      "selected string",
-		Description: "Sets the light alert state. Valid values are 'Selected' or 'None'",
+		Params:      "alert string",
+		Description: "Sets the light alert state. Valid values are 'select', 'lselect' or 'none'",
 		SetState: func(l *Light, payload string) error {
+			alert, err := alertValue(payload)
+			if err != nil {
+				return err
+			}
+
 			state := hue.LightState{
-				Alert: payload,
+				Alert: alert,
 				On:    true,
 			}
 
-			err := l.bridge.client.PublishMessage(casa.Message{
-
-				Topic:   l.Path + "/Alert",
-				Payload: []byte(payload),
-				Retain:  true,
-			})
+			err = l.setState(state)
 			if err != nil {
 				return err
 			}
-			return l.Light.SetState(state)
 
+			return l.publish("Alert", alert)
 		},
 		GetState: func(light *Light, topic string) (string, error) {
-			return light.Light.State.Alert, nil
+			return light.current().State.Alert, nil
+		}},
+
+	"State": {
+		Params:      "state json",
+		Description: "Applies a JSON light state such as {\"on\":true,\"bri\":127}. Fields that are left out keep their current value",
+		SetState: func(l *Light, payload string) error {
+			return l.applyJSONState(payload)
+		},
+		GetState: func(l *Light, topic string) (string, error) {
+			return l.jsonState()
+		}},
+
+	"TransitionTime": {
+		Params:      "value uint16",
+		Description: "Sets the duration of the fade used by subsequent changes, in multiples of 100ms",
+		SetState: func(l *Light, payload string) error {
+			t, err := strconv.ParseUint(payload, 10, 16)
+			if err != nil {
+				return errors.New("Invalid payload " + payload)
+			}
+
+			l.m.Lock()
+			l.transitionTime = uint16(t)
+			l.m.Unlock()
+
+			return l.publish("TransitionTime", payload)
+		},
+		GetState: func(l *Light, topic string) (string, error) {
+			l.m.RLock()
+			defer l.m.RUnlock()
+			return strconv.FormatUint(uint64(l.transitionTime), 10), nil
+		}},
+
+	"Lock": {
+		Params:      "locked bool",
+		Description: "Rejects commands to every other endpoint while true, until set to false",
+		SetState: func(l *Light, payload string) error {
+			locked, err := strconv.ParseBool(payload)
+			if err != nil {
+				return errors.New("Invalid payload " + payload)
+			}
+
+			l.m.Lock()
+			l.locked = locked
+			l.m.Unlock()
+
+			return l.publish("Lock", strconv.FormatBool(locked))
+		},
+		GetState: func(l *Light, topic string) (string, error) {
+			l.m.RLock()
+			defer l.m.RUnlock()
+			return strconv.FormatBool(l.locked), nil
+		}},
+
+	"Rename": {
+		Params:      "name string",
+		Description: "Renames the light on the bridge and moves it to the topics of the new name",
+		SetState: func(l *Light, payload string) error {
+			return l.rename(payload)
+		}},
+
+	"Groups": {
+		Params:      "read only",
+		Description: "The names of the groups the light belongs to, separated by commas, or None",
+		GetState: func(l *Light, topic string) (string, error) {
+			return l.membershipState(), nil
+		}},
+
+	"PowerOnBehavior": {
+		Params:      "mode string",
+		Description: "Sets what the light does when it regains power: 'safety', 'powerfail', 'lastonstate' or 'custom'",
+		SetState: func(l *Light, payload string) error {
+			return l.setPowerOn(payload)
+		},
+		GetState: func(l *Light, topic string) (string, error) {
+			l.m.RLock()
+			defer l.m.RUnlock()
+			if l.powerOn == "" {
+				return "Unknown", nil
+			}
+			return l.powerOn, nil
+		}},
+
+	"Undo": {
+		Params:      "any",
+		Description: "Reverts the most recent change made through another endpoint. The payload is ignored",
+		SetState: func(l *Light, payload string) error {
+			return l.undo()
+		}},
+
+	"Gamut": {
+		Params:      "read only",
+		Description: "The red, green and blue xy corners of the color gamut the light can display, or 'None' if it isn't known",
+
+		GetState: func(l *Light, topic string) (string, error) {
+			return l.gamutState()
 		}},
 
 	"Color Mode": {
@@ -333,6 +1180,122 @@ var endpoints = map[string]*endpoint{
 		Description: "Specifies the last mode used for choosing colors. Values are 'hs' for Hue and Saturation, 'xy' for XY and 'ct' for Color Temperature.",
 
 		GetState: func(l *Light, payload string) (string, error) {
-			return l.Light.State.ColorMode, nil
+			return l.current().State.ColorMode, nil
+		}},
+
+	"Reachable": {
+		Params:      "read only",
+		Description: "Whether the bridge can currently reach the light. Lights become unreachable when they lose power or drop off the Zigbee network.",
+
+		GetState: func(l *Light, topic string) (string, error) {
+			return strconv.FormatBool(l.current().State.Reachable), nil
+		}},
+
+	"History": {
+		Params:      "read only",
+		Description: "A JSON array of the latest commands to the light's endpoints, newest first",
+		Metadata:    true,
+
+		GetState: func(l *Light, topic string) (string, error) {
+			return l.historyState()
+		}},
+
+	"Endpoints": {
+		Params:      "read only",
+		Description: "A JSON array describing each endpoint of the light",
+		Metadata:    true,
+
+		GetState: func(l *Light, topic string) (string, error) {
+			return l.endpointListing()
+		}},
+
+	"ModelID": {
+		Params:      "read only",
+		Description: "The manufacturer's model identifier of the light",
+		Metadata:    true,
+
+		GetState: func(l *Light, topic string) (string, error) {
+			return l.Light.ModelID, nil
 		}},
+
+	"Type": {
+		Params:      "read only",
+		Description: "The Hue type of the light, such as 'Extended color light'",
+		Metadata:    true,
+
+		GetState: func(l *Light, topic string) (string, error) {
+			return l.Light.Type, nil
+		}},
+
+	"FirmwareVersion": {
+		Params:      "read only",
+		Description: "The software version running on the light",
+		Metadata:    true,
+
+		GetState: func(l *Light, topic string) (string, error) {
+			return l.Light.SWVersion, nil
+		}},
+
+	"ID": {
+		Params:      "read only",
+		Description: "The numeric ID of the light on the Hue bridge",
+		Metadata:    true,
+
+		GetState: func(l *Light, topic string) (string, error) {
+			return strconv.Itoa(l.Light.Index), nil
+		}},
+}
+
+// Smart plugs can only be switched on and off, so they get only the On
+// endpoint besides the read only informational ones.
+var plugEndpoints = map[string]*endpoint{
+	"On":              endpoints["On"],
+	"Reachable":       endpoints["Reachable"],
+	"History":         endpoints["History"],
+	"Endpoints":       endpoints["Endpoints"],
+	"ModelID":         endpoints["ModelID"],
+	"Type":            endpoints["Type"],
+	"FirmwareVersion": endpoints["FirmwareVersion"],
+	"ID":              endpoints["ID"],
+}
+
+// Endpoints that only work on lights able to display colors
+var colorEndpoints = []string{"Hue", "HueStep", "Saturation", "SaturationStep",
+	"Effect", "XY Color", "RGB", "HSL", "Color Name", "CycleColors", "RandomColor",
+	"Gamut"}
+
+// Endpoints that only work on lights with an adjustable color temperature
+var ctEndpoints = []string{"Color Temp", "ColorTempKelvin", "ColorTempPreset",
+	"Sunrise"}
+
+// Endpoints that only work on lights that can be dimmed
+var dimEndpoints = []string{"Brightness", "BrightnessUp", "BrightnessDown",
+	"Sunset"}
+
+// Returns the endpoints that apply to a Hue light of the given type. Lights of
+// unknown types get every endpoint.
+func lightEndpoints(lightType string) map[string]*endpoint {
+	if deviceClass(lightType) == "Plug" {
+		return copyEndpoints(plugEndpoints)
+	}
+
+	points := copyEndpoints(endpoints)
+
+	var skip []string
+	switch strings.ToLower(lightType) {
+	case "color light":
+		skip = ctEndpoints
+	case "color temperature light":
+		skip = colorEndpoints
+	case "dimmable light":
+		skip = append(append([]string{"Color Mode"}, colorEndpoints...), ctEndpoints...)
+	case "on/off light":
+		skip = append(append(append([]string{"Color Mode"}, colorEndpoints...),
+			ctEndpoints...), dimEndpoints...)
+	}
+
+	for _, point := range skip {
+		delete(points, point)
+	}
+	return points
 }
@@ -0,0 +1,720 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// The topic of the endpoint of the light named Desk on the test bridge
+func deskTopic(endpoint string) string {
+	return testPath + "/Light/Desk/" + sanitizeTopic(endpoint)
+}
+
+func TestEndpointCommands(t *testing.T) {
+	tests := []struct {
+		endpoint, payload string
+		state             map[string]interface{}
+		topics            map[string]string
+	}{
+		{"On", "true",
+			map[string]interface{}{"on": true},
+			map[string]string{"On": "true"}},
+		{"Brightness", "50",
+			map[string]interface{}{"on": true, "bri": float64(127)},
+			map[string]string{"Brightness": "50", "On": "true"}},
+		{"Brightness", "0",
+			map[string]interface{}{"on": false},
+			map[string]string{"Brightness": "0", "On": "false"}},
+		{"Hue", "1000",
+			map[string]interface{}{"on": true, "hue": float64(1000)},
+			map[string]string{"Hue": "1000"}},
+		{"Saturation", "200",
+			map[string]interface{}{"on": true, "sat": float64(200)},
+			map[string]string{"Saturation": "200"}},
+		{"Effect", "COLORLOOP",
+			map[string]interface{}{"effect": "colorloop"},
+			map[string]string{"Effect": "Colorloop"}},
+		{"Alert", "lselected",
+			map[string]interface{}{"alert": "lselect"},
+			map[string]string{"Alert": "lselect"}},
+		{"XY Color", "0.3,0.3",
+			map[string]interface{}{"colormode": "xy"},
+			map[string]string{"XY Color": "0.3,0.3", "Color Name": "None"}},
+		{"Color Temp", "250",
+			map[string]interface{}{"ct": float64(250)},
+			map[string]string{"Color Temp": "250"}},
+		{"ColorTempKelvin", "4000",
+			map[string]interface{}{"ct": float64(250)},
+			map[string]string{"Color Temp": "250", "ColorTempKelvin": "4000"}},
+		{"ColorTempPreset", "Daylight",
+			map[string]interface{}{"ct": float64(153)},
+			map[string]string{"ColorTempPreset": "daylight"}},
+		{"Color Name", "red:40",
+			map[string]interface{}{"bri": float64(101), "colormode": "xy"},
+			map[string]string{"Color Name": "Red", "Brightness": "40"}},
+		{"HSL", "120,100,50",
+			map[string]interface{}{"hue": float64(21845), "sat": float64(254), "bri": float64(254)},
+			map[string]string{"Hue": "21845", "Saturation": "254", "Brightness": "100"}},
+		{"TransitionTime", "10",
+			nil,
+			map[string]string{"TransitionTime": "10"}},
+	}
+
+	for _, test := range tests {
+		f := newFakeBridge(t)
+		f.addLight("1", "Desk", "Extended color light")
+		_, client, _ := startBridge(t, f, nil)
+
+		client.send(deskTopic(test.endpoint)+"/Set", test.payload)
+
+		if got, ok := client.last(deskTopic(test.endpoint) + "/Error"); ok && got != "" {
+			t.Errorf("%s %s failed: %s", test.endpoint, test.payload, got)
+			continue
+		}
+		state := f.state("1")
+		for k, want := range test.state {
+			if !reflect.DeepEqual(state[k], want) {
+				t.Errorf("%s %s set %s to %v, want %v",
+					test.endpoint, test.payload, k, state[k], want)
+			}
+		}
+		for point, want := range test.topics {
+			if got, _ := client.last(deskTopic(point)); got != want {
+				t.Errorf("%s %s published %s = %q, want %q",
+					test.endpoint, test.payload, point, got, want)
+			}
+		}
+	}
+
+	// A command the bridge rejects publishes nothing but the error
+	failing := []struct{ endpoint, payload string }{
+		{"Alert", "select"},
+		{"Alert", "lselect"},
+		{"On", "true"},
+	}
+
+	for _, test := range failing {
+		f := newFakeBridge(t)
+		f.addLight("1", "Desk", "Extended color light")
+		_, client, _ := startBridge(t, f, nil)
+		before, _ := client.last(deskTopic(test.endpoint))
+
+		f.m.Lock()
+		f.intercept = func(r *http.Request) (int, string, bool) {
+			if r.Method == "PUT" {
+				return http.StatusOK, `[{"error":{"type":201,"address":"/lights/1/state","description":"device is not reachable"}}]`, true
+			}
+			return 0, "", false
+		}
+		f.m.Unlock()
+
+		client.send(deskTopic(test.endpoint)+"/Set", test.payload)
+
+		if got, _ := client.last(deskTopic(test.endpoint)); got != before {
+			t.Errorf("Failed %s %s published %q, want %q left alone",
+				test.endpoint, test.payload, got, before)
+		}
+		if got, _ := client.last(deskTopic(test.endpoint) + "/Error"); !strings.Contains(got, "not reachable") {
+			t.Errorf("Failed %s %s: Error = %q, want the bridge error",
+				test.endpoint, test.payload, got)
+		}
+	}
+}
+
+func TestEndpointRejectsInvalidPayloads(t *testing.T) {
+	tests := []struct {
+		endpoint, payload, want string
+	}{
+		{"On", "maybe", "invalid syntax"},
+		{"Brightness", "101", "0-100"},
+		{"Brightness", "-1", "0-100"},
+		{"BrightnessUp", "0", "1-254"},
+		{"BrightnessDown", "255", "1-254"},
+		{"Hue", "70000", "Invalid payload"},
+		{"HueStep", "65535", "-65534 to 65534"},
+		{"SaturationStep", "-255", "-254 to 254"},
+		{"Effect", "sparkle", "colorloop"},
+		{"Alert", "blink", "lselect"},
+		{"XY Color", "0.3", "invalid colors"},
+		{"XY Color", "1.5,0.3", "0-1"},
+		{"RGB", "255,0", "Invalid payload"},
+		{"HSL", "400,100,50", "0-360"},
+		{"Color Name", "Chartreuse", "Red"},
+		{"Color Name", "Red:0", "Invalid brightness"},
+		{"Color Temp", "100", "153"},
+		{"ColorTempKelvin", "15.19", "2000-6536K"},
+		{"ColorTempKelvin", "0", "Invalid payload"},
+		{"ColorTempKelvin", "NaN", "Invalid payload"},
+		{"ColorTempPreset", "tepid", "candle"},
+		{"State", `{"effect":"sparkle"}`, "colorloop"},
+		{"TransitionTime", "-1", "Invalid payload"},
+	}
+
+	for _, test := range tests {
+		f := newFakeBridge(t)
+		f.addLight("1", "Desk", "Extended color light")
+		_, client, _ := startBridge(t, f, nil)
+
+		client.send(deskTopic(test.endpoint)+"/Set", test.payload)
+
+		got, _ := client.last(deskTopic(test.endpoint) + "/Error")
+		if !strings.Contains(got, test.want) {
+			t.Errorf("%s %s: Error = %q, want it to mention %q",
+				test.endpoint, test.payload, got, test.want)
+		}
+		if n := f.count("PUT", "/api/test/lights/1/state"); n != 0 {
+			t.Errorf("%s %s: sent %d states to the bridge, want none",
+				test.endpoint, test.payload, n)
+		}
+	}
+}
+
+func TestDeviceClass(t *testing.T) {
+	tests := map[string]string{
+		"On/off plug-in unit":  "Plug",
+		"On/Off plug-in unit":  "Plug",
+		"On/off light":         "Light",
+		"Extended color light": "Light",
+		"Smart plug":           "Light",
+	}
+
+	for lightType, want := range tests {
+		if got := deviceClass(lightType); got != want {
+			t.Errorf("deviceClass(%q) = %q, want %q", lightType, got, want)
+		}
+	}
+}
+
+func TestPlugIgnoresDimming(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Socket", "On/off plug-in unit")
+	_, client, _ := startBridge(t, f, nil)
+
+	topic := testPath + "/Plug/Socket/"
+	client.send(topic+"Brightness/Set", "50")
+	if n := f.count("PUT", "/api/test/lights/1/state"); n != 0 {
+		t.Error("Brightness was sent to a plug")
+	}
+
+	client.send(topic+"On/Set", "true")
+	if got := f.state("1")["on"]; got != true {
+		t.Error("Plug wasn't switched on")
+	}
+}
+
+func TestStateEndpointMerges(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	f.setState("1", map[string]interface{}{"on": true, "bri": float64(200)})
+	_, client, _ := startBridge(t, f, nil)
+
+	client.send(deskTopic("State")+"/Set", `{"ct":300}`)
+
+	state := f.state("1")
+	if state["on"] != true || state["bri"] != float64(200) || state["ct"] != float64(300) {
+		t.Errorf("State merged to %v, want the light left on at 200 with ct 300", state)
+	}
+
+	var published jsonState
+	err := json.Unmarshal([]byte(client.waitFor(t, deskTopic("State"))), &published)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if published.CT == nil || *published.CT != 300 || published.Bri == nil || *published.Bri != 200 {
+		t.Errorf("State published %+v, want ct 300 and bri 200", published)
+	}
+	if got, _ := client.last(deskTopic("Color Temp")); got != "300" {
+		t.Errorf("Color Temp = %q, want 300", got)
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	b, _, _ := startBridge(t, f, nil)
+
+	err := b.devices[testPath+"/Light/Desk"].Begin().On(true).Brightness(127).ColorTemp(370).Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := f.count("PUT", "/api/test/lights/1/state"); n != 1 {
+		t.Errorf("Commit sent %d states, want 1", n)
+	}
+	state := f.state("1")
+	if state["on"] != true || state["bri"] != float64(127) || state["ct"] != float64(370) {
+		t.Errorf("Commit set %v", state)
+	}
+}
+
+func TestEffectNoneStopsColorloop(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	f.setState("1", map[string]interface{}{"on": true, "effect": "colorloop"})
+	_, client, _ := startBridge(t, f, nil)
+
+	if got, _ := client.last(deskTopic("Effect")); got != "Colorloop" {
+		t.Fatalf("Effect = %q, want the active Colorloop", got)
+	}
+
+	for _, payload := range []string{"None", "none", "NONE"} {
+		f.setState("1", map[string]interface{}{"effect": "colorloop"})
+		client.send(deskTopic("Effect")+"/Set", payload)
+
+		if got := f.state("1")["effect"]; got != "none" {
+			t.Errorf("Effect %s left the bridge effect at %v, want none", payload, got)
+		}
+		if got, _ := client.last(deskTopic("Effect")); got != "None" {
+			t.Errorf("Effect %s published %q, want None", payload, got)
+		}
+	}
+}
+
+func TestOnBrightness(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	_, client, _ := startBridge(t, f, map[string]interface{}{
+		"Lights": map[string]interface{}{
+			"Desk": map[string]interface{}{"OnBrightness": 40},
+		},
+	})
+
+	client.send(deskTopic("On")+"/Set", "true")
+
+	if got := f.state("1")["bri"]; got != float64(101) {
+		t.Errorf("On set bri %v, want 101", got)
+	}
+	if got, _ := client.last(deskTopic("Brightness")); got != "40" {
+		t.Errorf("Brightness = %q, want 40", got)
+	}
+}
+
+func TestNormalizeTopicNames(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	_, client, _ := startBridge(t, f, map[string]interface{}{"NormalizeTopicNames": true})
+
+	client.send(testPath+"/Light/Desk/xy_color/Set", "0.3,0.3")
+	if got, _ := client.last(testPath + "/Light/Desk/xy_color"); got != "0.3,0.3" {
+		t.Errorf("xy_color = %q, want 0.3,0.3", got)
+	}
+	if _, ok := client.last(deskTopic("XY Color")); ok {
+		t.Error("Published to the mixed case topic")
+	}
+}
+
+func TestEchoCommands(t *testing.T) {
+	for _, echo := range []bool{false, true} {
+		f := newFakeBridge(t)
+		f.addLight("1", "Desk", "Extended color light")
+		_, client, _ := startBridge(t, f, map[string]interface{}{"EchoCommands": echo})
+
+		// The bridge reports a brightness other than the one requested
+		f.m.Lock()
+		f.requests = nil
+		f.intercept = func(r *http.Request) (int, string, bool) {
+			if r.Method == "PUT" {
+				f.setState("1", map[string]interface{}{"on": true, "bri": float64(250)})
+				return http.StatusOK, `[{"success":{}}]`, true
+			}
+			return 0, "", false
+		}
+		f.m.Unlock()
+
+		client.send(deskTopic("Brightness")+"/Set", "99")
+
+		want := "99"
+		if echo {
+			want = "98"
+		}
+		if got, _ := client.last(deskTopic("Brightness")); got != want {
+			t.Errorf("EchoCommands=%v: Brightness = %q, want %q", echo, got, want)
+		}
+		if got := f.count("GET", "/api/test/lights/1") > 0; got != echo {
+			t.Errorf("EchoCommands=%v re-read the light: %v", echo, got)
+		}
+	}
+}
+
+func TestGamutEndpoint(t *testing.T) {
+	tests := []struct {
+		model string
+		gamut string
+		want  Gamut
+		// A color outside this gamut but inside gamut C
+		outside [2]float32
+	}{
+		{"LST001", "A", Gamut{
+			Red:   [2]float32{0.704, 0.296},
+			Green: [2]float32{0.2151, 0.7106},
+			Blue:  [2]float32{0.138, 0.08},
+		}, [2]float32{0.16, 0.06}},
+		{"LCT001", "B", Gamut{
+			Red:   [2]float32{0.675, 0.322},
+			Green: [2]float32{0.409, 0.518},
+			Blue:  [2]float32{0.167, 0.04},
+		}, [2]float32{0.2151, 0.7106}},
+		{"LCT015", "C", Gamut{
+			Red:   [2]float32{0.692, 0.308},
+			Green: [2]float32{0.17, 0.7},
+			Blue:  [2]float32{0.153, 0.048},
+		}, [2]float32{0.8, 0.2}},
+	}
+
+	for _, test := range tests {
+		f := newFakeBridge(t)
+		f.addLight("1", "Desk", "Extended color light")["modelid"] = test.model
+		_, client, _ := startBridge(t, f, nil)
+
+		var got struct {
+			Name string `json:"gamut"`
+			Gamut
+		}
+		err := json.Unmarshal([]byte(client.waitFor(t, deskTopic("Gamut"))), &got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Name != test.gamut || got.Gamut != test.want {
+			t.Errorf("%s: Gamut = %+v, want gamut %s %+v", test.model, got, test.gamut, test.want)
+		}
+
+		// The corners are sent as they are
+		for _, corner := range [][2]float32{test.want.Red, test.want.Green, test.want.Blue} {
+			client.send(deskTopic("XY Color")+"/Set", formatXY(corner))
+			if xy := fakeXY(f, "1"); !closeXY(xy, corner, 1e-4) {
+				t.Errorf("%s: corner %v was sent as %v", test.model, corner, xy)
+			}
+		}
+
+		// Colors outside are clamped to the nearest edge of this gamut
+		client.send(deskTopic("XY Color")+"/Set", formatXY(test.outside))
+		xy := fakeXY(f, "1")
+		if closeXY(xy, test.outside, 1e-3) || !closeXY(xy, test.want.closest(test.outside), 1e-4) {
+			t.Errorf("%s: %v outside gamut %s was sent as %v, want %v", test.model,
+				test.outside, test.gamut, xy, test.want.closest(test.outside))
+		}
+	}
+
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")["modelid"] = "LWB010"
+	_, client, _ := startBridge(t, f, nil)
+	if got, _ := client.last(deskTopic("Gamut")); got != "None" {
+		t.Errorf("Gamut of an unknown model = %q, want None", got)
+	}
+}
+
+// Returns the xy color of the light on the fake bridge
+func fakeXY(f *fakeBridge, id string) [2]float32 {
+	xy := f.state(id)["xy"].([]interface{})
+	return [2]float32{float32(xy[0].(float64)), float32(xy[1].(float64))}
+}
+
+func TestColorTempGetState(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	f.setState("1", map[string]interface{}{"ct": float64(366), "sat": float64(200)})
+	b, client, _ := startBridge(t, f, nil)
+
+	desk := b.lights["1"]
+	got, err := desk.endpoints["Color Temp"].GetState(desk, deskTopic("Color Temp"))
+	if err != nil || got != "366" {
+		t.Errorf("Color Temp GetState = %q, %v, want the mireds 366", got, err)
+	}
+	if got, _ := client.last(deskTopic("Color Temp")); got != "366" {
+		t.Errorf("Color Temp = %q, want 366", got)
+	}
+
+	f.setState("1", map[string]interface{}{"ct": float64(153)})
+	client.send(deskTopic("Color Temp")+"/Get", "")
+	if got, _ := client.last(deskTopic("Color Temp")); got != "153" {
+		t.Errorf("Color Temp/Get = %q, want 153", got)
+	}
+}
+
+func TestEndpointsAreCopiedPerLight(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	f.addLight("2", "Hall", "Extended color light")
+	b, _, _ := startBridge(t, f, nil)
+
+	desk := b.devices[testPath+"/Light/Desk"]
+	hall := b.devices[testPath+"/Light/Hall"]
+	delete(desk.endpoints, "Hue")
+	if hall.endpoints["Hue"] == nil || endpoints["Hue"] == nil {
+		t.Error("Removing an endpoint of one light removed it from others")
+	}
+}
+
+func TestConcurrentCommandsToTwoLights(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	f.addLight("2", "Hall", "Extended color light")
+	_, client, _ := startBridge(t, f, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			client.send(deskTopic("Brightness")+"/Set", "50")
+		}()
+		go func() {
+			defer wg.Done()
+			client.send(testPath+"/Light/Hall/Hue/Set", "1000")
+		}()
+	}
+	wg.Wait()
+
+	desk, hall := f.state("1"), f.state("2")
+	if desk["bri"] != float64(127) || desk["hue"] != float64(0) {
+		t.Errorf("Desk bri %v hue %v, want only the brightness changed", desk["bri"], desk["hue"])
+	}
+	if hall["hue"] != float64(1000) || hall["bri"] != float64(1) {
+		t.Errorf("Hall bri %v hue %v, want only the hue changed", hall["bri"], hall["hue"])
+	}
+	if got, _ := client.last(deskTopic("Brightness")); got != "50" {
+		t.Errorf("Desk Brightness = %q, want 50", got)
+	}
+	if got, _ := client.last(testPath + "/Light/Hall/Hue"); got != "1000" {
+		t.Errorf("Hall Hue = %q, want 1000", got)
+	}
+	for _, id := range []string{"1", "2"} {
+		if n := f.count("PUT", "/api/test/lights/"+id+"/state"); n != 20 {
+			t.Errorf("Light %s was sent %d states, want 20", id, n)
+		}
+	}
+}
+
+func TestGroupTransitionTime(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	f.addLight("2", "Hall", "Extended color light")
+	f.addGroup("1", "Office", "1", "2")
+	_, client, _ := startBridge(t, f, nil)
+
+	transition := func() interface{} {
+		f.m.Lock()
+		defer f.m.Unlock()
+		return f.actions["1"]["transitiontime"]
+	}
+
+	client.send(testPath+"/Group/Office/Brightness/Set", "50")
+	if got := transition(); got != float64(defaultTransitionTime) {
+		t.Errorf("Group action transitiontime = %v, want the default %d", got, defaultTransitionTime)
+	}
+
+	client.send(testPath+"/Group/Office/TransitionTime/Set", "10")
+	client.send(testPath+"/Group/Office/Brightness/Set", "60")
+	if got := transition(); got != float64(10) {
+		t.Errorf("Group action transitiontime = %v, want 10", got)
+	}
+}
+
+func TestBrightnessSteps(t *testing.T) {
+	tests := []struct {
+		bri      float64
+		endpoint string
+		step     string
+		want     float64
+		on       bool
+	}{
+		{100, "BrightnessUp", "50", 150, true},
+		{200, "BrightnessUp", "100", 254, true},
+		{100, "BrightnessDown", "50", 50, true},
+		// The bridge keeps the brightness of lights switched off
+		{100, "BrightnessDown", "254", 100, false},
+	}
+
+	for _, test := range tests {
+		f := newFakeBridge(t)
+		f.addLight("1", "Desk", "Extended color light")
+		f.setState("1", map[string]interface{}{"on": true, "bri": test.bri})
+		_, client, _ := startBridge(t, f, nil)
+
+		client.send(deskTopic(test.endpoint)+"/Set", test.step)
+
+		state := f.state("1")
+		if state["bri"] != test.want || state["on"] != test.on {
+			t.Errorf("%s %s from %v: bri %v on %v, want %v %v", test.endpoint,
+				test.step, test.bri, state["bri"], state["on"], test.want, test.on)
+		}
+		if got, _ := client.last(deskTopic(test.endpoint)); got != test.step {
+			t.Errorf("%s = %q, want %q", test.endpoint, got, test.step)
+		}
+	}
+}
+
+func TestLightEndpointsByType(t *testing.T) {
+	tests := []struct {
+		lightType string
+		has, not  []string
+	}{
+		{"Extended color light", []string{"On", "Brightness", "Hue", "Color Temp"}, nil},
+		{"Color light", []string{"Hue", "XY Color"}, []string{"Color Temp", "Sunrise"}},
+		{"Color temperature light", []string{"Color Temp", "Brightness"}, []string{"Hue", "RGB"}},
+		{"Dimmable light", []string{"Brightness", "Sunset"}, []string{"Hue", "Color Temp", "Color Mode"}},
+		{"On/off light", []string{"On", "Rename", "Lock"}, []string{"Brightness", "Sunset"}},
+		{"On/off plug-in unit", []string{"On", "ID", "Reachable"}, []string{"Brightness", "Rename", "Lock", "State"}},
+	}
+
+	for _, test := range tests {
+		points := lightEndpoints(test.lightType)
+		for _, point := range test.has {
+			if points[point] == nil {
+				t.Errorf("%s lacks the %s endpoint", test.lightType, point)
+			}
+		}
+		for _, point := range test.not {
+			if points[point] != nil {
+				t.Errorf("%s has the %s endpoint", test.lightType, point)
+			}
+		}
+	}
+}
+
+func TestErrorClearedAfterSuccess(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	_, client, _ := startBridge(t, f, nil)
+
+	client.send(deskTopic("Brightness")+"/Set", "101")
+	client.send(deskTopic("Brightness")+"/Set", "50")
+
+	want := []string{"Brightness must be from 0-100", ""}
+	if got := client.payloads(deskTopic("Brightness") + "/Error"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Brightness/Error = %q, want %q", got, want)
+	}
+}
+
+func TestRandomColor(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	_, client, _ := startBridge(t, f, nil)
+
+	for i := 0; i < 20; i++ {
+		client.send(deskTopic("RandomColor")+"/Set", "")
+
+		xy := f.state("1")["xy"].([]interface{})
+		p := [2]float32{float32(xy[0].(float64)), float32(xy[1].(float64))}
+		gamut := gamuts["C"]
+		if !closeXY(p, gamut.closest(p), 1e-6) {
+			t.Fatalf("RandomColor chose %v, outside gamut C", p)
+		}
+		if got, _ := client.last(deskTopic("XY Color")); got != formatXY(p) {
+			t.Fatalf("XY Color = %q, want %s", got, formatXY(p))
+		}
+	}
+}
+
+func TestPublishesOnlyChanges(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	b, client, _ := startBridge(t, f, nil)
+
+	client.send(deskTopic("Brightness")+"/Set", "50")
+	client.send(deskTopic("Brightness")+"/Set", "50")
+	if got := client.payloads(deskTopic("Brightness")); !reflect.DeepEqual(got, []string{"0", "50"}) {
+		t.Errorf("Brightness published %q, want the change only", got)
+	}
+
+	// A poll publishes only what changed outside of Casa
+	client.reset()
+	f.setState("1", map[string]interface{}{"hue": float64(500)})
+	err := b.refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := client.last(deskTopic("Hue")); got != "500" {
+		t.Errorf("Hue = %q after a poll, want 500", got)
+	}
+	if _, ok := client.last(deskTopic("Brightness")); ok {
+		t.Error("Poll republished the unchanged Brightness")
+	}
+
+	// Get answers even when nothing changed
+	client.send(deskTopic("Brightness")+"/Get", "")
+	if got, _ := client.last(deskTopic("Brightness")); got != "50" {
+		t.Errorf("Brightness/Get = %q, want 50", got)
+	}
+}
+
+func TestLockRejectsCommands(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	_, client, _ := startBridge(t, f, nil)
+
+	client.send(deskTopic("Lock")+"/Set", "true")
+	client.send(deskTopic("On")+"/Set", "true")
+
+	if got, _ := client.last(deskTopic("Lock") + "/Rejected"); got != "On: true" {
+		t.Errorf("Lock/Rejected = %q, want On: true", got)
+	}
+	if f.state("1")["on"] != false {
+		t.Error("Locked light was switched on")
+	}
+
+	client.send(deskTopic("Lock")+"/Set", "false")
+	client.send(deskTopic("On")+"/Set", "true")
+	if f.state("1")["on"] != true {
+		t.Error("Unlocked light wasn't switched on")
+	}
+}
+
+func TestUndo(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	f.setState("1", map[string]interface{}{"on": true, "bri": float64(254)})
+	_, client, _ := startBridge(t, f, nil)
+
+	client.send(deskTopic("Brightness")+"/Set", "20")
+	client.send(deskTopic("Undo")+"/Set", "")
+
+	if got := f.state("1")["bri"]; got != float64(254) {
+		t.Errorf("Undo left bri at %v, want 254", got)
+	}
+}
+
+func TestOutOfGamutColor(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	_, client, logger := startBridge(t, f, nil)
+
+	client.send(deskTopic("XY Color")+"/Set", "0.8,0.2")
+
+	got, _ := client.last(deskTopic("XY Color"))
+	if got == "0.8,0.2" {
+		t.Error("XY Color outside the gamut was sent unchanged")
+	}
+	if !logger.contains("outside the gamut") {
+		t.Error("Moving the color into the gamut wasn't logged")
+	}
+}
+
+func TestLightsAddressedByID(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("7", "Desk", "Extended color light")
+	_, client, _ := startBridge(t, f, nil)
+
+	client.send(testPath+"/Light/7/On/Set", "true")
+	if got := f.state("7")["on"]; got != true {
+		t.Error("Light addressed by ID wasn't switched on")
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The settings Casa keeps for a light, as saved by Export
+type lightSettings struct {
+	// The Hue unique ID and the name of the light, to find it on import
+	UniqueID string `json:"uniqueid"`
+	Name     string `json:"name"`
+
+	OnBrightness   int    `json:"onbrightness"`
+	TransitionTime uint16 `json:"transitiontime"`
+	Locked         bool   `json:"locked"`
+}
+
+// The service state saved by Export
+type serviceState struct {
+	Lights []lightSettings `json:"lights"`
+
+	// The state of every light, as taken by SnapshotState
+	Snapshot json.RawMessage `json:"snapshot,omitempty"`
+}
+
+// Export returns the settings the service keeps for each light, such as its
+// OnBrightness, TransitionTime and Lock, and a snapshot of the lights as
+// JSON, for Import to restore on this or another host. Nothing configured on
+// the bridge itself is included.
+func (b *Bridge) Export() ([]byte, error) {
+	snapshot, err := b.SnapshotState()
+	if err != nil {
+		return nil, err
+	}
+
+	b.m.RLock()
+	state := serviceState{
+		Lights:   make([]lightSettings, 0, len(b.lights)),
+		Snapshot: snapshot,
+	}
+	for _, light := range b.lights {
+		light.m.RLock()
+		state.Lights = append(state.Lights, lightSettings{
+			UniqueID:       light.Light.UniqueID,
+			Name:           light.name,
+			OnBrightness:   light.onBrightness,
+			TransitionTime: light.transitionTime,
+			Locked:         light.locked,
+		})
+		light.m.RUnlock()
+	}
+	b.m.RUnlock()
+
+	sort.Slice(state.Lights, func(i, j int) bool {
+		return state.Lights[i].Name < state.Lights[j].Name
+	})
+	return json.MarshalIndent(state, "", "  ")
+}
+
+// Import restores the settings and snapshot saved by Export. Lights are found
+// by their Hue unique ID, or by name if no light has the ID, such as after
+// moving to another bridge. Nothing is changed if the settings are invalid.
+// Every light found is restored, and the lights that weren't found or failed
+// to restore are returned together.
+func (b *Bridge) Import(data []byte) error {
+	var state serviceState
+	err := json.Unmarshal(data, &state)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range state.Lights {
+		if s.OnBrightness < 0 || s.OnBrightness > 100 {
+			return errors.New("Invalid OnBrightness for " + s.Name + ": " +
+				strconv.Itoa(s.OnBrightness))
+		}
+	}
+
+	var snapshot map[string]json.RawMessage
+	if len(state.Snapshot) > 0 {
+		err = json.Unmarshal(state.Snapshot, &snapshot)
+		if err != nil {
+			return err
+		}
+	}
+
+	var failed []string
+	found := make(map[*Light]lightSettings)
+
+	// The snapshot is keyed by the exported names, which are changed to the
+	// current names of the lights found by unique ID
+	restore := make(map[string]json.RawMessage)
+
+	b.m.RLock()
+	for _, s := range state.Lights {
+		light := b.lightByUniqueID(s.UniqueID)
+		if light == nil {
+			light = b.lightByName(s.Name)
+		}
+		if light == nil {
+			failed = append(failed, "Unknown light "+s.Name)
+			continue
+		}
+		found[light] = s
+		if values, ok := snapshot[s.Name]; ok {
+			restore[light.name] = values
+		}
+
+		// Locks are applied after the snapshot, which they would reject
+		light.m.Lock()
+		light.onBrightness = s.OnBrightness
+		light.transitionTime = s.TransitionTime
+		light.locked = false
+		light.m.Unlock()
+	}
+	b.m.RUnlock()
+
+	if len(restore) > 0 {
+		data, err := json.Marshal(restore)
+		if err == nil {
+			err = b.RestoreState(data)
+		}
+		if err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+
+	b.m.RLock()
+	for light, s := range found {
+		light.m.Lock()
+		light.locked = s.Locked
+		light.m.Unlock()
+
+		err := light.publishState("TransitionTime", "Lock")
+		if err != nil {
+			failed = append(failed, light.name+": "+err.Error())
+		}
+	}
+	b.m.RUnlock()
+
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return errors.New("Unable to import Hue lights: " + strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// Returns the light with the Hue unique ID, or nil if there is none. b.m must
+// be held.
+func (b *Bridge) lightByUniqueID(id string) *Light {
+	if id == "" {
+		return nil
+	}
+	for _, light := range b.lights {
+		if light.Light.UniqueID == id {
+			return light
+		}
+	}
+	return nil
+}
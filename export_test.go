@@ -0,0 +1,155 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// The settings Export saves for the light
+func settingsOf(l *Light) lightSettings {
+	l.m.RLock()
+	defer l.m.RUnlock()
+	return lightSettings{
+		UniqueID:       l.Light.UniqueID,
+		Name:           l.name,
+		OnBrightness:   l.onBrightness,
+		TransitionTime: l.transitionTime,
+		Locked:         l.locked,
+	}
+}
+
+// Starts a bridge with the Desk light on at a color temperature, and returns
+// its export after setting the light's OnBrightness, TransitionTime and Lock
+func exportDesk(t *testing.T) []byte {
+	f := newFakeBridge(t)
+	light := f.addLight("1", "Desk", "Extended color light")
+	state := light["state"].(map[string]interface{})
+	state["on"], state["bri"], state["ct"] = true, float64(127), float64(250)
+
+	b, client, _ := startBridge(t, f, nil)
+	client.send(deskTopic("TransitionTime/Set"), "7")
+	client.send(deskTopic("Lock/Set"), "true")
+	desk := b.lights["1"]
+	desk.m.Lock()
+	desk.onBrightness = 40
+	desk.m.Unlock()
+
+	data, err := b.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	data := exportDesk(t)
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"same name", "Desk"},
+		// Found by unique ID after being renamed
+		{"renamed", "Office"},
+	}
+
+	for _, test := range tests {
+		f := newFakeBridge(t)
+		f.addLight("1", test.want, "Extended color light")
+		b, client, _ := startBridge(t, f, nil)
+
+		err := b.Import(data)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		want := lightSettings{
+			UniqueID:       "00:17:88:01:00:00:00:01",
+			Name:           test.want,
+			OnBrightness:   40,
+			TransitionTime: 7,
+			Locked:         true,
+		}
+		if got := settingsOf(b.lights["1"]); got != want {
+			t.Errorf("%s: imported %+v, want %+v", test.name, got, want)
+		}
+
+		state := f.state("1")
+		if state["on"] != true || state["bri"] != float64(127) || state["ct"] != float64(250) {
+			t.Errorf("%s: snapshot restored to %v", test.name, state)
+		}
+
+		path := testPath + "/Light/" + test.want
+		if got, _ := client.last(path + "/Lock"); got != "true" {
+			t.Errorf("%s: Lock = %q, want true", test.name, got)
+		}
+		if got, _ := client.last(path + "/TransitionTime"); got != "7" {
+			t.Errorf("%s: TransitionTime = %q, want 7", test.name, got)
+		}
+
+		// What was imported exports the same settings
+		again, err := b.Export()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var exported serviceState
+		err = json.Unmarshal(again, &exported)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(exported.Lights) != 1 || exported.Lights[0] != want {
+			t.Errorf("%s: exported %+v after importing, want %+v",
+				test.name, exported.Lights, want)
+		}
+	}
+}
+
+func TestImportRejections(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	b, _, _ := startBridge(t, f, nil)
+	before := settingsOf(b.lights["1"])
+
+	tests := []struct {
+		name, data string
+		changed    bool
+		want       string
+	}{
+		{"not json", `not json`, false, ""},
+		{"invalid OnBrightness",
+			`{"lights": [{"name": "Desk", "onbrightness": 150, "transitiontime": 3}]}`,
+			false, "OnBrightness"},
+		{"unknown light",
+			`{"lights": [{"name": "Desk", "transitiontime": 3}, {"name": "Hall"}]}`,
+			true, "Unknown light Hall"},
+	}
+
+	for _, test := range tests {
+		err := b.Import([]byte(test.data))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: Import returned %v, want an error containing %q",
+				test.name, err, test.want)
+		}
+
+		got := settingsOf(b.lights["1"])
+		if changed := got != before; changed != test.changed {
+			t.Errorf("%s: Import changed Desk to %+v: %v, want %v",
+				test.name, got, changed, test.changed)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/inhies/GoHue"
+)
+
+// Time between the steps of a fade for each light being faded. The bridge
+// only handles around 10 light state changes per second, so fading more
+// lights makes for fewer, longer steps.
+const fadeStepPerLight = 100 * time.Millisecond
+
+// FadeTarget is the state lights are faded to by Bridge.Fade. Nil fields are
+// left unchanged.
+type FadeTarget struct {
+	// Brightness percentage from 1-100
+	Brightness *int        `json:"brightness"`
+	XY         *[2]float32 `json:"xy"`
+}
+
+// The payload accepted by the bridge Fade command, for example
+// {"lights":["Lamp A","Lamp B"],"brightness":10,"duration":60}
+type fadeRequest struct {
+	FadeTarget
+	Lights []string `json:"lights"`
+
+	// Duration in seconds
+	Duration float64 `json:"duration"`
+}
+
+// Runs the Fade bridge command
+func (b *Bridge) fadeCommand(payload string) error {
+	var req fadeRequest
+	err := json.Unmarshal([]byte(payload), &req)
+	if err != nil {
+		return err
+	}
+
+	return b.Fade(req.Lights, req.FadeTarget,
+		time.Duration(req.Duration*float64(time.Second)))
+}
+
+// Fade smoothly moves the named lights together to target over duration.
+// The fade runs in the background and replaces any fade already running.
+func (b *Bridge) Fade(names []string, target FadeTarget, duration time.Duration) error {
+	if len(names) == 0 {
+		return errors.New("No lights to fade")
+	}
+	if target.Brightness != nil &&
+		(*target.Brightness < 1 || *target.Brightness > 100) {
+		return errors.New("Fade brightness must be from 1-100")
+	}
+
+	lights := make([]*Light, 0, len(names))
+	b.m.RLock()
+	for _, name := range names {
+		light := b.lightByName(name)
+		if light == nil {
+			b.m.RUnlock()
+			return errors.New("Invalid Hue device specified: " + name)
+		}
+		lights = append(lights, light)
+	}
+	b.m.RUnlock()
+
+	b.fadeM.Lock()
+	defer b.fadeM.Unlock()
+
+	b.stopFade()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	b.cancelFade = cancel
+	b.fadeDone = done
+
+	go func() {
+		defer close(done)
+		b.runFade(ctx, lights, target, duration)
+	}()
+	return nil
+}
+
+// Cancels the running fade, if any, and waits for it to stop. b.fadeM must be
+// held.
+func (b *Bridge) stopFade() {
+	if b.cancelFade == nil {
+		return
+	}
+
+	b.cancelFade()
+	<-b.fadeDone
+	b.cancelFade = nil
+	b.fadeDone = nil
+}
+
+// Steps the lights from their current state to target until the fade is done
+// or ctx is cancelled, then publishes the state the lights were left in.
+func (b *Bridge) runFade(ctx context.Context, lights []*Light, target FadeTarget, duration time.Duration) {
+	interval := time.Duration(len(lights)) * fadeStepPerLight
+	steps := int(duration / interval)
+	if steps < 1 {
+		steps = 1
+	}
+
+	type start struct {
+		bri float64
+		xy  [2]float32
+	}
+	starts := make([]start, len(lights))
+	for i, light := range lights {
+		current := light.current()
+		starts[i] = start{float64(current.State.Bri), current.State.XY}
+	}
+
+	// Each step fades into the next
+	transition := strconv.FormatInt(int64(interval/(100*time.Millisecond)), 10)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+fade:
+	for step := 1; step <= steps; step++ {
+		select {
+		case <-ctx.Done():
+			break fade
+		case <-ticker.C:
+		}
+
+		progress := float64(step) / float64(steps)
+		for i, light := range lights {
+			state := hue.LightState{
+				On:             true,
+				TransitionTime: transition,
+			}
+			if target.Brightness != nil {
+				bri := float64(percentToBri(*target.Brightness))
+				state.Bri = uint8(starts[i].bri + (bri-starts[i].bri)*progress)
+			}
+			if target.XY != nil {
+				state.XY = &[2]float32{
+					starts[i].xy[0] + (target.XY[0]-starts[i].xy[0])*float32(progress),
+					starts[i].xy[1] + (target.XY[1]-starts[i].xy[1])*float32(progress),
+				}
+			}
+
+			err := light.setState(state)
+			if err != nil {
+				b.Log("Unable to fade "+light.Light.Name+":", err)
+				continue
+			}
+
+			light.changeState(func(cur *hue.Light) {
+				cur.State.On = true
+				if state.Bri != 0 {
+					cur.State.Bri = state.Bri
+				}
+				if state.XY != nil {
+					cur.State.XY = *state.XY
+				}
+			})
+		}
+	}
+
+	for _, light := range lights {
+		err := light.publishState("On", "Brightness", "XY Color")
+		if err != nil {
+			b.Log(err)
+		}
+	}
+}
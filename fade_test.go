@@ -0,0 +1,69 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"testing"
+)
+
+func TestFade(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	f.addLight("2", "Hall", "Extended color light")
+	_, client, _ := startBridge(t, f, nil)
+
+	client.reset()
+	client.send(testPath+"/Fade/Set", `{"lights":["Desk","Hall"],"brightness":100,"xy":[0.5,0.4],"duration":0.5}`)
+
+	for _, name := range []string{"Desk", "Hall"} {
+		if got := client.waitFor(t, testPath+"/Light/"+name+"/Brightness"); got != "100" {
+			t.Errorf("%s Brightness = %q after the fade, want 100", name, got)
+		}
+		if got, _ := client.last(testPath + "/Light/" + name + "/XY_Color"); got != "0.5,0.4" {
+			t.Errorf("%s XY Color = %q after the fade, want 0.5,0.4", name, got)
+		}
+	}
+	for _, id := range []string{"1", "2"} {
+		if got := f.state(id)["bri"]; got != float64(254) {
+			t.Errorf("Light %s bri = %v after the fade, want 254", id, got)
+		}
+	}
+	if n := f.count("PUT", "/api/test/lights/1/state"); n < 2 {
+		t.Errorf("Fade took %d steps, want several", n)
+	}
+}
+
+func TestFadeRejects(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	b, _, _ := startBridge(t, f, nil)
+
+	bright := 150
+	tests := []struct {
+		name   string
+		lights []string
+		target FadeTarget
+	}{
+		{"no lights", nil, FadeTarget{}},
+		{"unknown light", []string{"Desk", "Attic"}, FadeTarget{}},
+		{"brightness", []string{"Desk"}, FadeTarget{Brightness: &bright}},
+	}
+
+	for _, test := range tests {
+		if err := b.Fade(test.lights, test.target, 0); err == nil {
+			t.Errorf("%s: Fade succeeded", test.name)
+		}
+	}
+}
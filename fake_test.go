@@ -0,0 +1,669 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/casaplatform/casa"
+	"github.com/casaplatform/mqtt"
+	"github.com/spf13/viper"
+)
+
+// The user the fake bridge accepts
+const testUser = "test"
+
+// The topic path of the bridge started by startBridge
+const testPath = "Service/Hue/Test"
+
+// A MessageClient that records what the bridge publishes and passes the
+// commands sent by tests to the bridge's handler
+type fakeClient struct {
+	m            sync.Mutex
+	handler      func(msg *casa.Message, err error)
+	published    []casa.Message
+	subscribed   []string
+	unsubscribed []string
+	closed       bool
+}
+
+func (c *fakeClient) Handle(handler func(msg *casa.Message, err error)) {
+	c.m.Lock()
+	c.handler = handler
+	c.m.Unlock()
+}
+
+func (c *fakeClient) Close() error {
+	c.m.Lock()
+	c.closed = true
+	c.m.Unlock()
+	return nil
+}
+
+func (c *fakeClient) PublishMessage(msg casa.Message) error {
+	c.m.Lock()
+	c.published = append(c.published, msg)
+	c.m.Unlock()
+	return nil
+}
+
+func (c *fakeClient) Publish(topic string, payload []byte) error {
+	return c.PublishMessage(casa.Message{Topic: topic, Payload: payload})
+}
+
+func (c *fakeClient) Subscribe(topic string) error {
+	c.m.Lock()
+	c.subscribed = append(c.subscribed, topic)
+	c.m.Unlock()
+	return nil
+}
+
+func (c *fakeClient) Unsubscribe(topic string) error {
+	c.m.Lock()
+	c.unsubscribed = append(c.unsubscribed, topic)
+	c.m.Unlock()
+	return nil
+}
+
+// Delivers a message to the bridge as the broker would
+func (c *fakeClient) send(topic, payload string) {
+	c.m.Lock()
+	handler := c.handler
+	c.m.Unlock()
+
+	handler(&casa.Message{Topic: topic, Payload: []byte(payload)}, nil)
+}
+
+// Returns the payloads published to topic, oldest first
+func (c *fakeClient) payloads(topic string) []string {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	var payloads []string
+	for _, msg := range c.published {
+		if msg.Topic == topic {
+			payloads = append(payloads, string(msg.Payload))
+		}
+	}
+	return payloads
+}
+
+// Returns the last payload published to topic, if there is one
+func (c *fakeClient) last(topic string) (string, bool) {
+	payloads := c.payloads(topic)
+	if len(payloads) == 0 {
+		return "", false
+	}
+	return payloads[len(payloads)-1], true
+}
+
+// Waits for a message on topic and returns the last payload published to it
+func (c *fakeClient) waitFor(t *testing.T, topic string) string {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if payload, ok := c.last(topic); ok {
+			return payload
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Nothing published to %s", topic)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// Forgets the messages published so far
+func (c *fakeClient) reset() {
+	c.m.Lock()
+	c.published = nil
+	c.m.Unlock()
+}
+
+// Collects what the bridge logs, as logging through t after a test ends
+// panics
+type testLogger struct {
+	m     sync.Mutex
+	lines []string
+}
+
+func (l *testLogger) Log(a ...interface{}) {
+	l.m.Lock()
+	l.lines = append(l.lines, strings.TrimSpace(fmt.Sprintln(a...)))
+	l.m.Unlock()
+}
+
+// Reports whether a logged line contains s
+func (l *testLogger) contains(s string) bool {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	for _, line := range l.lines {
+		if strings.Contains(line, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// An in-memory Hue bridge serving the parts of the REST API the service uses
+type fakeBridge struct {
+	m       sync.Mutex
+	srv     *httptest.Server
+	model   string
+	lights  map[string]map[string]interface{}
+	groups  map[string]map[string]interface{}
+	scenes  map[string]map[string]interface{}
+	sensors map[string]map[string]interface{}
+
+	// Requests received, as "METHOD /path"
+	requests []string
+
+	// The last action sent to each group
+	actions map[string]map[string]interface{}
+
+	// Answers a request instead of the fake when it returns ok
+	intercept func(r *http.Request) (status int, body string, ok bool)
+}
+
+func newFakeBridge(t *testing.T) *fakeBridge {
+	f := &fakeBridge{
+		model:   "BSB002",
+		lights:  make(map[string]map[string]interface{}),
+		groups:  make(map[string]map[string]interface{}),
+		scenes:  make(map[string]map[string]interface{}),
+		sensors: make(map[string]map[string]interface{}),
+		actions: make(map[string]map[string]interface{}),
+	}
+	f.srv = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+// Returns the host and port the fake bridge listens on
+func (f *fakeBridge) addr() string {
+	return strings.TrimPrefix(f.srv.URL, "http://")
+}
+
+// Adds a reachable light that is off, returning its description for tests
+// to adjust before the bridge starts
+func (f *fakeBridge) addLight(id, name, lightType string) map[string]interface{} {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	light := map[string]interface{}{
+		"name":             name,
+		"type":             lightType,
+		"modelid":          "LCT015",
+		"manufacturername": "Signify",
+		"uniqueid":         "00:17:88:01:00:00:00:0" + id,
+		"swversion":        "1.50.2",
+		"state": map[string]interface{}{
+			"on":        false,
+			"bri":       float64(1),
+			"hue":       float64(0),
+			"sat":       float64(0),
+			"effect":    "none",
+			"xy":        []interface{}{0.3227, 0.329},
+			"ct":        float64(366),
+			"alert":     "none",
+			"colormode": "ct",
+			"reachable": true,
+		},
+		"capabilities": map[string]interface{}{
+			"control": map[string]interface{}{
+				"ct": map[string]interface{}{"min": float64(153), "max": float64(500)},
+			},
+		},
+		"config": map[string]interface{}{
+			"startup": map[string]interface{}{"mode": "safety"},
+		},
+	}
+	f.lights[id] = light
+	return light
+}
+
+// Adds a room holding the lights with the given IDs
+func (f *fakeBridge) addGroup(id, name string, lights ...string) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	members := make([]interface{}, len(lights))
+	for i, light := range lights {
+		members[i] = light
+	}
+	f.groups[id] = map[string]interface{}{
+		"name":   name,
+		"type":   "Room",
+		"lights": members,
+		"action": map[string]interface{}{"on": false},
+	}
+}
+
+// Adds a scene setting the lights to the given states, keyed by light ID. The
+// scene is a group scene if group is set and a light scene otherwise.
+func (f *fakeBridge) addScene(id, name, group string, states map[string]map[string]interface{}) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	lights := make([]string, 0, len(states))
+	for light := range states {
+		lights = append(lights, light)
+	}
+	sort.Strings(lights)
+
+	members := make([]interface{}, len(lights))
+	lightstates := make(map[string]interface{}, len(states))
+	for i, light := range lights {
+		members[i] = light
+		lightstates[light] = states[light]
+	}
+
+	scene := map[string]interface{}{
+		"name":        name,
+		"type":        "LightScene",
+		"lights":      members,
+		"lightstates": lightstates,
+		"lastupdated": "2016-12-25T10:30:00",
+	}
+	if group != "" {
+		scene["type"] = "GroupScene"
+		scene["group"] = group
+	}
+	f.scenes[id] = scene
+}
+
+// Adds a sensor of the given Hue type. Its config reports the battery
+// percentage unless battery is negative.
+func (f *fakeBridge) addSensor(id, name, sensorType string, battery int) map[string]interface{} {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	config := map[string]interface{}{"on": true, "reachable": true}
+	if battery >= 0 {
+		config["battery"] = float64(battery)
+	}
+	sensor := map[string]interface{}{
+		"name":   name,
+		"type":   sensorType,
+		"state":  map[string]interface{}{"presence": false, "lastupdated": "none"},
+		"config": config,
+	}
+	f.sensors[id] = sensor
+	return sensor
+}
+
+// Returns a copy of the state of the light
+func (f *fakeBridge) state(id string) map[string]interface{} {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	state := make(map[string]interface{})
+	for k, v := range f.lights[id]["state"].(map[string]interface{}) {
+		state[k] = v
+	}
+	return state
+}
+
+// Changes the state of the light as if someone used the Hue app
+func (f *fakeBridge) setState(id string, changes map[string]interface{}) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	state := f.lights[id]["state"].(map[string]interface{})
+	for k, v := range changes {
+		state[k] = v
+	}
+}
+
+// Returns the number of requests received with the method whose path starts
+// with prefix
+func (f *fakeBridge) count(method, prefix string) int {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	n := 0
+	for _, r := range f.requests {
+		if strings.HasPrefix(r, method+" "+prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+// The description the bridge serves for discovery and model detection
+const fakeDescription = `<?xml version="1.0" encoding="UTF-8" ?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<device>
+<friendlyName>Test</friendlyName>
+<modelName>Philips hue bridge 2015</modelName>
+<modelNumber>%s</modelNumber>
+<serialNumber>001788000000</serialNumber>
+</device>
+</root>`
+
+func (f *fakeBridge) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	f.m.Lock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	intercept := f.intercept
+	f.m.Unlock()
+
+	if intercept != nil {
+		if status, answer, ok := intercept(r); ok {
+			w.WriteHeader(status)
+			fmt.Fprint(w, answer)
+			return
+		}
+	}
+
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.URL.Path == "/description.xml":
+		fmt.Fprintf(w, fakeDescription, f.model)
+		return
+	case r.URL.Path == "/discovery":
+		writeJSON(w, []map[string]string{{"id": "001788fffe000000", "internalipaddress": f.addr()}})
+		return
+	case parts[0] != "api":
+		http.NotFound(w, r)
+		return
+	case len(parts) == 1:
+		writeJSON(w, []interface{}{map[string]interface{}{
+			"success": map[string]string{"username": "registered"}}})
+		return
+	case parts[1] != testUser:
+		writeJSON(w, []interface{}{map[string]interface{}{
+			"error": map[string]interface{}{"type": 1, "address": "/", "description": "unauthorized user"}}})
+		return
+	case len(parts) == 2:
+		writeJSON(w, map[string]interface{}{"lights": f.lights})
+		return
+	}
+
+	var params map[string]interface{}
+	json.Unmarshal(body, &params)
+
+	resource, rest := parts[2], parts[3:]
+	switch resource {
+	case "config":
+		if r.Method == "DELETE" {
+			writeJSON(w, success(r.URL.Path+" deleted"))
+			return
+		}
+		writeJSON(w, map[string]interface{}{
+			"name":          "Test",
+			"apiversion":    "1.46.0",
+			"swversion":     "1946157000",
+			"mac":           "00:17:88:00:00:00",
+			"bridgeid":      "001788FFFE000000",
+			"zigbeechannel": 15,
+			"whitelist": map[string]interface{}{
+				testUser: map[string]string{
+					"name":          "casa#hue",
+					"create date":   "2016-01-01T00:00:00",
+					"last use date": "2016-01-02T00:00:00",
+				},
+			},
+		})
+	case "lights":
+		f.serveLights(w, r.Method, rest, params)
+	case "groups":
+		f.serveGroups(w, r.Method, rest, params)
+	case "scenes":
+		f.serveScenes(w, r.Method, rest, params)
+	case "sensors":
+		writeJSON(w, f.sensors)
+	case "schedules":
+		switch r.Method {
+		case "POST":
+			writeJSON(w, []interface{}{map[string]interface{}{
+				"success": map[string]string{"id": "1"}}})
+		case "DELETE":
+			writeJSON(w, success(r.URL.Path+" deleted"))
+		default:
+			writeJSON(w, map[string]interface{}{})
+		}
+	default:
+		writeJSON(w, notFound(r.URL.Path))
+	}
+}
+
+func (f *fakeBridge) serveLights(w http.ResponseWriter, method string, rest []string, params map[string]interface{}) {
+	if len(rest) == 0 {
+		writeJSON(w, f.lights)
+		return
+	}
+
+	light := f.lights[rest[0]]
+	if light == nil {
+		writeJSON(w, notFound("/lights/"+rest[0]))
+		return
+	}
+
+	switch {
+	case method == "GET":
+		writeJSON(w, light)
+	case len(rest) == 1:
+		for k, v := range params {
+			light[k] = v
+		}
+		writeJSON(w, success("/lights/"+rest[0]))
+	case rest[1] == "state":
+		applyFakeState(light["state"].(map[string]interface{}), params)
+		writeJSON(w, success("/lights/"+rest[0]+"/state"))
+	case rest[1] == "config":
+		config := light["config"].(map[string]interface{})
+		for k, v := range params {
+			config[k] = v
+		}
+		writeJSON(w, success("/lights/"+rest[0]+"/config"))
+	}
+}
+
+func (f *fakeBridge) serveGroups(w http.ResponseWriter, method string, rest []string, params map[string]interface{}) {
+	if len(rest) == 0 {
+		writeJSON(w, f.groups)
+		return
+	}
+	if method == "GET" {
+		writeJSON(w, f.groups[rest[0]])
+		return
+	}
+
+	f.actions[rest[0]] = params
+
+	var members []interface{}
+	if group := f.groups[rest[0]]; group != nil {
+		members, _ = group["lights"].([]interface{})
+	}
+	if id, ok := params["scene"].(string); ok {
+		// Recalling a scene sets each member to its stored state
+		if scene := f.scenes[id]; scene != nil {
+			states, _ := scene["lightstates"].(map[string]interface{})
+			for light, state := range states {
+				if l := f.lights[light]; l != nil {
+					applyFakeState(l["state"].(map[string]interface{}), state.(map[string]interface{}))
+				}
+			}
+		}
+	} else {
+		for _, id := range members {
+			if l := f.lights[id.(string)]; l != nil {
+				applyFakeState(l["state"].(map[string]interface{}), params)
+			}
+		}
+	}
+	writeJSON(w, success("/groups/"+rest[0]+"/action"))
+}
+
+func (f *fakeBridge) serveScenes(w http.ResponseWriter, method string, rest []string, params map[string]interface{}) {
+	switch {
+	case method == "POST":
+		id := "scene" + strconv.Itoa(len(f.scenes)+1)
+		f.scenes[id] = params
+		writeJSON(w, []interface{}{map[string]interface{}{
+			"success": map[string]string{"id": id}}})
+	case method == "DELETE":
+		delete(f.scenes, rest[0])
+		writeJSON(w, success("/scenes/"+rest[0]+" deleted"))
+	case len(rest) > 0:
+		writeJSON(w, f.scenes[rest[0]])
+	default:
+		writeJSON(w, f.scenes)
+	}
+}
+
+// Applies the fields of a state change to state, as the bridge does
+func applyFakeState(state, params map[string]interface{}) {
+	increments := map[string]struct {
+		field    string
+		min, max float64
+	}{
+		"bri_inc": {"bri", 1, 254},
+		"hue_inc": {"hue", 0, 65535},
+		"sat_inc": {"sat", 0, 254},
+		"ct_inc":  {"ct", 153, 500},
+	}
+
+	for k, v := range params {
+		if inc, ok := increments[k]; ok {
+			value, _ := state[inc.field].(float64)
+			value += v.(float64)
+			if value < inc.min {
+				value = inc.min
+			}
+			if value > inc.max {
+				value = inc.max
+			}
+			state[inc.field] = value
+			continue
+		}
+
+		switch k {
+		case "transitiontime":
+			continue
+		case "xy":
+			state["colormode"] = "xy"
+		case "ct":
+			state["colormode"] = "ct"
+		case "hue", "sat":
+			state["colormode"] = "hs"
+		}
+		state[k] = v
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
+func success(address string) []interface{} {
+	return []interface{}{map[string]interface{}{
+		"success": map[string]interface{}{address: true}}}
+}
+
+func notFound(address string) []interface{} {
+	return []interface{}{map[string]interface{}{
+		"error": map[string]interface{}{"type": 3, "address": address,
+			"description": "resource, " + address + ", not available"}}}
+}
+
+// The settings every test bridge starts with, keeping tests fast
+var testSettings = map[string]interface{}{
+	"User":             testUser,
+	"MaxBridgeRPS":     1000,
+	"RetryBaseDelayMs": 1,
+	"InitWorkers":      2,
+}
+
+// Starts a Bridge against the fake bridge with testSettings and settings,
+// returning it with the client it publishes through and the logger it logs
+// to. The bridge is stopped when the test ends.
+func startBridge(t *testing.T, f *fakeBridge, settings map[string]interface{}) (*Bridge, *fakeClient, *testLogger) {
+	t.Helper()
+
+	b, client, logger, err := tryStartBridge(t, f, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, client, logger
+}
+
+// Starts a Bridge as startBridge does, returning the error Start returns
+func tryStartBridge(t *testing.T, f *fakeBridge, settings map[string]interface{}) (*Bridge, *fakeClient, *testLogger, error) {
+	t.Helper()
+
+	client := &fakeClient{}
+	oldClient, oldURL := newClient, discoveryURL
+	newClient = func(uri string, options ...mqtt.Option) (casa.MessageClient, error) {
+		return client, nil
+	}
+	discoveryURL = f.srv.URL + "/discovery"
+	t.Cleanup(func() { newClient, discoveryURL = oldClient, oldURL })
+
+	b := &Bridge{}
+	logger := &testLogger{}
+	b.UseLogger(logger)
+
+	err := b.Start(context.Background(), testConfig(settings))
+	if err != nil {
+		return b, client, logger, err
+	}
+	t.Cleanup(func() { b.Stop() })
+	return b, client, logger, nil
+}
+
+// Returns a config with testSettings and settings
+func testConfig(settings map[string]interface{}) *viper.Viper {
+	config := viper.New()
+	for k, v := range testSettings {
+		config.Set(k, v)
+	}
+	for k, v := range settings {
+		config.Set(k, v)
+	}
+	return config
+}
+
+// Returns the sorted keys of m
+func keys(m map[string]string) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
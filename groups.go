@@ -0,0 +1,162 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"strconv"
+
+	"github.com/inhies/GoHue"
+)
+
+// Group wraps a Hue room or zone. Groups have the same endpoints as lights,
+// applied to all of their lights at once through the group action API.
+type Group struct {
+	*Light
+	Group *hue.Group
+}
+
+// Endpoints that apply to groups: every light endpoint except those
+// describing a single bulb or relying on increments groups don't support, plus
+// Scene and Scenes.
+var groupEndpoints = func() map[string]*endpoint {
+	points := copyEndpoints(endpoints)
+	for _, point := range []string{"Gamut", "Reachable", "ModelID", "FirmwareVersion",
+		"ID", "HueStep", "SaturationStep", "PowerOnBehavior", "Groups", "Rename"} {
+		delete(points, point)
+	}
+
+	points["Scene"] = &endpoint{
+		Params:      "name string",
+		Description: "Recalls the named scene on the group",
+		SetState: func(l *Light, payload string) error {
+			return l.recallScene(payload)
+		},
+		GetState: func(l *Light, topic string) (string, error) {
+			l.m.RLock()
+			defer l.m.RUnlock()
+			if l.scene == "" {
+				return "None", nil
+			}
+			return l.scene, nil
+		}}
+
+	points["Scenes"] = &endpoint{
+		Params:      "read only",
+		Description: "A JSON array of the scenes that can be recalled on the group, with their id, name, lights and lastupdated time",
+		GetState: func(l *Light, topic string) (string, error) {
+			return l.sceneListing()
+		}}
+	return points
+}()
+
+// Creates the Group for g. Its Light holds the state reported by the group
+// action so the light endpoints can read it.
+func (b *Bridge) newGroup(g *hue.Group) *Group {
+	l := &hue.Light{
+		Name: g.Name,
+		Type: g.Type,
+	}
+
+	a := g.Action
+	if a.On != nil {
+		l.State.On = *a.On
+	}
+	if a.Bri != nil {
+		l.State.Bri = uint8(*a.Bri)
+	}
+	if a.Hue != nil {
+		l.State.Hue = uint16(*a.Hue)
+	}
+	if a.Sat != nil {
+		l.State.Saturation = uint8(*a.Sat)
+	}
+	if a.Ct != nil {
+		l.State.CT = uint16(*a.Ct)
+	}
+	if len(a.XY) == 2 {
+		l.State.XY = [2]float32{float32(a.XY[0]), float32(a.XY[1])}
+	}
+	l.State.Effect = a.Effect
+	l.State.Alert = a.Alert
+	l.State.ColorMode = a.Colormode
+
+	return &Group{
+		Light: &Light{
+			Light:     l,
+			Path:      b.lightPath("Group", g.Name),
+			name:      g.Name,
+			endpoints: copyEndpoints(groupEndpoints),
+
+			transitionTime: defaultTransitionTime,
+
+			group:  g,
+			bridge: b,
+		},
+		Group: g,
+	}
+}
+
+// A group action with the transition time, which hue.Action doesn't carry
+type groupActionState struct {
+	*hue.Action
+	TransitionTime *uint16 `json:"transitiontime,omitempty"`
+}
+
+// Converts a light state to the equivalent group action, keeping its
+// transition time
+func groupAction(state hue.LightState) groupActionState {
+	action := &hue.Action{
+		On:     &state.On,
+		Effect: state.Effect,
+		Alert:  state.Alert,
+	}
+
+	if state.Bri != 0 {
+		bri := int(state.Bri)
+		action.Bri = &bri
+	}
+	if state.Hue != 0 {
+		h := int(state.Hue)
+		action.Hue = &h
+	}
+	if state.Sat != 0 {
+		sat := int(state.Sat)
+		action.Sat = &sat
+	}
+	if state.CT != 0 {
+		ct := int(state.CT)
+		action.Ct = &ct
+	}
+	if state.XY != nil {
+		action.XY = []float64{float64(state.XY[0]), float64(state.XY[1])}
+	}
+
+	result := groupActionState{Action: action}
+	if t, err := strconv.ParseUint(state.TransitionTime, 10, 16); err == nil {
+		transition := uint16(t)
+		result.TransitionTime = &transition
+	}
+	return result
+}
+
+// Sends action to the group action API of group
+func (b *Bridge) setGroupAction(group *hue.Group, action groupActionState) error {
+	body, _, err := b.hueBridge().Put("/api/"+b.User+"/groups/"+
+		strconv.Itoa(group.Index)+"/action", action)
+	if err != nil {
+		return err
+	}
+	return apiError(body)
+}
@@ -0,0 +1,85 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// The body of the /live and /ready responses
+type healthReport struct {
+	Bridge string `json:"bridge"`
+	MQTT   string `json:"mqtt"`
+	Lights int    `json:"lights"`
+	TS     string `json:"ts"`
+}
+
+// Starts serving liveness at /live and readiness at /ready on HealthPort
+func (b *Bridge) startHealth(port int) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/live", func(w http.ResponseWriter, r *http.Request) {
+		b.serveHealth(w, true)
+	})
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		report := b.health()
+		b.serveHealth(w, report.Bridge == "online" && report.MQTT == "connected")
+	})
+
+	srv, err := b.listen(port, mux)
+	if err != nil {
+		return err
+	}
+	b.healthServer = srv
+	return nil
+}
+
+// Returns the current state of the bridge and MQTT connections
+func (b *Bridge) health() healthReport {
+	b.cm.RLock()
+	connected := b.client != nil && b.brokerConnected
+	b.cm.RUnlock()
+
+	b.m.RLock()
+	lights := len(b.lights)
+	b.m.RUnlock()
+
+	report := healthReport{
+		Bridge: b.currentStatus(),
+		MQTT:   "disconnected",
+		Lights: lights,
+		TS:     time.Now().Format(time.RFC3339),
+	}
+	if connected {
+		report.MQTT = "connected"
+	}
+	return report
+}
+
+// Writes the health report with 200 if ok, or 503 otherwise
+func (b *Bridge) serveHealth(w http.ResponseWriter, ok bool) {
+	data, err := json.Marshal(b.health())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(data)
+}
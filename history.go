@@ -0,0 +1,114 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Number of commands kept for each light when HistoryDepth isn't set
+const defaultHistoryDepth = 20
+
+// A command to an endpoint of a light, with the value the endpoint had before
+// it and the error it failed with, if it failed
+type historyEntry struct {
+	Endpoint  string
+	OldValue  string
+	NewValue  string
+	Timestamp time.Time
+	Err       error
+}
+
+// MarshalJSON writes the entry with its error as a string
+func (e historyEntry) MarshalJSON() ([]byte, error) {
+	var text string
+	if e.Err != nil {
+		text = e.Err.Error()
+	}
+
+	return json.Marshal(struct {
+		Endpoint  string    `json:"endpoint"`
+		OldValue  string    `json:"old"`
+		NewValue  string    `json:"new"`
+		Timestamp time.Time `json:"timestamp"`
+		Err       string    `json:"error,omitempty"`
+	}{e.Endpoint, e.OldValue, e.NewValue, e.Timestamp, text})
+}
+
+// Returns the HistoryDepth setting from config
+func historyDepth(config *viper.Viper) int {
+	if !config.IsSet("HistoryDepth") {
+		return defaultHistoryDepth
+	}
+	return config.GetInt("HistoryDepth")
+}
+
+// Records a command to the endpoint at the front of the light's history,
+// dropping the oldest once HistoryDepth are kept
+func (l *Light) recordHistory(endpoint, old, payload string, err error) {
+	depth := l.bridge.historyDepth
+	if depth == 0 {
+		return
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	entry := historyEntry{
+		Endpoint:  endpoint,
+		OldValue:  old,
+		NewValue:  payload,
+		Timestamp: time.Now(),
+		Err:       err,
+	}
+	l.history = append([]historyEntry{entry}, l.history...)
+	if len(l.history) > depth {
+		l.history = l.history[:depth]
+	}
+}
+
+// Returns a copy of the light's history, newest first
+func (l *Light) historyEntries() []historyEntry {
+	l.m.RLock()
+	defer l.m.RUnlock()
+	return append([]historyEntry(nil), l.history...)
+}
+
+// Returns the light's history as the JSON array published to History
+func (l *Light) historyState() (string, error) {
+	entries := l.historyEntries()
+	if entries == nil {
+		entries = []historyEntry{}
+	}
+
+	data, err := json.Marshal(entries)
+	return string(data), err
+}
+
+// GetLightHistory returns the latest commands to the endpoints of the named
+// light, newest first.
+func (b *Bridge) GetLightHistory(name string) ([]historyEntry, error) {
+	b.m.RLock()
+	light := b.lightByName(name)
+	b.m.RUnlock()
+	if light == nil {
+		return nil, errors.New("Invalid Hue device specified: " + name)
+	}
+	return light.historyEntries(), nil
+}
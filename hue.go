@@ -12,12 +12,26 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+// Package hue is a Casa service bridging the lights, groups and sensors of
+// Philips Hue bridges to MQTT topics.
+//
+// Every message is published and subscribed at the default QoS of the MQTT
+// client, as casa.Message and the casa/mqtt client have no way to choose one
+// yet. Until they do, ValidateConfig rejects the MQTTPublishQoS and
+// MQTTSubscribeQoS settings rather than ignoring them.
 package hue
 
 import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"text/template"
 	"time"
 
 	"github.com/casaplatform/casa"
@@ -25,18 +39,21 @@ import (
 	"github.com/casaplatform/mqtt"
 	"github.com/inhies/GoHue"
 	"github.com/pkg/errors"
+	"github.com/spf13/cast"
 	"github.com/spf13/viper"
 )
 
+// Default topic prefixes, changed with the SvcPrefix and TopicNamespace config
+// keys
 const (
+	SvcPrefix = "Service"
 	Namespace = "Hue"
 )
 
 // TODO: Add more colors from http://www.developers.meethue.com/documentation/hue-xy-values
 // TODO: Make colors work with multiple color gamuts (A,B,C)
-// TODO: Make getting color names from values possible
 
-// Simple pre-defined colors
+// Simple pre-defined colors, extended by LoadColors. Guarded by colorsM.
 var Colors = map[string]*[2]float32{
 	"Red":    hue.RED,
 	"Yellow": hue.YELLOW,
@@ -49,15 +66,166 @@ var Colors = map[string]*[2]float32{
 	"White":  hue.WHITE,
 }
 
+var colorsM sync.RWMutex
+
 type Bridge struct {
 	IP     string
 	User   string
+	cm     sync.RWMutex // Protects client
 	client casa.MessageClient
+	root   string // Topic prefix shared by every Hue bridge
+	path   string // Topic prefix of this bridge
+
+	// Options the MQTT client is connected with, and the signal to
+	// reconnect when its connection drops
+	brokerOptions []mqtt.Option
+	brokerDown    chan struct{}
+
+	// Whether the MQTT client's connection is up, protected by cm
+	brokerConnected bool
 
 	m      sync.RWMutex
-	lights map[string]*Light
+	lights map[string]*Light // Keyed by Hue light ID
+	groups map[string]*Group // Keyed by sanitized name
+
+	// Motion, daylight, temperature and light level sensors, keyed by Hue
+	// sensor ID
+	sensors map[string]*Sensor
+
+	// Maps the sanitized name used in a light's topic path to its Hue light ID
+	nameIndex map[string]string
+
+	// Sanitized names that lights are being renamed to but that aren't in
+	// nameIndex yet. Commands hold b.m for reading, so renames reserve names
+	// under renameM and moveLight releases them under b.m.
+	renameM  sync.Mutex
+	renaming map[string]bool
 
+	// The lights and the Lights of groups, keyed by topic path for routing
+	// commands
+	devices map[string]*Light
+
+	// The lights keyed by the topic path they would have if named by their
+	// Hue ID, so commands can address a light by ID
+	lightsByID map[string]*Light
+
+	// Builds the topic paths of devices, see PathTemplate
+	pathTemplate *template.Template
+	scenes       map[string]*hue.Scene
+
+	// Every scene on the bridge as listed by Group.Scenes, or nil until it
+	// is read again after a rescan
+	sceneM    sync.Mutex
+	sceneList []Scene
+
+	bm     sync.RWMutex // Protects bridge and netFailures
 	bridge *hue.Bridge
+	config *viper.Viper
+
+	// Consecutive network failures of bridge calls, and the signal to
+	// reconnect once there are too many
+	netFailures int
+	reconnect   chan struct{}
+
+	// Limits the rate of state changes sent to the bridge
+	limiter *limiter
+
+	// How often and how patiently failed bridge calls are retried
+	retryM        sync.RWMutex
+	retryAttempts int
+	retryDelay    time.Duration
+
+	// Stops calling the bridge while it keeps failing
+	breaker breaker
+
+	// The running fade across lights, if any
+	fadeM      sync.Mutex
+	cancelFade context.CancelFunc
+	fadeDone   chan struct{}
+
+	// Log messages on subscribed topics that aren't commands
+	logUnknown bool
+
+	// Use lowercase, underscore separated endpoint names in topics
+	normalizeTopics bool
+
+	// Allow deleting bridge whitelist entries over MQTT
+	allowWhitelistDelete bool
+
+	// Publish the value confirmed by the bridge after each command
+	echoCommands bool
+
+	// Re-apply the last commanded state to lights that become reachable
+	// again
+	reapplyOnRecovery bool
+
+	// Furthest xy distance at which Color Name reports the nearest color
+	colorNameThreshold float64
+
+	// Battery percentage below which a sensor's battery is logged as low
+	lowBatteryPercent int
+
+	// Number of changes Undo can revert on each light
+	undoDepth int
+
+	// Number of commands kept in the History of each light
+	historyDepth int
+
+	// How long to wait for further commands to an endpoint before applying
+	// the latest, and the commands waiting
+	debounceDelay time.Duration
+	debouncer     debouncer
+
+	// Clamp color temperatures outside a light's range rather than rejecting
+	// them
+	clampColorTemp bool
+
+	// Receives an entry for each command to an endpoint, if set
+	auditM sync.Mutex
+	audit  io.Writer
+
+	// Counts of calls and messages served on MetricsPort, if it is set
+	metrics       *metrics
+	metricsServer *http.Server
+
+	// Serves liveness and readiness on HealthPort, if it is set
+	healthServer *http.Server
+
+	// The bridge's schedules, keyed by ID
+	schedM    sync.RWMutex
+	schedules map[string]*Schedule
+
+	// Cancels each user registration in progress, keyed by bridge IP
+	regM          sync.Mutex
+	registrations map[string]context.CancelFunc
+
+	// The status last published, such as online or degraded
+	statusM sync.Mutex
+	status  string
+
+	// Settings of simulations such as Sunrise
+	simM sync.RWMutex
+	sim  simSettings
+
+	// How often the bridge is polled for changes, and signalled by Reload
+	// when it changes so the wait under way is cut short
+	pollEvery time.Duration
+	repoll    chan struct{}
+
+	// Cancels the context of the background workers, which Stop waits for
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+
+	// The context of the background workers, for the work that commands
+	// start while b.m is held
+	ctxM sync.RWMutex
+	ctx  context.Context
+
+	// Commands being handled, which Stop lets finish before disconnecting.
+	// Once stopping, guarded by cm, no more are added.
+	inflight sync.WaitGroup
+	stopping bool
+
 	casa.Logger
 }
 
@@ -65,14 +233,90 @@ type Light struct {
 	Light *hue.Light
 	Path  string
 
+	// The name used in the topic path, which is the Hue name made unique on
+	// the bridge
+	name string
+
 	m         sync.RWMutex
 	endpoints map[string]*endpoint
 
+	// Color temperature range reported by the bridge, in mireds, or 0 if
+	// unknown
+	ctMin, ctMax uint16
+
+	// Names of the groups the light belongs to, sorted
+	memberOf []string
+
+	// Startup mode used when the light regains power, or empty if unknown
+	powerOn string
+
+	// Brightness percentage used when turning the light on, 0 to leave the
+	// brightness unchanged
+	onBrightness int
+
+	// Transition time used for state changes, in multiples of 100ms
+	transitionTime uint16
+
+	// Number of bulk operations setting the light, whose state changes may
+	// use the burst granted by withBurst
+	bulk int
+
+	// The Hue group targeted by SetState, if this is a Group's Light
+	group *hue.Group
+
+	// Name of the last scene recalled on the group
+	scene string
+
+	// The last value published for each endpoint
+	lastPublished map[string]string
+
+	// Recent changes made through endpoints, newest last, for Undo
+	changes []undoEntry
+
+	// The state commanded through setState, merged over every command, for
+	// ReapplyOnRecovery
+	commanded jsonState
+
+	// Recent commands to endpoints, newest first
+	history []historyEntry
+
+	// Set through the Lock endpoint to reject commands to other endpoints
+	locked bool
+
+	// Functions registered by Bridge.Watch for each endpoint
+	watchers map[string][]*watcher
+
+	// Endpoints whose Error topic holds the failure of the last command
+	failed map[string]bool
+
+	// Cancels the running simulation, such as a sunrise, and is closed once
+	// it has finished
+	activeSim context.CancelFunc
+	simDone   chan struct{}
+
 	bridge *Bridge
 }
 
+// Config keys that can only take effect by reconnecting to the Hue bridge or
+// the MQTT broker, or by republishing every topic, and are therefore rejected
+// by Reload.
+var reconnectKeys = []string{"BridgeIP", "User", "MQTT.User", "MQTT.Pass",
+	"MQTTBroker", "MQTTUsername", "MQTTPassword", "MQTTClientCert",
+	"MQTTClientKey", "MQTTCACert", "NormalizeTopicNames", "SvcPrefix",
+	"TopicNamespace", "PathTemplate", "MetricsPort",
+	"HealthPort"}
+
 func init() {
-	environment.RegisterService("hue", &Bridge{})
+	environment.RegisterService("hue", service{&Bridge{}})
+}
+
+// Adapts Bridge to casa.Service, whose Start doesn't take a context
+type service struct {
+	*Bridge
+}
+
+func (s service) Start(config *viper.Viper) error {
+	return s.Bridge.Start(context.Background(), config)
 }
 
 func NewBridge(ip string) *Bridge {
@@ -80,6 +324,209 @@ func NewBridge(ip string) *Bridge {
 		IP: ip,
 	}
 }
+
+// Multibridge runs a Bridge for each of the Hue bridges listed under the
+// Bridges config key, each publishing under its own TopicNamespace. Aliases
+// spanning lights on several of the bridges are commanded under
+// {Root}/Alias/{Alias}.
+type Multibridge struct {
+	m       sync.Mutex
+	bridges []*Bridge
+
+	// The running bridges keyed by Namespace, the members of each alias
+	// keyed in lower case, and the client receiving alias commands under
+	// root
+	named   map[string]*Bridge
+	aliases map[string][]aliasMember
+	client  casa.MessageClient
+	root    string
+
+	// Alias commands being handled, and whether Stop is waiting for them, so
+	// that no more are added
+	inflight sync.WaitGroup
+	stopping bool
+
+	casa.Logger
+}
+
+func (mb *Multibridge) UseLogger(logger casa.Logger) {
+	mb.Logger = logger
+}
+
+// Start starts a Bridge for each entry of the Bridges config key, such as
+// {IP: 192.168.1.2, User: abc, Namespace: Upstairs}, with the rest of config
+// applying to all of them. The bridges are started concurrently and a bridge
+// that fails to start is logged without stopping the others; an error is only
+// returned if none of them start. Aliases are read from the Aliases config
+// key, such as {Downstairs: [{Bridge: Upstairs, Light: Desk}]}, naming each
+// light by the Namespace of its bridge.
+func (mb *Multibridge) Start(ctx context.Context, config *viper.Viper) error {
+	entries, err := cast.ToSliceE(config.Get("Bridges"))
+	if err != nil || len(entries) == 0 {
+		return errors.New("Bridges must list the Hue bridges to run")
+	}
+
+	configs := make([]*viper.Viper, len(entries))
+	namespaces := make(map[string]bool)
+	for i, entry := range entries {
+		settings, err := entrySettings(entry)
+		if err != nil {
+			return errors.New("Bridges entry " + strconv.Itoa(i) + " must be a map of IP, User and Namespace")
+		}
+
+		namespace := settings["namespace"]
+		if namespace == "" || namespaces[namespace] {
+			return errors.New("Bridges entry " + strconv.Itoa(i) + " needs a Namespace of its own")
+		}
+		namespaces[namespace] = true
+
+		sub := viper.New()
+		for _, key := range config.AllKeys() {
+			sub.Set(key, config.Get(key))
+		}
+		sub.Set("Bridges", nil)
+		if settings["ip"] != "" {
+			sub.Set("BridgeIP", settings["ip"])
+		}
+		sub.Set("User", settings["user"])
+		sub.Set("TopicNamespace", namespace)
+		configs[i] = sub
+	}
+
+	aliases, err := parseAliases(config, namespaces)
+	if err != nil {
+		return err
+	}
+
+	var (
+		wg      sync.WaitGroup
+		started = make([]*Bridge, len(configs))
+	)
+	for i, sub := range configs {
+		wg.Add(1)
+		go func(i int, sub *viper.Viper) {
+			defer wg.Done()
+
+			b := &Bridge{}
+			b.UseLogger(mb.Logger)
+			err := b.Start(ctx, sub)
+			if err != nil {
+				mb.Log("Unable to start Hue bridge "+sub.GetString("TopicNamespace")+":", err)
+				b.Stop()
+				return
+			}
+			started[i] = b
+		}(i, sub)
+	}
+	wg.Wait()
+
+	mb.m.Lock()
+	mb.named = make(map[string]*Bridge)
+	for i, b := range started {
+		if b != nil {
+			mb.bridges = append(mb.bridges, b)
+			mb.named[configs[i].GetString("TopicNamespace")] = b
+		}
+	}
+	running := len(mb.bridges)
+	mb.m.Unlock()
+
+	if running == 0 {
+		return errors.New("Unable to start any Hue bridge")
+	}
+	if len(aliases) > 0 {
+		err = mb.serveAliases(config, aliases)
+		if err != nil {
+			return errors.Wrap(err, "Unable to receive Hue alias commands")
+		}
+	}
+	return nil
+}
+
+// Stop stops every bridge and waits for all of them to finish
+func (mb *Multibridge) Stop() error {
+	// Alias commands being handled finish, publishing their outcome, before
+	// their bridges stop, and no more are accepted meanwhile
+	mb.m.Lock()
+	mb.stopping = true
+	client, root := mb.client, mb.root
+	mb.m.Unlock()
+
+	if client != nil {
+		err := client.Unsubscribe(root + "/Alias/#")
+		if err != nil {
+			mb.Log("Unable to unsubscribe from Hue alias commands:", err)
+		}
+	}
+	mb.inflight.Wait()
+
+	mb.m.Lock()
+	bridges := mb.bridges
+	mb.bridges, mb.named, mb.client = nil, nil, nil
+	mb.m.Unlock()
+
+	if client != nil {
+		err := client.Close()
+		if err != nil {
+			mb.Log("Unable to close the Hue alias client:", err)
+		}
+	}
+
+	var (
+		wg     sync.WaitGroup
+		errs   = make([]error, len(bridges))
+		failed []string
+	)
+	for i, b := range bridges {
+		wg.Add(1)
+		go func(i int, b *Bridge) {
+			defer wg.Done()
+			errs[i] = b.Stop()
+		}(i, b)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New("Unable to stop Hue bridges: " + strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// Returns the device class used in topic paths for the given Hue light type.
+// Smart plugs are reported by the bridge as on/off plug-in units, but they
+// switch appliances rather than bulbs so they are published as a "Plug".
+// Bulbs that can only be switched, of type "On/Off light", stay lights.
+func deviceClass(lightType string) string {
+	switch strings.ToLower(lightType) {
+	case "on/off plug-in unit":
+		return "Plug"
+	}
+	return "Light"
+}
+
+// Returns the generation of a Hue bridge from its model number or name: 1 for
+// the original round bridge, 2 for the square one.
+func bridgeGeneration(info hue.BridgeInfo) int {
+	if info.Device.ModelNumber == "BSB001" ||
+		strings.Contains(info.Device.ModelName, "2012") {
+		return 1
+	}
+	return 2
+}
+
+// Returns an error naming feature if the bridge is older than a v2 bridge
+func (b *Bridge) requireV2(feature string) error {
+	if bridgeGeneration(b.hueBridge().Info) < 2 {
+		return errors.New(feature + " requires a v2 Hue bridge")
+	}
+	return nil
+}
+
 func (b *Bridge) UseLogger(logger casa.Logger) {
 	b.Logger = logger
 }
@@ -91,48 +538,108 @@ func (b *Bridge) handler(msg *casa.Message, err error) {
 		b.Log(err)
 		return
 	case msg != nil:
+		if !b.beginCommand() {
+			return
+		}
+		defer b.inflight.Done()
+
+		if !b.connected() {
+			b.Log(errors.Wrap(ErrNotConnected, "Dropping message on "+msg.Topic))
+			return
+		}
+
+		b.metrics.countMessage("in")
+
 		m := strings.Split(msg.Topic, "/")
 
-		if m[len(m)-1] == "Register" {
-			newbridge, err := hue.NewBridge(m[len(m)-2])
-			if err != nil {
-				b.Log("Unable to connect to Hue bridge:", err)
+		// We only care about commands and refresh requests sent to us
+		command := m[len(m)-1]
+		if command != "Set" && command != "Get" {
+			b.m.RLock()
+			logUnknown := b.logUnknown
+			b.m.RUnlock()
+
+			if logUnknown {
+				b.Log("Ignoring unrecognized topic: " + msg.Topic)
+			}
+			return
+		}
+
+		// Registering users on a bridge
+		if command == "Set" && b.registerCommand(msg.Topic) {
+			return
+		}
+
+		// Creating and deleting scenes
+		if command == "Set" {
+			if ok, err := b.sceneCommand(msg.Topic, string(msg.Payload)); ok {
+				if err != nil {
+					b.Log(err)
+				}
 				return
 			}
-			b.Log("Press the link button on the Hue bridge")
-			var token string
-			for i := 0; i < 12; i++ {
-				time.Sleep(5 * time.Second)
-				token, err = newbridge.CreateUser("Casa" + strconv.FormatInt(time.Now().Unix(), 10))
+		}
+
+		// Managing the bridge's schedules
+		if ok, err := b.scheduleCommand(msg.Topic, command, string(msg.Payload)); ok {
+			if err != nil {
+				b.Log(err)
+			}
+			return
+		}
+
+		// Commands addressed to the bridge itself rather than a light
+		if command == "Set" && len(m) > 2 {
+			parent := strings.Join(m[:len(m)-2], "/")
+			if parent == b.path+"/All" {
+				_, err = b.setAllEndpoint(m[len(m)-2], string(msg.Payload))
 				if err != nil {
 					b.Log(err)
 				}
+				return
 			}
-			if token == "" {
-				b.Log("Unable to create user on Hue bridge. Please try again")
+			if parent == b.path || parent == b.path+"/Colors" {
+				name := strings.TrimPrefix(parent+"/"+m[len(m)-2], b.path+"/")
+				err = b.bridgeCommand(name, string(msg.Payload))
+				if err != nil {
+					b.Log(err)
+				}
 				return
 			}
-			b.Log("Token created:", token)
-
 		}
 
-		// We only care about commands sent to us
-		if m[len(m)-1] != "Set" {
-			return
+		// {Endpoint}/Stop/Set stops what the endpoint started
+		stop := command == "Set" && len(m) > 4 && m[len(m)-2] == "Stop"
+		if stop {
+			m = m[:len(m)-1]
 		}
 
 		b.m.RLock()
-		light := b.lights[m[len(m)-3]]
 		defer b.m.RUnlock()
 
+		// Devices are addressed by name, or lights by their Hue ID in
+		// place of the name
+		path := strings.Join(m[:len(m)-2], "/")
+		light := b.devices[path]
 		if light == nil {
-			b.Log(errors.New("Invalid Hue device specified: " + m[len(m)-3]))
+			light = b.lightsByID[path]
+		}
+		if light == nil {
+			b.Log("Warning: no Hue light or group is named or numbered " +
+				m[len(m)-3] + ", ignoring " + msg.Topic)
 			return
 		}
 
-		endpoint := m[len(m)-2]
+		endpoint := light.endpointName(m[len(m)-2])
 
-		err = light.setEndpointState(endpoint, string(msg.Payload))
+		switch {
+		case stop:
+			err = light.stopEndpoint(endpoint)
+		case command == "Get":
+			err = light.getEndpointState(endpoint)
+		default:
+			b.debounce(light, endpoint, string(msg.Payload))
+		}
 		if err != nil {
 			b.Log(err)
 		}
@@ -142,32 +649,45 @@ func (b *Bridge) handler(msg *casa.Message, err error) {
 	}
 
 }
-func (b *Bridge) Start(config *viper.Viper) error {
-	if config.IsSet("BridgeIP") &&
-		config.IsSet("User") {
+
+// Start connects to the Hue bridge and the MQTT broker and publishes every
+// light and group. Background workers run until ctx is done or Stop is called.
+func (b *Bridge) Start(ctx context.Context, config *viper.Viper) error {
+	err := ValidateConfig(config)
+	if err != nil {
+		return err
+	}
+
+	if config.IsSet("ColorsFile") {
+		err = LoadColors(config.GetString("ColorsFile"))
+		if err != nil {
+			return err
+		}
+	}
+
+	b.User = config.GetString("User")
+
+	if config.IsSet("BridgeIP") {
 		b.IP = config.GetString("BridgeIP")
-		b.User = config.GetString("User")
 	} else {
-		// Need to setup a new hue bridge here
-		return errors.New("No valid Hue bridge found in config")
-	}
-	var userString string
-	if config.IsSet("MQTT.User") {
-		userString = config.GetString("MQTT.User") + ":" +
-			config.GetString("MQTT.Pass") + "@"
+		ip, err := b.discoverIP()
+		if err != nil {
+			return err
+		}
+		b.IP = ip
 	}
-	client, err := mqtt.NewClient("tcp://" + userString + "127.0.0.1:1883")
 
+	bridge, err := hue.NewBridge(b.IP)
 	if err != nil {
 		return err
 	}
 
-	bridge, err := hue.NewBridge(b.IP)
+	err = bridge.Login(b.User)
 	if err != nil {
 		return err
 	}
 
-	err = bridge.Login(b.User)
+	err = validateUser(bridge, b.User)
 	if err != nil {
 		return err
 	}
@@ -177,61 +697,706 @@ func (b *Bridge) Start(config *viper.Viper) error {
 		return err
 	}
 
+	b.root = topicRoot(config)
+	b.path = b.root + "/" + sanitizeTopic(bridge.Info.Device.FriendlyName)
+	b.pathTemplate, err = parsePathTemplate(config, b.root)
+	if err != nil {
+		return err
+	}
+
+	// Let subscribers know the bridge is gone if we disconnect uncleanly,
+	// and reconnect when the broker goes away
+	b.brokerDown = make(chan struct{}, 1)
+	b.brokerOptions = []mqtt.Option{
+		mqtt.Will(casa.Message{
+			Topic:   b.path + "/Status",
+			Payload: []byte("offline"),
+			Retain:  true,
+		}),
+		mqtt.OnConnectionLost(b.brokerLost),
+	}
+	client, err := connectBroker(config, b.brokerOptions...)
+	if err != nil {
+		return err
+	}
+
+	b.cm.Lock()
 	b.client = client
+	b.brokerConnected = true
+	b.stopping = false
+	b.cm.Unlock()
+	b.bm.Lock()
+	b.bridge = bridge
+	b.bm.Unlock()
+	b.reconnect = make(chan struct{}, 1)
+	b.repoll = make(chan struct{}, 1)
+	b.config = config
+	b.logUnknown = config.GetBool("LogUnknownTopics")
+	b.normalizeTopics = config.GetBool("NormalizeTopicNames")
+	b.allowWhitelistDelete = config.GetBool("AllowWhitelistDelete")
+	b.echoCommands = config.GetBool("EchoCommands")
+	b.reapplyOnRecovery = config.GetBool("ReapplyOnRecovery")
+	b.colorNameThreshold = colorNameThreshold(config)
+	b.lowBatteryPercent = lowBatteryPercent(config)
+	b.undoDepth = undoDepth(config)
+	b.historyDepth = historyDepth(config)
+	b.clampColorTemp = config.GetBool("ClampColorTemp")
+	b.debounceDelay = debounceDelay(config)
+	b.sim = loadSimSettings(config)
+	b.pollEvery = pollInterval(config)
+	b.limiter = newLimiter(maxBridgeRPS(config))
+	b.retryAttempts, b.retryDelay = retrySettings(config)
+	b.breaker.configure(breakerSettings(config))
 	b.lights = make(map[string]*Light)
+	b.nameIndex = make(map[string]string)
+	b.devices = make(map[string]*Light)
+	b.lightsByID = make(map[string]*Light)
+	b.groups = make(map[string]*Group)
+
+	err = b.publishStatus("online")
+	if err != nil {
+		return err
+	}
 
+	err = b.publishInfo()
+	if err != nil {
+		return err
+	}
+
+	err = b.publishWhitelist()
+	if err != nil {
+		return err
+	}
+
+	initialized := make([]*Light, 0, len(lights))
 	for i := 0; i < len(lights); i++ {
 		l := lights[i]
-		id := "Service/" + Namespace + "/" + bridge.Info.Device.FriendlyName + "/Light/" + l.Name
+		id := strconv.Itoa(l.Index)
+		if strings.EqualFold(sanitizeTopic(l.Name), "All") {
+			return errors.New("Hue light " + id +
+				" is named All, which is reserved for commands to every light. Please rename it")
+		}
+
+		name := l.Name
+		if _, ok := b.nameIndex[sanitizeTopic(name)]; ok {
+			name = l.Name + "-" + id
+			b.Log("Warning: more than one Hue light is named " + l.Name +
+				", publishing light " + id + " as " + name)
+		}
+
 		light := &Light{
 			Light:     &l,
-			Path:      id,
-			endpoints: endpoints,
+			Path:      b.lightPath(deviceClass(l.Type), name),
+			name:      name,
+			endpoints: lightEndpoints(l.Type),
+
+			transitionTime: defaultTransitionTime,
 
 			bridge: b,
 		}
-		b.lights[l.Name] = light
+		light.configure(config)
+		b.lights[id] = light
+		b.nameIndex[sanitizeTopic(name)] = id
+		b.devices[light.Path] = light
+		b.lightsByID[b.lightPath(deviceClass(l.Type), id)] = light
+		initialized = append(initialized, light)
+	}
 
-		for point, data := range endpoints {
-			data.light = light
-			err := b.client.PublishMessage(casa.Message{
-				Topic:   "New/" + id + "/" + point,
-				Payload: []byte(data.Params + " : " + data.Description),
-				Retain:  true,
-			})
+	groups, err := bridge.GetAllGroups()
+	if err != nil {
+		return err
+	}
+	b.setMemberships(groups)
 
-			if err != nil {
-				return err
-			}
+	err = b.loadCapabilities()
+	if err != nil {
+		b.Log("Unable to read Hue light capabilities:", err)
+	}
 
-			payload, err := data.GetState(light, id+"/"+point)
-			if err != nil {
-				return err
-			}
+	err = publishLights(initialized, initWorkers(config))
+	if err != nil {
+		return err
+	}
 
-			err = b.client.PublishMessage(casa.Message{
-				Topic:   id + "/" + point,
-				Payload: []byte(payload),
-				Retain:  true,
-			})
-			if err != nil {
-				return err
+	b.scenes, err = b.loadScenes()
+	if err != nil {
+		return err
+	}
+
+	err = b.publishScenes()
+	if err != nil {
+		return err
+	}
+
+	err = b.publishSceneIDs()
+	if err != nil {
+		return err
+	}
+
+	err = b.publishColors()
+	if err != nil {
+		return err
+	}
+
+	err = b.refreshSchedules()
+	if err != nil {
+		b.Log("Unable to read Hue schedules:", err)
+	} else {
+		err = b.publishSchedules()
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := 0; i < len(groups); i++ {
+		group := b.newGroup(&groups[i])
+		b.groups[sanitizeTopic(group.Group.Name)] = group
+		b.devices[group.Path] = group.Light
+
+		err := group.publishEndpoints()
+		if err != nil {
+			return err
+		}
+	}
+
+	sensors, batteries, err := readSensors(bridge, b.User)
+	if err != nil {
+		return err
+	}
+
+	b.sensors = b.loadSensors(sensors, batteries)
+	for _, sensor := range b.sensors {
+		err := sensor.publishChanged()
+		if err != nil {
+			return err
+		}
+	}
+
+	if config.GetBool("RestoreOnStart") {
+		err = b.loadSnapshot(config.GetString("SnapshotFile"))
+		if err != nil {
+			b.Log("Unable to restore Hue snapshot:", err)
+		}
+	}
+
+	err = client.Subscribe(b.root + "/#")
+	if err != nil {
+		return err
+	}
+
+	err = b.publishDiscoveryComplete()
+	if err != nil {
+		return err
+	}
+
+	client.Handle(b.handler)
+	ctx, cancel := context.WithCancel(ctx)
+	b.m.Lock()
+	b.cancel = cancel
+	b.m.Unlock()
+
+	b.ctxM.Lock()
+	b.ctx = ctx
+	b.ctxM.Unlock()
+
+	if config.IsSet("MetricsPort") {
+		err = b.startMetrics(config.GetInt("MetricsPort"))
+		if err != nil {
+			return errors.Wrap(err, "Unable to serve Hue metrics")
+		}
+	}
+
+	if config.IsSet("HealthPort") {
+		err = b.startHealth(config.GetInt("HealthPort"))
+		if err != nil {
+			b.shutdown(b.metricsServer)
+			b.metricsServer = nil
+			b.metrics = nil
+			return errors.Wrap(err, "Unable to serve Hue health checks")
+		}
+	}
+
+	b.goWorker(func() { b.poll(ctx) })
+	b.goWorker(func() { b.reconnectLoop(ctx) })
+	b.goWorker(func() { b.brokerLoop(ctx) })
+	return nil
+}
+
+// Returns the InitWorkers setting from config, the number of lights published
+// at once during Start
+func initWorkers(config *viper.Viper) int {
+	workers := config.GetInt("InitWorkers")
+	if workers <= 0 {
+		return runtime.NumCPU()
+	}
+	return workers
+}
+
+// Publishes the endpoints of lights using the given number of workers. Every
+// light is attempted, and the errors of those that failed are returned
+// together.
+func publishLights(lights []*Light, workers int) error {
+	jobs := make(chan *Light)
+	errs := make(chan error, len(lights))
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for light := range jobs {
+				err := light.publishEndpoints()
+				if err != nil {
+					errs <- errors.Wrap(err, light.name)
+				}
 			}
+		}()
+	}
+
+	for _, light := range lights {
+		jobs <- light
+	}
+	close(jobs)
+	wg.Wait()
+	close(errs)
+
+	var failed []string
+	for err := range errs {
+		failed = append(failed, err.Error())
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return errors.New("Unable to publish Hue lights: " + strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// Returns the topic prefix shared by every Hue bridge, built from the
+// SvcPrefix and TopicNamespace config keys
+func topicRoot(config *viper.Viper) string {
+	prefix, namespace := SvcPrefix, Namespace
+	if config.IsSet("SvcPrefix") {
+		prefix = config.GetString("SvcPrefix")
+	}
+	if config.IsSet("TopicNamespace") {
+		namespace = config.GetString("TopicNamespace")
+	}
+	return prefix + "/" + namespace
+}
+
+// Returns the light published under name, or nil if there is none. The caller
+// must hold b.m.
+func (b *Bridge) lightByName(name string) *Light {
+	id, ok := b.nameIndex[sanitizeTopic(name)]
+	if !ok {
+		return nil
+	}
+	return b.lights[id]
+}
+
+// Publishes the descriptor and current state of each of the light's endpoints
+func (l *Light) publishEndpoints() error {
+	for point, data := range l.endpoints {
+		if data.Metadata {
+			continue
 		}
 
-		err := b.client.Subscribe("Service/" + Namespace + "/#")
+		err := l.bridge.publish(casa.Message{
+			Topic:   "New/" + l.topic(point),
+			Payload: []byte(data.Params + " : " + data.Description),
+			Retain:  true,
+		})
 		if err != nil {
 			return err
 		}
 	}
 
-	b.client.Handle(b.handler)
+	l.forgetPublished()
+	return l.publishState(l.pointNames()...)
+}
+
+// Describes one of a light's endpoints in the Endpoints listing, named as in
+// its topic
+type endpointInfo struct {
+	Name        string `json:"name"`
+	Params      string `json:"params"`
+	Description string `json:"description"`
+	ReadOnly    bool   `json:"readonly"`
+}
+
+// Returns the JSON array published to the Endpoints topic, describing every
+// other endpoint of the light sorted by name
+func (l *Light) endpointListing() (string, error) {
+	names := l.pointNames()
+	sort.Strings(names)
+
+	listing := make([]endpointInfo, 0, len(names))
+	for _, point := range names {
+		if point == "Endpoints" {
+			continue
+		}
+		data := l.endpoints[point]
+		listing = append(listing, endpointInfo{
+			Name:        l.bridge.topicName(point),
+			Params:      data.Params,
+			Description: data.Description,
+			ReadOnly:    data.SetState == nil,
+		})
+	}
+
+	payload, err := json.Marshal(listing)
+	return string(payload), err
+}
+
+// Returns the names of the light's endpoints
+func (l *Light) pointNames() []string {
+	names := make([]string, 0, len(l.endpoints))
+	for point := range l.endpoints {
+		names = append(names, point)
+	}
+	return names
+}
+
+// Publishes the DiscoveryComplete topic, which signals that the descriptors
+// and state of every device have been published.
+func (b *Bridge) publishDiscoveryComplete() error {
+	b.m.RLock()
+	count := len(b.lights) + len(b.groups) + len(b.sensors)
+	b.m.RUnlock()
+
+	payload, err := json.Marshal(struct {
+		Time    string `json:"time"`
+		Devices int    `json:"devices"`
+	}{time.Now().Format(time.RFC3339), count})
+	if err != nil {
+		return err
+	}
+
+	return b.publish(casa.Message{
+		Topic:   b.path + "/DiscoveryComplete",
+		Payload: payload,
+		Retain:  true,
+	})
+}
+
+// Reload applies the settings from config that are safe to change while the
+// service is running. Changes to settings that require a reconnect return an
+// error and leave the running configuration untouched.
+func (b *Bridge) Reload(config *viper.Viper) error {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if b.config == nil {
+		return errors.New("Unable to reload, Hue bridge not started")
+	}
+
+	err := ValidateConfig(config)
+	if err != nil {
+		return err
+	}
+
+	var colors map[string]*[2]float32
+	if config.IsSet("ColorsFile") {
+		colors, err = readColors(config.GetString("ColorsFile"))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, key := range reconnectKeys {
+		if config.GetString(key) != b.config.GetString(key) {
+			return errors.New("Changing " + key + " requires a restart")
+		}
+	}
+
+	// Nothing is applied until the whole config is known to be acceptable
+	setColors(colors)
+	b.config = config
+	b.logUnknown = config.GetBool("LogUnknownTopics")
+	b.allowWhitelistDelete = config.GetBool("AllowWhitelistDelete")
+	b.echoCommands = config.GetBool("EchoCommands")
+	b.reapplyOnRecovery = config.GetBool("ReapplyOnRecovery")
+	b.colorNameThreshold = colorNameThreshold(config)
+	b.lowBatteryPercent = lowBatteryPercent(config)
+	b.undoDepth = undoDepth(config)
+	b.historyDepth = historyDepth(config)
+	b.clampColorTemp = config.GetBool("ClampColorTemp")
+	b.debounceDelay = debounceDelay(config)
+	b.simM.Lock()
+	b.sim = loadSimSettings(config)
+	b.simM.Unlock()
+	if every := pollInterval(config); every != b.pollEvery {
+		b.pollEvery = every
+		select {
+		case b.repoll <- struct{}{}:
+		default:
+		}
+	}
+	b.limiter.setRate(maxBridgeRPS(config))
+	b.retryM.Lock()
+	b.retryAttempts, b.retryDelay = retrySettings(config)
+	b.retryM.Unlock()
+	b.breaker.configure(breakerSettings(config))
+	for _, light := range b.lights {
+		light.configure(config)
+	}
+	return nil
+}
+
+// Applies the per-light settings found under Lights.{Name} in config
+func (l *Light) configure(config *viper.Viper) {
+	key := "Lights." + l.Light.Name + "."
+
+	brightness := config.GetInt(key + "OnBrightness")
+	if brightness < 0 || brightness > 100 {
+		l.bridge.Log("Ignoring invalid OnBrightness for " + l.Light.Name +
+			": " + strconv.Itoa(brightness))
+		brightness = 0
+	}
+
+	l.m.Lock()
+	l.onBrightness = brightness
+	l.m.Unlock()
+}
+
+// ErrUnauthorized is returned by Start when the Hue bridge does not accept the
+// configured User token.
+var ErrUnauthorized = errors.New("Hue bridge rejected the configured User, register a new user and update the config")
+
+// Confirms the bridge accepts user by fetching the bridge configuration. Only
+// authorized users get the full configuration, which includes the whitelist;
+// anyone else gets an error response instead.
+func validateUser(bridge *hue.Bridge, user string) error {
+	body, _, err := bridge.Get("/api/" + user + "/config")
+	if err != nil {
+		return errors.Wrap(err, "Unable to validate Hue bridge user")
+	}
+
+	_, err = parseWhitelist(body)
+	if err != nil {
+		return ErrUnauthorized
+	}
 	return nil
 }
 
+// Unlocks every light and group so that no lock outlives the service
+func (b *Bridge) unlockAll() {
+	b.m.RLock()
+	defer b.m.RUnlock()
+
+	unlock := func(l *Light) {
+		l.m.Lock()
+		locked := l.locked
+		l.locked = false
+		l.m.Unlock()
+
+		if !locked {
+			return
+		}
+		err := l.publish("Lock", "false")
+		if err != nil && err != ErrNotConnected {
+			b.Log(err)
+		}
+	}
+	for _, light := range b.lights {
+		unlock(light)
+	}
+	for _, group := range b.groups {
+		unlock(group.Light)
+	}
+}
+
 func (b *Bridge) Stop() error {
-	if b.client != nil {
-		return b.client.Close()
+	b.fadeM.Lock()
+	b.stopFade()
+	b.fadeM.Unlock()
+
+	b.m.Lock()
+	cancel := b.cancel
+	b.cancel = nil
+	config := b.config
+	b.m.Unlock()
+
+	if cancel != nil && config.GetBool("SnapshotOnStop") {
+		err := b.saveSnapshot(config.GetString("SnapshotFile"))
+		if err != nil {
+			b.Log("Unable to save Hue snapshot:", err)
+		}
+	}
+
+	b.stopCommands()
+	b.cancelRegistrations()
+	b.cancelDebounced()
+
+	// Let commands being handled publish their outcome before disconnecting
+	b.drainCommands(stopDrainTimeout(config))
+
+	// Simulations restore the state they started from, which needs the
+	// bridge, so they stop before the workers are cancelled
+	b.stopSims()
+
+	if cancel != nil {
+		cancel()
+		b.waitWorkers(stopTimeout)
+	}
+
+	b.unlockAll()
+
+	b.shutdown(b.metricsServer)
+	b.metricsServer = nil
+	b.shutdown(b.healthServer)
+	b.healthServer = nil
+
+	err := b.publishStatus("offline")
+	if err != nil && err != ErrNotConnected {
+		b.Log(err)
+	}
+
+	b.cm.Lock()
+	client := b.client
+	b.client = nil
+	b.brokerConnected = false
+	b.cm.Unlock()
+
+	// Start counts from zero again
+	defer func() { b.metrics = nil }()
+
+	if client != nil {
+		return client.Close()
 	}
 	return nil
 }
+
+// How long Stop waits for background workers to finish
+const stopTimeout = 5 * time.Second
+
+// Returns the context of the background workers, which Stop cancels
+func (b *Bridge) workerContext() context.Context {
+	b.ctxM.RLock()
+	defer b.ctxM.RUnlock()
+	if b.ctx == nil {
+		return context.Background()
+	}
+	return b.ctx
+}
+
+// Runs fn in a background worker that Stop waits for
+func (b *Bridge) goWorker(fn func()) {
+	b.workers.Add(1)
+	go func() {
+		defer b.workers.Done()
+		fn()
+	}()
+}
+
+// Waits up to timeout for the background workers to finish
+func (b *Bridge) waitWorkers(timeout time.Duration) {
+	b.waitGroup(&b.workers, timeout, "Timed out waiting for Hue workers to stop")
+}
+
+// Counts a command as being handled, unless Stop has stopped accepting them
+func (b *Bridge) beginCommand() bool {
+	b.cm.Lock()
+	defer b.cm.Unlock()
+	if b.stopping {
+		return false
+	}
+	b.inflight.Add(1)
+	return true
+}
+
+// Stops accepting commands and unsubscribes from them, so that none are added
+// while Stop waits for those being handled
+func (b *Bridge) stopCommands() {
+	b.cm.Lock()
+	b.stopping = true
+	client := b.client
+	b.cm.Unlock()
+
+	if client != nil {
+		err := client.Unsubscribe(b.root + "/#")
+		if err != nil {
+			b.Log("Unable to unsubscribe from Hue commands:", err)
+		}
+	}
+}
+
+// Waits up to timeout for the commands being handled to finish
+func (b *Bridge) drainCommands(timeout time.Duration) {
+	b.waitGroup(&b.inflight, timeout, "Timed out waiting for Hue commands to finish")
+}
+
+// Waits up to timeout for wg, logging message if it doesn't finish in time
+func (b *Bridge) waitGroup(wg *sync.WaitGroup, timeout time.Duration, message string) {
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-finished:
+	case <-timer.C:
+		b.Log(message)
+	}
+}
+
+// Returns how long Stop waits for the commands being handled to finish, from
+// the StopDrainTimeoutSeconds setting in config
+func stopDrainTimeout(config *viper.Viper) time.Duration {
+	if config == nil || !config.IsSet("StopDrainTimeoutSeconds") {
+		return stopTimeout
+	}
+	return time.Duration(config.GetInt("StopDrainTimeoutSeconds")) * time.Second
+}
+
+// Publishes the retained bridge Status topic: "online" or "offline"
+func (b *Bridge) publishStatus(status string) error {
+	b.statusM.Lock()
+	b.status = status
+	b.statusM.Unlock()
+
+	return b.publish(casa.Message{
+		Topic:   b.path + "/Status",
+		Payload: []byte(status),
+		Retain:  true,
+	})
+}
+
+// ErrNotConnected is returned when publishing while the bridge has no MQTT
+// client, before Start has connected or after Stop.
+var ErrNotConnected = errors.New("MQTT client not connected")
+
+// Reports whether the bridge has a client to publish through
+func (b *Bridge) connected() bool {
+	b.cm.RLock()
+	defer b.cm.RUnlock()
+	return b.client != nil
+}
+
+// Publishes msg with the bridge's MQTT client
+func (b *Bridge) publish(msg casa.Message) error {
+	b.cm.RLock()
+	client := b.client
+	b.cm.RUnlock()
+
+	if client == nil {
+		return ErrNotConnected
+	}
+
+	err := client.PublishMessage(msg)
+	if err == nil {
+		b.metrics.countMessage("out")
+	}
+	return err
+}
+
+// Returns the status last published, such as online or degraded
+func (b *Bridge) currentStatus() string {
+	b.statusM.Lock()
+	defer b.statusM.Unlock()
+	return b.status
+}
@@ -0,0 +1,422 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/casaplatform/casa"
+	"github.com/inhies/GoHue"
+)
+
+func TestStartPublishesLights(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+
+	_, client, _ := startBridge(t, f, nil)
+
+	if got, _ := client.last(testPath + "/Status"); got != "online" {
+		t.Errorf("Status = %q, want online", got)
+	}
+	if got, _ := client.last(testPath + "/Light/Desk/On"); got != "false" {
+		t.Errorf("On = %q, want false", got)
+	}
+	if got, _ := client.last(testPath + "/Light/Desk/ID"); got != "1" {
+		t.Errorf("ID = %q, want 1", got)
+	}
+}
+
+func TestReloadRejection(t *testing.T) {
+	dir := t.TempDir()
+	colors := filepath.Join(dir, "colors.json")
+	err := ioutil.WriteFile(colors, []byte(`{"Teal": [0.17, 0.34]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	b, _, _ := startBridge(t, f, map[string]interface{}{"ColorsFile": colors})
+	defer setColors(nil)
+
+	tests := []struct {
+		name     string
+		settings map[string]interface{}
+	}{
+		{"invalid setting", map[string]interface{}{"MaxBridgeRPS": -1}},
+		{"restart setting", map[string]interface{}{"User": "other"}},
+		{"broken colors file", map[string]interface{}{"ColorsFile": filepath.Join(dir, "missing.json")}},
+	}
+
+	for _, test := range tests {
+		settings := map[string]interface{}{
+			"ColorsFile":         colors,
+			"ColorNameThreshold": 0.2,
+		}
+		for k, v := range test.settings {
+			settings[k] = v
+		}
+
+		err := b.Reload(testConfig(settings))
+		if err == nil {
+			t.Errorf("%s: Reload succeeded", test.name)
+		}
+		if b.colorNameThreshold != defaultColorNameThreshold {
+			t.Errorf("%s: rejected Reload changed ColorNameThreshold", test.name)
+		}
+		if _, _, err := lookupColor("Teal"); err != nil {
+			t.Errorf("%s: rejected Reload changed the colors: %v", test.name, err)
+		}
+	}
+
+	// Colors from the old file are dropped by a reload without one
+	err = b.Reload(testConfig(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := lookupColor("Teal"); err == nil {
+		t.Error("Reload without a ColorsFile kept the colors of the old one")
+	}
+	if _, _, err := lookupColor("Red"); err != nil {
+		t.Error("Reload dropped the built in colors:", err)
+	}
+}
+
+func TestReloadPollInterval(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	b, _, _ := startBridge(t, f, map[string]interface{}{"PollIntervalSeconds": 3600})
+
+	polls := func() int { return f.count("GET", "/api/test/sensors") }
+	started := polls()
+
+	err := b.Reload(testConfig(map[string]interface{}{"PollIntervalSeconds": 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The hour long wait under way is cut short by the reload
+	time.Sleep(2500 * time.Millisecond)
+	if n := polls() - started; n < 2 || n > 3 {
+		t.Errorf("Polled %d times in 2.5s after reloading a 1s interval, want 2", n)
+	}
+}
+
+func TestUnknownTopics(t *testing.T) {
+	tests := []struct {
+		log  bool
+		want bool
+	}{
+		{false, false},
+		{true, true},
+	}
+
+	for _, test := range tests {
+		f := newFakeBridge(t)
+		f.addLight("1", "Desk", "Extended color light")
+		_, client, logger := startBridge(t, f, map[string]interface{}{
+			"LogUnknownTopics": test.log,
+		})
+
+		client.send(testPath+"/Light/Desk/On", "true")
+		if got := logger.contains("Ignoring unrecognized topic: " + testPath + "/Light/Desk/On"); got != test.want {
+			t.Errorf("LogUnknownTopics=%v logged unknown topic: %v, want %v",
+				test.log, got, test.want)
+		}
+		if f.count("PUT", "/api/test/lights/1/state") != 0 {
+			t.Errorf("LogUnknownTopics=%v sent an unrecognized topic to the bridge", test.log)
+		}
+
+		// Commands are still routed to the light
+		client.send(testPath+"/Light/Desk/On/Set", "true")
+		if f.state("1")["on"] != true {
+			t.Errorf("LogUnknownTopics=%v dropped a command", test.log)
+		}
+		if logger.contains("Ignoring unrecognized topic: " + testPath + "/Light/Desk/On/Set") {
+			t.Errorf("LogUnknownTopics=%v logged a command as unrecognized", test.log)
+		}
+	}
+}
+
+func TestBridgeGeneration(t *testing.T) {
+	tests := []struct {
+		number, name string
+		want         int
+	}{
+		{"BSB001", "Philips hue bridge 2012", 1},
+		{"", "Philips hue bridge 2012", 1},
+		{"BSB002", "Philips hue bridge 2015", 2},
+		{"", "", 2},
+	}
+
+	for _, test := range tests {
+		var info hue.BridgeInfo
+		info.Device.ModelNumber = test.number
+		info.Device.ModelName = test.name
+		if got := bridgeGeneration(info); got != test.want {
+			t.Errorf("bridgeGeneration(%q, %q) = %d, want %d",
+				test.number, test.name, got, test.want)
+		}
+	}
+}
+
+func TestV1BridgeRejectsPowerOnBehavior(t *testing.T) {
+	f := newFakeBridge(t)
+	f.model = "BSB001"
+	f.addLight("1", "Desk", "Extended color light")
+
+	_, client, _ := startBridge(t, f, nil)
+
+	f.m.Lock()
+	f.requests = nil
+	f.m.Unlock()
+
+	client.send(testPath+"/Light/Desk/PowerOnBehavior/Set", "powerfail")
+	got := client.waitFor(t, testPath+"/Light/Desk/PowerOnBehavior/Error")
+	if !strings.Contains(got, "v2") {
+		t.Errorf("PowerOnBehavior/Error = %q, want a v2 bridge error", got)
+	}
+	if f.count("PUT", "/api/test/lights/1/config") != 0 {
+		t.Error("PowerOnBehavior was sent to a v1 bridge")
+	}
+}
+
+func TestDiscoveryComplete(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	f.addLight("2", "Hall", "Dimmable light")
+	f.addGroup("1", "Office", "1", "2")
+	f.addSensor("1", "Porch", "ZLLPresence", 80)
+
+	b, client, _ := startBridge(t, f, nil)
+
+	var complete struct {
+		Time    string `json:"time"`
+		Devices int    `json:"devices"`
+	}
+	err := json.Unmarshal([]byte(client.waitFor(t, testPath+"/DiscoveryComplete")), &complete)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if complete.Devices != 4 || complete.Time == "" {
+		t.Errorf("DiscoveryComplete = %+v, want 4 devices and a time", complete)
+	}
+	assertPublishedLast(t, client, testPath+"/DiscoveryComplete", []string{
+		testPath + "/Light/Desk/", testPath + "/Light/Hall/",
+		testPath + "/Group/Office/", testPath + "/Sensor/Porch/",
+	})
+
+	client.reset()
+	err = b.reconnectBridge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertPublishedLast(t, client, testPath+"/DiscoveryComplete", []string{
+		testPath + "/Light/Desk/", testPath + "/Light/Hall/", testPath + "/Group/Office/",
+	})
+}
+
+// Fails the test unless the last message published went to topic and the
+// topics under each of the prefixes were published before it
+func assertPublishedLast(t *testing.T, client *fakeClient, topic string, prefixes []string) {
+	t.Helper()
+
+	client.m.Lock()
+	published := append([]casa.Message(nil), client.published...)
+	client.m.Unlock()
+
+	if len(published) == 0 || published[len(published)-1].Topic != topic {
+		t.Fatalf("%s wasn't the last of %d messages published", topic, len(published))
+	}
+	for _, prefix := range prefixes {
+		found := false
+		for _, msg := range published[:len(published)-1] {
+			if strings.HasPrefix(msg.Topic, prefix) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("Nothing under %s was published before %s", prefix, topic)
+		}
+	}
+}
+
+func TestStartRejectsUnauthorizedUser(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+
+	_, _, _, err := tryStartBridge(t, f, map[string]interface{}{"User": "stranger"})
+	if err == nil {
+		t.Fatal("Start succeeded with a user the bridge doesn't know")
+	}
+	if f.count("GET", "/api/stranger/lights") != 0 {
+		t.Error("Lights were enumerated before the user was validated")
+	}
+}
+
+func TestHandlerWithoutClient(t *testing.T) {
+	b := &Bridge{}
+	logger := &testLogger{}
+	b.UseLogger(logger)
+
+	b.handler(&casa.Message{Topic: testPath + "/Light/Desk/On/Set", Payload: []byte("true")}, nil)
+	if !logger.contains(ErrNotConnected.Error()) {
+		t.Error("Message handled without a client wasn't logged as dropped")
+	}
+}
+
+func TestPublishWithoutClient(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	stopped, _, _ := startBridge(t, f, nil)
+	err := stopped.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unstarted := &Bridge{}
+	unstarted.UseLogger(&testLogger{})
+
+	mb := &Multibridge{aliases: map[string][]aliasMember{
+		"downstairs": {{Bridge: "Upstairs", Light: "Desk"}},
+	}}
+	mb.UseLogger(&testLogger{})
+
+	for name, b := range map[string]*Bridge{"stopped": stopped, "unstarted": unstarted} {
+		calls := map[string]func() error{
+			"AllOn": func() error {
+				_, err := b.AllOn()
+				return err
+			},
+			"AllOff": func() error {
+				_, err := b.AllOff()
+				return err
+			},
+			"publishStatus":            func() error { return b.publishStatus("online") },
+			"publishDiscoveryComplete": b.publishDiscoveryComplete,
+			"republish":                b.republish,
+		}
+		if light := b.lights["1"]; light != nil {
+			calls["Light.publish"] = func() error { return light.publish("On", "true") }
+		}
+
+		for call, fn := range calls {
+			if err := fn(); err != ErrNotConnected {
+				t.Errorf("%s bridge: %s returned %v, want ErrNotConnected", name, call, err)
+			}
+		}
+	}
+
+	if _, err := mb.SetAlias("Downstairs", "On", "true"); err != ErrNotConnected {
+		t.Errorf("SetAlias without a client returned %v, want ErrNotConnected", err)
+	}
+	if _, err := unstarted.SnapshotState(); err != nil {
+		t.Errorf("SnapshotState of an unstarted bridge returned %v", err)
+	}
+}
+
+func TestStopResetsMetrics(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	b, client, _ := startBridge(t, f, map[string]interface{}{"MetricsPort": freePort(t)})
+
+	client.send(testPath+"/Light/Desk/On/Set", "true")
+	b.metrics.m.Lock()
+	in := b.metrics.messages["in"]
+	b.metrics.m.Unlock()
+	if in != 1 {
+		t.Errorf("Counted %d messages in, want 1", in)
+	}
+
+	err := b.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.metrics != nil {
+		t.Error("Stop kept the metrics counted while running")
+	}
+}
+
+// Returns a TCP port nothing is listening on
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestStopWhileHandlingCommands(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	b, client, _ := startBridge(t, f, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				client.send(testPath+"/Light/Desk/Brightness/Set", "50")
+			}
+		}()
+	}
+
+	err := b.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	client.m.Lock()
+	unsubscribed := client.unsubscribed
+	client.m.Unlock()
+	if !reflect.DeepEqual(unsubscribed, []string{"Service/Hue/#"}) {
+		t.Errorf("Unsubscribed from %v before draining, want the command topics", unsubscribed)
+	}
+
+	// Commands delivered after Stop are dropped
+	f.m.Lock()
+	f.requests = nil
+	f.m.Unlock()
+	client.send(testPath+"/Light/Desk/Brightness/Set", "60")
+	if n := f.count("PUT", "/api/test/lights/1/state"); n != 0 {
+		t.Errorf("A command after Stop sent %d states", n)
+	}
+}
+
+func TestValidateRejectsQoS(t *testing.T) {
+	if err := ValidateConfig(testConfig(nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"MQTTPublishQoS", "MQTTSubscribeQoS"} {
+		err := ValidateConfig(testConfig(map[string]interface{}{key: 1}))
+		e, ok := err.(*ConfigError)
+		if !ok || e.Fields[key] == "" {
+			t.Errorf("ValidateConfig accepted %s until QoS can be passed on: %v", key, err)
+		}
+	}
+}
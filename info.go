@@ -0,0 +1,86 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/casaplatform/casa"
+)
+
+// The bridge details reported by the bridge configuration API
+type bridgeConfig struct {
+	APIVersion      string `json:"apiversion"`
+	FirmwareVersion string `json:"swversion"`
+	MAC             string `json:"mac"`
+	BridgeID        string `json:"bridgeid"`
+	ZigbeeChannel   int    `json:"zigbeechannel"`
+}
+
+// Publishes what is known about the bridge to retained Info/{Field} topics:
+// the model, generation and serial number from the bridge description, and
+// the API and firmware versions, MAC address, bridge ID and Zigbee channel from
+// its configuration.
+func (b *Bridge) publishInfo() error {
+	info := map[string]string{}
+
+	device := b.hueBridge().Info.Device
+	if device.ModelName == "" {
+		b.Log("Warning: Hue bridge description is missing, not publishing its model")
+	} else {
+		info["Model"] = device.ModelName
+		info["ModelNumber"] = device.ModelNumber
+		info["SerialNumber"] = device.SerialNumber
+		info["Generation"] = "v" + strconv.Itoa(bridgeGeneration(b.hueBridge().Info))
+	}
+
+	var body []byte
+	err := b.guard(func() (err error) {
+		body, _, err = b.hueBridge().Get("/api/" + b.User + "/config")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	var config bridgeConfig
+	err = json.Unmarshal(body, &config)
+	if err != nil {
+		return err
+	}
+
+	if config.APIVersion == "" {
+		b.Log("Warning: Hue bridge configuration is missing, not publishing its versions")
+	} else {
+		info["APIVersion"] = config.APIVersion
+		info["FirmwareVersion"] = config.FirmwareVersion
+		info["MAC"] = config.MAC
+		info["BridgeID"] = config.BridgeID
+		info["ZigbeeChannel"] = strconv.Itoa(config.ZigbeeChannel)
+	}
+
+	for field, value := range info {
+		err := b.publish(casa.Message{
+			Topic:   b.path + "/Info/" + field,
+			Payload: []byte(value),
+			Retain:  true,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
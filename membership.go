@@ -0,0 +1,77 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/inhies/GoHue"
+)
+
+// Records the names of the groups each light belongs to. b.m must be held.
+func (b *Bridge) setMemberships(groups []hue.Group) {
+	names := make(map[string][]string)
+	for _, group := range groups {
+		for _, id := range group.Lights {
+			names[id] = append(names[id], group.Name)
+		}
+	}
+
+	for id, light := range b.lights {
+		sort.Strings(names[id])
+
+		light.m.Lock()
+		light.memberOf = names[id]
+		light.m.Unlock()
+	}
+}
+
+// Reads the groups from the bridge and publishes the Groups endpoint of each
+// light whose membership changed
+func (b *Bridge) refreshMemberships() error {
+	var groups []hue.Group
+	err := b.guard(func() (err error) {
+		groups, err = b.hueBridge().GetAllGroups()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	b.m.RLock()
+	defer b.m.RUnlock()
+
+	b.setMemberships(groups)
+	for _, light := range b.lights {
+		err := light.publishState("Groups")
+		if err != nil {
+			b.Log(err)
+		}
+	}
+	return nil
+}
+
+// Returns the names of the groups the light belongs to, separated by commas,
+// or None
+func (l *Light) membershipState() string {
+	l.m.RLock()
+	defer l.m.RUnlock()
+
+	if len(l.memberOf) == 0 {
+		return "None"
+	}
+	return strings.Join(l.memberOf, ",")
+}
@@ -0,0 +1,239 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds of the buckets of hue_bridge_api_duration_seconds, in seconds
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Counts of the calls and messages handled by a bridge, exposed in the
+// Prometheus text format when MetricsPort is set. A nil *metrics counts
+// nothing.
+type metrics struct {
+	m sync.Mutex
+
+	// Calls by light, endpoint and status
+	calls map[[3]string]uint64
+
+	// Call durations by light and endpoint
+	durations map[[2]string]*histogram
+
+	// MQTT messages by direction, in or out
+	messages map[string]uint64
+}
+
+// A cumulative histogram of durations in seconds
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		calls:     make(map[[3]string]uint64),
+		durations: make(map[[2]string]*histogram),
+		messages:  make(map[string]uint64),
+	}
+}
+
+// Counts a command to the endpoint of a light that took d and failed with
+// err, if it failed
+func (m *metrics) observeCall(light, endpoint string, err error, d time.Duration) {
+	if m == nil {
+		return
+	}
+
+	status := "success"
+	if err != nil {
+		status = "error"
+	}
+
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	m.calls[[3]string{light, endpoint, status}]++
+
+	h := m.durations[[2]string{light, endpoint}]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(durationBuckets))}
+		m.durations[[2]string{light, endpoint}] = h
+	}
+	seconds := d.Seconds()
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// Counts an MQTT message sent or received
+func (m *metrics) countMessage(direction string) {
+	if m == nil {
+		return
+	}
+
+	m.m.Lock()
+	m.messages[direction]++
+	m.m.Unlock()
+}
+
+// Starts serving the bridge's metrics at /metrics on MetricsPort
+func (b *Bridge) startMetrics(port int) error {
+	b.metrics = newMetrics()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", b.serveMetrics)
+
+	srv, err := b.listen(port, mux)
+	if err != nil {
+		return err
+	}
+	b.metricsServer = srv
+	return nil
+}
+
+// Writes the bridge's metrics in the Prometheus text format
+func (b *Bridge) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	m := b.metrics
+	m.m.Lock()
+
+	fmt.Fprintln(w, "# HELP hue_bridge_api_calls_total Commands sent to light endpoints.")
+	fmt.Fprintln(w, "# TYPE hue_bridge_api_calls_total counter")
+	calls := make([][3]string, 0, len(m.calls))
+	for key := range m.calls {
+		calls = append(calls, key)
+	}
+	sort.Slice(calls, func(i, j int) bool {
+		return strings.Join(calls[i][:], "\x00") < strings.Join(calls[j][:], "\x00")
+	})
+	for _, key := range calls {
+		fmt.Fprintf(w, "hue_bridge_api_calls_total{%s} %d\n",
+			labels("light", key[0], "endpoint", key[1], "status", key[2]), m.calls[key])
+	}
+
+	fmt.Fprintln(w, "# HELP hue_bridge_api_duration_seconds Time taken by commands to light endpoints.")
+	fmt.Fprintln(w, "# TYPE hue_bridge_api_duration_seconds histogram")
+	durations := make([][2]string, 0, len(m.durations))
+	for key := range m.durations {
+		durations = append(durations, key)
+	}
+	sort.Slice(durations, func(i, j int) bool {
+		return durations[i][0]+"\x00"+durations[i][1] < durations[j][0]+"\x00"+durations[j][1]
+	})
+	for _, key := range durations {
+		h := m.durations[key]
+		for i, bound := range durationBuckets {
+			fmt.Fprintf(w, "hue_bridge_api_duration_seconds_bucket{%s} %d\n",
+				labels("light", key[0], "endpoint", key[1],
+					"le", strconv.FormatFloat(bound, 'g', -1, 64)), h.counts[i])
+		}
+		fmt.Fprintf(w, "hue_bridge_api_duration_seconds_bucket{%s} %d\n",
+			labels("light", key[0], "endpoint", key[1], "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "hue_bridge_api_duration_seconds_sum{%s} %g\n",
+			labels("light", key[0], "endpoint", key[1]), h.sum)
+		fmt.Fprintf(w, "hue_bridge_api_duration_seconds_count{%s} %d\n",
+			labels("light", key[0], "endpoint", key[1]), h.count)
+	}
+
+	fmt.Fprintln(w, "# HELP hue_mqtt_messages_processed_total MQTT messages received and sent.")
+	fmt.Fprintln(w, "# TYPE hue_mqtt_messages_processed_total counter")
+	for _, direction := range []string{"in", "out"} {
+		fmt.Fprintf(w, "hue_mqtt_messages_processed_total{%s} %d\n",
+			labels("direction", direction), m.messages[direction])
+	}
+	m.m.Unlock()
+
+	b.m.RLock()
+	reachable := 0
+	for _, light := range b.lights {
+		if light.current().State.Reachable {
+			reachable++
+		}
+	}
+	b.m.RUnlock()
+
+	fmt.Fprintln(w, "# HELP hue_lights_reachable Lights the bridge can reach.")
+	fmt.Fprintln(w, "# TYPE hue_lights_reachable gauge")
+	fmt.Fprintf(w, "hue_lights_reachable %d\n", reachable)
+
+	online := 0
+	if b.currentStatus() == "online" {
+		online = 1
+	}
+	fmt.Fprintln(w, "# HELP hue_bridge_status Whether the bridge is online.")
+	fmt.Fprintln(w, "# TYPE hue_bridge_status gauge")
+	fmt.Fprintf(w, "hue_bridge_status{%s} %d\n", labels("bridge", b.path), online)
+}
+
+// Formats pairs of label names and values, escaping the values
+func labels(pairs ...string) string {
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, pairs[i]+`="`+escape.Replace(pairs[i+1])+`"`)
+	}
+	return strings.Join(parts, ",")
+}
+
+// Serves handler over HTTP on port until the returned server is shut down. An
+// error is returned if the port can't be listened on.
+func (b *Bridge) listen(port int, handler http.Handler) (*http.Server, error) {
+	ln, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &http.Server{Handler: handler}
+	go func() {
+		err := srv.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			b.Log("Hue HTTP server on port "+strconv.Itoa(port)+" stopped:", err)
+		}
+	}()
+	return srv, nil
+}
+
+// Shuts down a server started by listen, waiting up to stopTimeout for
+// requests in progress
+func (b *Bridge) shutdown(srv *http.Server) {
+	if srv == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		b.Log(err)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/viper"
+)
+
+// Topic layout used when PathTemplate isn't configured
+const defaultPathTemplate = "{{.Namespace}}/{{.BridgeName}}/{{.DevType}}/{{.DevName}}/{{.Endpoint}}"
+
+// Parses the PathTemplate setting from config. The template is given the
+// Namespace, which is the topic prefix shared by every bridge such as
+// "Service/Hue", and the BridgeName, DevType, DevName and Endpoint of a topic.
+// It must start with the Namespace, so the topics are subscribed to, and end
+// with the Endpoint.
+func parsePathTemplate(config *viper.Viper, namespace string) (*template.Template, error) {
+	text := defaultPathTemplate
+	if config.IsSet("PathTemplate") {
+		text = config.GetString("PathTemplate")
+	}
+
+	if !strings.HasSuffix(text, "/{{.Endpoint}}") {
+		return nil, errors.New("PathTemplate must end with /{{.Endpoint}}")
+	}
+
+	tmpl, err := template.New("PathTemplate").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, errors.New("Invalid PathTemplate: " + err.Error())
+	}
+
+	// Try it out so unknown variables fail now rather than on first use
+	sample, err := executePath(tmpl, map[string]string{
+		"Namespace":  namespace,
+		"BridgeName": "Bridge",
+		"DevType":    "Light",
+		"DevName":    "Light",
+		"Endpoint":   "On",
+	})
+	if err != nil {
+		return nil, errors.New("Invalid PathTemplate: " + err.Error())
+	}
+	if !strings.HasPrefix(sample, namespace+"/") {
+		return nil, errors.New("PathTemplate must start with {{.Namespace}}")
+	}
+	return tmpl, nil
+}
+
+// Executes the path template with data
+func executePath(tmpl *template.Template, data map[string]string) (string, error) {
+	var path bytes.Buffer
+	err := tmpl.Execute(&path, data)
+	return path.String(), err
+}
+
+// Returns the topic path of the named device of the class, such as a Light,
+// Plug, Group or Sensor, which its endpoint topics are published under.
+func (b *Bridge) lightPath(class, name string) string {
+	path, err := executePath(b.pathTemplate, map[string]string{
+		"Namespace":  b.root,
+		"BridgeName": strings.TrimPrefix(b.path, b.root+"/"),
+		"DevType":    class,
+		"DevName":    sanitizeTopic(name),
+		"Endpoint":   "",
+	})
+	if err != nil {
+		// The template was tried out by parsePathTemplate, so this can't
+		// happen, but fall back to the default layout just in case
+		return b.path + "/" + class + "/" + sanitizeTopic(name)
+	}
+	return strings.TrimSuffix(path, "/")
+}
@@ -0,0 +1,133 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/inhies/GoHue"
+	"github.com/spf13/viper"
+)
+
+// Default time between polls of the bridge
+const defaultPollInterval = 30 * time.Second
+
+// Returns the PollIntervalSeconds setting from config
+func pollInterval(config *viper.Viper) time.Duration {
+	seconds := config.GetInt("PollIntervalSeconds")
+	if seconds <= 0 {
+		return defaultPollInterval
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Polls the bridge until ctx is done, so that changes made outside of
+// Casa, such as from the Hue app, are published.
+func (b *Bridge) poll(ctx context.Context) {
+	for {
+		b.m.RLock()
+		interval := b.pollEvery
+		b.m.RUnlock()
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-b.repoll:
+			// Reload changed the interval, which applies from now
+			timer.Stop()
+			continue
+		case <-timer.C:
+		}
+
+		err := b.refresh()
+		if err != nil {
+			b.Log("Unable to poll Hue bridge:", err)
+		}
+
+		err = b.refreshSensors()
+		if err != nil {
+			b.Log("Unable to poll Hue sensors:", err)
+		}
+
+		err = b.refreshMemberships()
+		if err != nil {
+			b.Log("Unable to poll Hue groups:", err)
+		}
+
+		err = b.refreshSchedules()
+		if err != nil {
+			b.Log("Unable to poll Hue schedules:", err)
+		}
+	}
+}
+
+// Reads the state of every light from the bridge and publishes the endpoint
+// values that changed.
+func (b *Bridge) refresh() error {
+	var lights []hue.Light
+	err := b.guard(func() (err error) {
+		lights, err = b.hueBridge().GetAllLights()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	b.m.RLock()
+	defer b.m.RUnlock()
+
+	for i := range lights {
+		light := b.lights[strconv.Itoa(lights[i].Index)]
+		if light == nil {
+			continue
+		}
+
+		err := light.update(&lights[i])
+		if err != nil {
+			b.Log(err)
+		}
+	}
+	return nil
+}
+
+// Replaces the light's state with fresh and publishes the endpoint values that
+// changed. Lights that stop being reachable are logged, and those that become
+// reachable again announce it on Recovered.
+func (l *Light) update(fresh *hue.Light) error {
+	var lost, found bool
+	l.changeState(func(cur *hue.Light) {
+		lost = cur.State.Reachable && !fresh.State.Reachable
+		found = !cur.State.Reachable && fresh.State.Reachable
+		cur.State = fresh.State
+	})
+	if lost {
+		l.bridge.Log("Warning: Hue light is no longer reachable:", l.Light.Name)
+	}
+
+	err := l.publishChanged()
+	if err != nil || !found {
+		return err
+	}
+	return l.recovered()
+}
+
+// Publishes the endpoints whose value differs from the last one published
+func (l *Light) publishChanged() error {
+	return l.publishState(l.pointNames()...)
+}
@@ -0,0 +1,74 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"errors"
+	"strconv"
+)
+
+// The startup modes a light can use when it regains power
+var powerOnModes = map[string]bool{
+	"safety":      true,
+	"powerfail":   true,
+	"lastonstate": true,
+	"custom":      true,
+}
+
+// The body of a light config request setting the startup mode
+type startupConfig struct {
+	Startup struct {
+		Mode       string `json:"mode"`
+		Configured bool   `json:"configured"`
+	} `json:"startup"`
+}
+
+// Sets the startup mode of the light on the bridge and publishes it
+func (l *Light) setPowerOn(mode string) error {
+	if !powerOnModes[mode] {
+		return errors.New("Invalid power on behavior " + strconv.Quote(mode) +
+			"; valid modes are: safety, powerfail, lastonstate, custom")
+	}
+
+	err := l.bridge.requireV2("PowerOnBehavior")
+	if err != nil {
+		return err
+	}
+
+	var config startupConfig
+	config.Startup.Mode = mode
+	config.Startup.Configured = true
+
+	var body []byte
+	err = l.bridge.call(func() (err error) {
+		body, _, err = l.bridge.hueBridge().Put("/api/"+l.bridge.User+"/lights/"+
+			strconv.Itoa(l.Light.Index)+"/config", config)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = apiError(body)
+	if err != nil {
+		return err
+	}
+
+	l.m.Lock()
+	l.powerOn = mode
+	l.m.Unlock()
+
+	return l.publish("PowerOnBehavior", mode)
+}
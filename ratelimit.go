@@ -0,0 +1,137 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Default number of state changes sent to the bridge per second. The bridge
+// silently drops commands beyond roughly 10 per second.
+const defaultMaxBridgeRPS = 10
+
+// Returns the MaxBridgeRPS setting from config
+func maxBridgeRPS(config *viper.Viper) int {
+	rps := config.GetInt("MaxBridgeRPS")
+	if rps <= 0 {
+		return defaultMaxBridgeRPS
+	}
+	return rps
+}
+
+// A token bucket shared by every light on a bridge. It holds up to rate
+// tokens and refills at rate tokens per second. Bulk operations can be
+// granted a burst of extra tokens on top, see grantBurst.
+type limiter struct {
+	m      sync.Mutex
+	rate   float64
+	tokens float64
+	burst  float64
+	last   time.Time
+}
+
+// Creates a limiter allowing rps requests per second, starting full
+func newLimiter(rps int) *limiter {
+	return &limiter{
+		rate:   float64(rps),
+		tokens: float64(rps),
+		last:   time.Now(),
+	}
+}
+
+// Changes the number of requests allowed per second
+func (r *limiter) setRate(rps int) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.refill(time.Now())
+	r.rate = float64(rps)
+	if r.tokens > r.rate {
+		r.tokens = r.rate
+	}
+	if r.burst > r.rate {
+		r.burst = r.rate
+	}
+}
+
+// Adds the tokens earned since the last refill and decays the burst. The
+// caller must hold r.m.
+func (r *limiter) refill(now time.Time) {
+	elapsed := now.Sub(r.last).Seconds()
+	r.tokens += elapsed * r.rate
+	if r.tokens > r.rate {
+		r.tokens = r.rate
+	}
+	r.burst -= elapsed * r.rate
+	if r.burst < 0 {
+		r.burst = 0
+	}
+	r.last = now
+}
+
+// Grants n extra tokens that only WaitBulk spends, once the regular tokens
+// run out, so that an operation on many lights can briefly exceed the steady
+// rate. The burst is capped at one second's worth of tokens, keeping it
+// within what the bridge tolerates, and decays at rate tokens per second.
+func (r *limiter) grantBurst(n int) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.refill(time.Now())
+	r.burst += float64(n)
+	if r.burst > r.rate {
+		r.burst = r.rate
+	}
+}
+
+// Wait blocks until a request may be sent or ctx is done
+func (r *limiter) Wait(ctx context.Context) error {
+	return r.wait(ctx, false)
+}
+
+// WaitBulk blocks as Wait does, but may spend the burst granted by grantBurst
+func (r *limiter) WaitBulk(ctx context.Context) error {
+	return r.wait(ctx, true)
+}
+
+// Waits for a regular token, or one from the burst if bulk is set
+func (r *limiter) wait(ctx context.Context, bulk bool) error {
+	for {
+		r.m.Lock()
+		r.refill(time.Now())
+		if r.tokens >= 1 {
+			r.tokens--
+			r.m.Unlock()
+			return nil
+		}
+		if bulk && r.burst >= 1 {
+			r.burst--
+			r.m.Unlock()
+			return nil
+		}
+		wait := time.Duration((1 - r.tokens) / r.rate * float64(time.Second))
+		r.m.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
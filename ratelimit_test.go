@@ -0,0 +1,133 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Returns the number of calls to wait that return within d
+func countWaits(wait func(ctx context.Context) error, d time.Duration) int {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+
+	n := 0
+	for wait(ctx) == nil {
+		n++
+	}
+	return n
+}
+
+func TestLimiter(t *testing.T) {
+	r := newLimiter(50)
+	ctx := context.Background()
+
+	// The bucket starts full, then refills at the rate
+	start := time.Now()
+	for i := 0; i < 60; i++ {
+		err := r.Wait(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("60 requests at 50 per second took %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	r.setRate(1)
+	r.Wait(context.Background())
+	if err := r.Wait(ctx); err != context.Canceled {
+		t.Errorf("Wait with a cancelled context returned %v", err)
+	}
+}
+
+func TestLimiterBurst(t *testing.T) {
+	r := newLimiter(50)
+	r.grantBurst(500)
+
+	// The burst is capped at a second's worth of tokens, which decays a
+	// little while they are spent
+	if n := countWaits(r.WaitBulk, 10*time.Millisecond); n < 98 || n > 101 {
+		t.Errorf("Bulk operation got %d requests through at once, want 50 plus the burst of 50", n)
+	}
+}
+
+func TestLimiterBurstOnlyForBulk(t *testing.T) {
+	r := newLimiter(50)
+	r.grantBurst(50)
+
+	if n := countWaits(r.Wait, 10*time.Millisecond); n != 50 {
+		t.Errorf("Regular requests got %d through at once, want 50", n)
+	}
+	if n := countWaits(r.WaitBulk, 10*time.Millisecond); n < 45 {
+		t.Errorf("Regular requests spent the burst, %d left for bulk ones", n)
+	}
+}
+
+func TestLimiterBurstDecays(t *testing.T) {
+	r := newLimiter(10)
+	r.grantBurst(10)
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.refill(r.last.Add(500 * time.Millisecond))
+	if math.Abs(r.burst-5) > 1e-9 {
+		t.Errorf("Burst = %v after half a second, want 5", r.burst)
+	}
+	r.refill(r.last.Add(600 * time.Millisecond))
+	if r.burst != 0 {
+		t.Errorf("Burst = %v after over a second, want 0", r.burst)
+	}
+}
+
+func TestBulkCommandUsesBurst(t *testing.T) {
+	const rate, lights = 10, 20
+
+	f := newFakeBridge(t)
+	for i := 1; i <= lights; i++ {
+		id := strconv.Itoa(i)
+		f.addLight(id, "Light "+id, "Extended color light")
+	}
+	b, client, _ := startBridge(t, f, map[string]interface{}{"MaxBridgeRPS": rate})
+
+	// Serially, the last 10 commands would wait 100ms each for a token
+	start := time.Now()
+	result, err := b.AllOn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("AllOn on %d lights took %v, no faster than serial commands", lights, elapsed)
+	}
+	if len(result.Succeeded) != lights {
+		t.Errorf("AllOn result = %+v", result)
+	}
+
+	// Commands after it are still limited to the steady rate
+	start = time.Now()
+	for i := 0; i < 4; i++ {
+		client.send(testPath+"/Light/Light_1/Brightness/Set", strconv.Itoa(10+i))
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("4 commands after AllOn took %v, beyond the rate of %d per second", elapsed, rate)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/inhies/GoHue"
+	"github.com/pkg/errors"
+)
+
+// Consecutive network failures after which the bridge is reconnected
+const reconnectAfterFailures = 3
+
+// Delays between reconnection attempts
+const (
+	reconnectBaseDelay = time.Second
+	reconnectMaxDelay  = 5 * time.Minute
+)
+
+// Returns the bridge API client. It is replaced when the bridge reconnects.
+func (b *Bridge) hueBridge() *hue.Bridge {
+	b.bm.RLock()
+	defer b.bm.RUnlock()
+	return b.bridge
+}
+
+// Counts consecutive network failures of bridge calls, asking the reconnect
+// loop to reconnect once there are enough of them. Any answer from the bridge,
+// even an error, resets the count.
+func (b *Bridge) trackConnection(err error) {
+	_, network := errors.Cause(err).(net.Error)
+
+	b.bm.Lock()
+	defer b.bm.Unlock()
+
+	if !network {
+		b.netFailures = 0
+		return
+	}
+
+	b.netFailures++
+	if b.netFailures < reconnectAfterFailures {
+		return
+	}
+
+	select {
+	case b.reconnect <- struct{}{}:
+	default:
+	}
+}
+
+// Reconnects to the bridge whenever trackConnection asks, retrying with
+// exponential backoff, until ctx is done.
+func (b *Bridge) reconnectLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-b.reconnect:
+		}
+
+		delay := reconnectBaseDelay
+		for {
+			err := b.reconnectBridge()
+			if err == nil {
+				b.Log("Reconnected to Hue bridge at " + b.IP)
+				break
+			}
+			b.Log("Unable to reconnect to Hue bridge, retrying in "+delay.String()+":", err)
+
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			delay *= 2
+			if delay > reconnectMaxDelay {
+				delay = reconnectMaxDelay
+			}
+		}
+	}
+}
+
+// Logs in to the bridge again, swaps in the new API client, republishes the
+// state of every light and group and signals DiscoveryComplete again.
+func (b *Bridge) reconnectBridge() error {
+	bridge, err := hue.NewBridge(b.IP)
+	if err != nil {
+		return err
+	}
+
+	err = bridge.Login(b.User)
+	if err != nil {
+		return err
+	}
+
+	lights, err := bridge.GetAllLights()
+	if err != nil {
+		return err
+	}
+
+	b.m.Lock()
+	b.bm.Lock()
+	b.bridge = bridge
+	b.netFailures = 0
+	b.bm.Unlock()
+
+	for i := range lights {
+		light := b.lights[strconv.Itoa(lights[i].Index)]
+		if light == nil {
+			continue
+		}
+		fresh := lights[i].State
+		light.changeState(func(cur *hue.Light) {
+			cur.Bridge = bridge
+			cur.State = fresh
+		})
+	}
+	b.m.Unlock()
+	b.invalidateScenes()
+
+	err = b.publishAllState()
+	if err != nil {
+		return err
+	}
+	return b.publishDiscoveryComplete()
+}
+
+// Publishes the state of every light and group, including values that were
+// published before, as a reconnect may follow missed changes and retained
+// messages the broker lost
+func (b *Bridge) publishAllState() error {
+	b.m.RLock()
+	defer b.m.RUnlock()
+
+	for _, light := range b.lights {
+		light.forgetPublished()
+		err := light.publishState(light.pointNames()...)
+		if err != nil {
+			return err
+		}
+	}
+	for _, group := range b.groups {
+		group.forgetPublished()
+		err := group.publishState(group.pointNames()...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"time"
+
+	"github.com/casaplatform/casa"
+	"github.com/inhies/GoHue"
+)
+
+// Merges the absolute values of a state accepted by the bridge into the
+// state commanded so far. Alerts and increments are one-off changes, so they
+// aren't re-applied.
+func (l *Light) recordCommand(state hue.LightState) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	c := &l.commanded
+	on := state.On
+	c.On = &on
+	if state.Bri != 0 {
+		bri := state.Bri
+		c.Bri = &bri
+	}
+
+	// Only the last color mode commanded is kept
+	switch {
+	case state.XY != nil:
+		xy := *state.XY
+		c.XY, c.Hue, c.Sat, c.CT = &xy, nil, nil, nil
+	case state.CT != 0:
+		ct := state.CT
+		c.CT, c.Hue, c.Sat, c.XY = &ct, nil, nil, nil
+	case state.Hue != 0 || state.Sat != 0:
+		c.XY, c.CT = nil, nil
+		if state.Hue != 0 {
+			h := state.Hue
+			c.Hue = &h
+		}
+		if state.Sat != 0 {
+			sat := state.Sat
+			c.Sat = &sat
+		}
+	}
+	if state.Effect != "" {
+		effect := effectName(state.Effect)
+		c.Effect = &effect
+	}
+}
+
+// Publishes the non-retained Recovered event of a light the bridge can reach
+// again, such as once its power is restored, and re-applies the state last
+// commanded to it if ReapplyOnRecovery is set. b.m must be held for reading.
+func (l *Light) recovered() error {
+	l.bridge.Log("Hue light is reachable again:", l.Light.Name)
+
+	err := l.bridge.publish(casa.Message{
+		Topic:   l.Path + "/Recovered",
+		Payload: []byte(time.Now().Format(time.RFC3339)),
+	})
+	if err != nil || !l.bridge.reapplyOnRecovery {
+		return err
+	}
+
+	l.m.RLock()
+	commanded := l.commanded
+	l.m.RUnlock()
+
+	if commanded.On == nil {
+		return nil
+	}
+	return l.applyState(commanded)
+}
@@ -0,0 +1,110 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/inhies/GoHue"
+)
+
+func TestRecovered(t *testing.T) {
+	tests := []struct {
+		reapply bool
+		bri     float64
+	}{
+		{false, 254},
+		{true, 101},
+	}
+
+	for _, test := range tests {
+		f := newFakeBridge(t)
+		f.addLight("1", "Desk", "Extended color light")
+		b, client, _ := startBridge(t, f, map[string]interface{}{"ReapplyOnRecovery": test.reapply})
+
+		client.send(deskTopic("Color Temp")+"/Set", "250")
+		client.send(deskTopic("Brightness")+"/Set", "40")
+
+		// The light loses power, then comes back in its power on state
+		f.setState("1", map[string]interface{}{"reachable": false})
+		err := b.refresh()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := client.last(deskTopic("Recovered")); ok {
+			t.Fatal("Recovered published while the light is unreachable")
+		}
+
+		f.setState("1", map[string]interface{}{"reachable": true, "on": true,
+			"bri": float64(254), "ct": float64(366)})
+		err = b.refresh()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var retained bool
+		client.m.Lock()
+		for _, msg := range client.published {
+			if msg.Topic == deskTopic("Recovered") {
+				retained = msg.Retain
+				_, err = time.Parse(time.RFC3339, string(msg.Payload))
+			}
+		}
+		client.m.Unlock()
+		if err != nil || retained {
+			t.Errorf("ReapplyOnRecovery=%v: Recovered isn't a non-retained time: %v",
+				test.reapply, err)
+		}
+		if got, _ := client.last(deskTopic("Reachable")); got != "true" {
+			t.Errorf("ReapplyOnRecovery=%v: Reachable = %q", test.reapply, got)
+		}
+
+		state := f.state("1")
+		wantCT := map[bool]float64{false: 366, true: 250}[test.reapply]
+		if state["bri"] != test.bri || state["ct"] != wantCT {
+			t.Errorf("ReapplyOnRecovery=%v: recovered light at bri %v ct %v, want %v %v",
+				test.reapply, state["bri"], state["ct"], test.bri, wantCT)
+		}
+
+		// Polls while the light stays reachable are no recovery
+		client.reset()
+		err = b.refresh()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := client.last(deskTopic("Recovered")); ok {
+			t.Errorf("ReapplyOnRecovery=%v: Recovered published again", test.reapply)
+		}
+	}
+}
+
+func TestRecordCommandKeepsLastColorMode(t *testing.T) {
+	l := &Light{}
+	xy := [2]float32{0.3, 0.3}
+
+	l.recordCommand(hue.LightState{CT: 250, On: true, Bri: 100})
+	l.recordCommand(hue.LightState{XY: &xy, On: true})
+
+	c := l.commanded
+	if c.CT != nil || c.XY == nil || *c.XY != xy || c.Bri == nil || *c.Bri != 100 {
+		t.Errorf("Commanded state = %+v, want the xy color at brightness 100", c)
+	}
+
+	l.recordCommand(hue.LightState{On: false})
+	if c := l.commanded; c.On == nil || *c.On || c.XY == nil {
+		t.Errorf("Commanded state = %+v, want the xy color switched off", c)
+	}
+}
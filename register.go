@@ -0,0 +1,152 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/casaplatform/casa"
+	"github.com/inhies/GoHue"
+)
+
+// How often and how many times a user is requested from a bridge while
+// waiting for its link button to be pressed
+const (
+	registerInterval = 5 * time.Second
+	registerAttempts = 12
+)
+
+// Runs a registration command sent to Register/{BridgeIP}/Set, which starts
+// registering a user on the bridge, or Register/{BridgeIP}/Cancel/Set, which
+// stops it. Returns false if the topic isn't a registration command.
+func (b *Bridge) registerCommand(topic string) bool {
+	prefix := b.root + "/Register/"
+	if !strings.HasPrefix(topic, prefix) {
+		return false
+	}
+
+	m := strings.Split(strings.TrimPrefix(topic, prefix), "/")
+	switch {
+	case len(m) == 2 && m[1] == "Set":
+		b.startRegistration(m[0])
+	case len(m) == 3 && m[1] == "Cancel" && m[2] == "Set":
+		b.cancelRegistration(m[0])
+	default:
+		return false
+	}
+	return true
+}
+
+// Starts registering a user on the bridge at ip in the background, unless
+// that is already in progress
+func (b *Bridge) startRegistration(ip string) {
+	b.regM.Lock()
+	defer b.regM.Unlock()
+
+	if b.registrations[ip] != nil {
+		b.Log("Already registering a user on Hue bridge " + ip)
+		return
+	}
+	if b.registrations == nil {
+		b.registrations = make(map[string]context.CancelFunc)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b.registrations[ip] = cancel
+	b.goWorker(func() {
+		b.register(ctx, ip)
+
+		b.regM.Lock()
+		delete(b.registrations, ip)
+		b.regM.Unlock()
+		cancel()
+	})
+}
+
+// Stops registering a user on the bridge at ip
+func (b *Bridge) cancelRegistration(ip string) {
+	b.regM.Lock()
+	cancel := b.registrations[ip]
+	b.regM.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// Stops every registration in progress
+func (b *Bridge) cancelRegistrations() {
+	b.regM.Lock()
+	defer b.regM.Unlock()
+
+	for _, cancel := range b.registrations {
+		cancel()
+	}
+}
+
+// Requests a user from the bridge at ip every registerInterval until the link
+// button is pressed, registerAttempts run out or ctx is cancelled. Progress is
+// published to Register/{BridgeIP}/Status.
+func (b *Bridge) register(ctx context.Context, ip string) {
+	status := func(s string) {
+		err := b.publish(casa.Message{
+			Topic:   b.root + "/Register/" + ip + "/Status",
+			Payload: []byte(s),
+		})
+		if err != nil {
+			b.Log(err)
+		}
+	}
+
+	newbridge, err := hue.NewBridge(ip)
+	if err != nil {
+		b.Log("Unable to connect to Hue bridge:", err)
+		status("failed")
+		return
+	}
+
+	b.Log("Press the link button on the Hue bridge")
+	status("waiting")
+
+	ticker := time.NewTicker(registerInterval)
+	defer ticker.Stop()
+
+	for i := 1; i <= registerAttempts; i++ {
+		select {
+		case <-ctx.Done():
+			status("cancelled")
+			return
+		case <-ticker.C:
+		}
+
+		status("attempt " + strconv.Itoa(i) + " of " + strconv.Itoa(registerAttempts))
+		token, err := newbridge.CreateUser("Casa" + strconv.FormatInt(time.Now().Unix(), 10))
+		if err != nil {
+			b.Log(err)
+			continue
+		}
+		if token != "" {
+			b.Log("Token created:", token)
+			status("success: " + token)
+			return
+		}
+	}
+
+	b.Log("Unable to create user on Hue bridge. Please try again")
+	status("failed")
+}
@@ -0,0 +1,144 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/casaplatform/casa"
+)
+
+// Renames the light on the bridge, then moves it to the topic path of the new
+// name. The move waits for b.m, which the caller holds, so it runs in a
+// worker.
+func (l *Light) rename(name string) error {
+	name = strings.TrimSpace(name)
+	switch {
+	case name == "":
+		return errors.New("Light name must not be empty")
+	case strings.EqualFold(sanitizeTopic(name), "All"):
+		return errors.New("Light name All is reserved for commands to every light")
+	case strings.Contains(name, "/"):
+		return errors.New("Light name must not contain /")
+	}
+	err := l.bridge.reserveName(name)
+	if err != nil {
+		return err
+	}
+
+	var body []byte
+	err = l.bridge.call(func() (err error) {
+		body, _, err = l.bridge.hueBridge().Put("/api/"+l.bridge.User+"/lights/"+
+			strconv.Itoa(l.Light.Index), map[string]string{"name": name})
+		return err
+	})
+	if err == nil {
+		err = apiError(body)
+	}
+	if err != nil {
+		l.bridge.releaseName(name)
+		return err
+	}
+
+	l.bridge.goWorker(func() {
+		err := l.bridge.moveLight(l, name)
+		if err != nil {
+			l.bridge.Log("Unable to publish renamed Hue light "+name+":", err)
+		}
+	})
+	return nil
+}
+
+// Reserves name for a light being renamed, so that no other light can be
+// renamed to it before the move. b.m must be held for reading.
+func (b *Bridge) reserveName(name string) error {
+	key := sanitizeTopic(name)
+
+	b.renameM.Lock()
+	defer b.renameM.Unlock()
+
+	if _, ok := b.nameIndex[key]; ok || b.renaming[key] {
+		return errors.New("A Hue light is already named " + name)
+	}
+	if b.renaming == nil {
+		b.renaming = make(map[string]bool)
+	}
+	b.renaming[key] = true
+	return nil
+}
+
+// Releases the reservation of name made by reserveName
+func (b *Bridge) releaseName(name string) {
+	b.renameM.Lock()
+	delete(b.renaming, sanitizeTopic(name))
+	b.renameM.Unlock()
+}
+
+// Moves the light to the topic path of its new name, clears the retained
+// topics under the old path, publishes the light under the new one and
+// announces the change on Light/Renamed.
+func (b *Bridge) moveLight(l *Light, name string) error {
+	b.m.Lock()
+	old := l.name
+	oldTopics := make([]string, 0, 2*len(l.endpoints))
+	for point := range l.endpoints {
+		oldTopics = append(oldTopics, l.topic(point), "New/"+l.topic(point))
+	}
+
+	delete(b.nameIndex, sanitizeTopic(old))
+	delete(b.devices, l.Path)
+
+	l.Light.Name = name
+	l.name = name
+	l.Path = b.lightPath(deviceClass(l.Light.Type), name)
+
+	b.nameIndex[sanitizeTopic(name)] = strconv.Itoa(l.Light.Index)
+	b.devices[l.Path] = l
+	b.releaseName(name)
+	b.m.Unlock()
+
+	for _, topic := range oldTopics {
+		err := b.publish(casa.Message{
+			Topic:  topic,
+			Retain: true,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	b.m.RLock()
+	err := l.publishEndpoints()
+	b.m.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(map[string]string{
+		"old": old,
+		"new": name,
+	})
+	if err != nil {
+		return err
+	}
+
+	return b.publish(casa.Message{
+		Topic:   b.path + "/Light/Renamed",
+		Payload: payload,
+	})
+}
@@ -0,0 +1,155 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRename(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	b, client, _ := startBridge(t, f, nil)
+
+	client.send(deskTopic("Rename")+"/Set", "Lamp")
+	if got := client.waitFor(t, testPath+"/Light/Renamed"); got != `{"new":"Lamp","old":"Desk"}` {
+		t.Errorf("Light/Renamed = %s", got)
+	}
+
+	if got, _ := client.last(deskTopic("On")); got != "" {
+		t.Errorf("Topic of the old name still holds %q", got)
+	}
+	if got, _ := client.last(testPath + "/Light/Lamp/On"); got != "false" {
+		t.Errorf("Lamp/On = %q, want false", got)
+	}
+
+	b.m.RLock()
+	_, old := b.devices[testPath+"/Light/Desk"]
+	_, renamed := b.devices[testPath+"/Light/Lamp"]
+	b.m.RUnlock()
+	if old || !renamed {
+		t.Error("Renamed light wasn't moved to its new path")
+	}
+
+	client.send(testPath+"/Light/Lamp/On/Set", "true")
+	if f.state("1")["on"] != true {
+		t.Error("Renamed light doesn't answer on its new topic")
+	}
+}
+
+func TestRenameCollisions(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"Hall", "already named"},
+		{"", "must not be empty"},
+		{"  ", "must not be empty"},
+		{"all", "reserved"},
+		{"Up/Down", "must not contain /"},
+	}
+
+	for _, test := range tests {
+		f := newFakeBridge(t)
+		f.addLight("1", "Desk", "Extended color light")
+		f.addLight("2", "Hall", "Extended color light")
+		_, client, _ := startBridge(t, f, nil)
+
+		client.send(deskTopic("Rename")+"/Set", test.name)
+
+		got, _ := client.last(deskTopic("Rename") + "/Error")
+		if !strings.Contains(got, test.want) {
+			t.Errorf("Rename to %q: Error = %q, want it to mention %q", test.name, got, test.want)
+		}
+		if f.count("PUT", "/api/test/lights/1") != 0 {
+			t.Errorf("Rename to %q was sent to the bridge", test.name)
+		}
+	}
+}
+
+func TestRenameReservesName(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	b, _, _ := startBridge(t, f, nil)
+
+	b.m.RLock()
+	defer b.m.RUnlock()
+
+	if err := b.reserveName("Lamp"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.reserveName("Lamp"); err == nil {
+		t.Error("Name reserved for one rename was given to another")
+	}
+	if err := b.reserveName("Desk"); err == nil {
+		t.Error("Reserved the name of an existing light")
+	}
+
+	b.releaseName("Lamp")
+	if err := b.reserveName("Lamp"); err != nil {
+		t.Error("Released name can't be reserved again:", err)
+	}
+}
+
+func TestFailedRenameReleasesName(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	_, client, _ := startBridge(t, f, nil)
+
+	f.m.Lock()
+	f.intercept = func(r *http.Request) (int, string, bool) {
+		if r.Method == "PUT" && r.URL.Path == "/api/test/lights/1" {
+			return http.StatusOK, `[{"error":{"type":7,"address":"/lights/1/name","description":"invalid value"}}]`, true
+		}
+		return 0, "", false
+	}
+	f.m.Unlock()
+
+	client.send(deskTopic("Rename")+"/Set", "Lamp")
+	if got, _ := client.last(deskTopic("Rename") + "/Error"); got == "" {
+		t.Fatal("Rename rejected by the bridge succeeded")
+	}
+
+	f.m.Lock()
+	f.intercept = nil
+	f.m.Unlock()
+
+	client.send(deskTopic("Rename")+"/Set", "Lamp")
+	if got, _ := client.last(deskTopic("Rename") + "/Error"); got != "" {
+		t.Errorf("Retried rename failed: %s", got)
+	}
+	client.waitFor(t, testPath+"/Light/Renamed")
+}
+
+func TestRenameNotSentToAll(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	f.addLight("2", "Hall", "Extended color light")
+	b, client, logger := startBridge(t, f, nil)
+
+	client.send(testPath+"/All/Rename/Set", "Lamp")
+	if !logger.contains("Rename can't be sent to every light") {
+		t.Error("All/Rename wasn't rejected")
+	}
+	if f.count("PUT", "/api/test/lights/") != 0 {
+		t.Error("All/Rename was sent to the bridge")
+	}
+
+	_, err := b.setAllEndpoint("Rename", "Lamp")
+	if err == nil {
+		t.Error("setAllEndpoint accepted Rename")
+	}
+}
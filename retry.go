@@ -0,0 +1,131 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Defaults for retrying failed bridge calls
+const (
+	defaultRetryAttempts  = 3
+	defaultRetryBaseDelay = 200 * time.Millisecond
+)
+
+// Returns the RetryAttempts and RetryBaseDelayMs settings from config
+func retrySettings(config *viper.Viper) (int, time.Duration) {
+	attempts := defaultRetryAttempts
+	if n := config.GetInt("RetryAttempts"); n > 0 {
+		attempts = n
+	}
+
+	delay := defaultRetryBaseDelay
+	if ms := config.GetInt("RetryBaseDelayMs"); ms > 0 {
+		delay = time.Duration(ms) * time.Millisecond
+	}
+	return attempts, delay
+}
+
+// Sends a request to the bridge with fn through the circuit breaker, waiting
+// for the rate limiter before each attempt. Transport and server failures are
+// retried with exponential backoff until every attempt has failed, while
+// errors about the request itself are returned straight away. The breaker
+// counts the call once, however many attempts it took, and Stop cancels the
+// waits.
+func (b *Bridge) call(fn func() error) error {
+	return b.callWaiting(b.limiter.Wait, fn)
+}
+
+// Sends a request to the bridge as call does, for a bulk operation that may
+// spend the burst granted by withBurst
+func (b *Bridge) bulkCall(fn func() error) error {
+	return b.callWaiting(b.limiter.WaitBulk, fn)
+}
+
+// Makes a call, waiting for the rate limiter with wait
+func (b *Bridge) callWaiting(wait func(ctx context.Context) error, fn func() error) error {
+	err := b.breaker.allow()
+	if err != nil {
+		return err
+	}
+	err = b.retry(wait, fn)
+	b.recordCall(err)
+	return err
+}
+
+// Makes the attempts at fn for call
+func (b *Bridge) retry(wait func(ctx context.Context) error, fn func() error) error {
+	b.retryM.RLock()
+	attempts, delay := b.retryAttempts, b.retryDelay
+	b.retryM.RUnlock()
+
+	ctx := b.workerContext()
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		err = wait(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = fn()
+		b.trackConnection(err)
+		if err == nil {
+			if attempt > 1 {
+				b.Log("Hue bridge call succeeded on attempt " + strconv.Itoa(attempt))
+			}
+			return nil
+		}
+		if !retryable(err) {
+			return err
+		}
+
+		if attempt < attempts {
+			b.Log("Hue bridge call failed, retrying (attempt "+
+				strconv.Itoa(attempt)+" of "+strconv.Itoa(attempts)+"):", err)
+
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+			delay *= 2
+		}
+	}
+	return errors.Wrap(err, "Hue bridge call failed after "+
+		strconv.Itoa(attempts)+" attempts")
+}
+
+// Reports whether a failed bridge call is worth retrying. Transport failures
+// and server errors are, but errors the bridge reports about the request, such
+// as an invalid value, would only fail again.
+func retryable(err error) bool {
+	switch cause := errors.Cause(err).(type) {
+	case net.Error:
+		return true
+	case interface{ StatusCode() int }:
+		return cause.StatusCode() >= 500
+	}
+	return errors.Cause(err) == io.ErrUnexpectedEOF
+}
@@ -0,0 +1,221 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// An error carrying the HTTP status of a failed request
+type statusError int
+
+func (e statusError) Error() string {
+	return "HTTP status " + strconv.Itoa(int(e))
+}
+
+func (e statusError) StatusCode() int {
+	return int(e)
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"transport", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{"wrapped transport", errors.Wrap(&net.OpError{Op: "read"}, "Unable to read"), true},
+		{"truncated response", io.ErrUnexpectedEOF, true},
+		{"server error", statusError(503), true},
+		{"client error", statusError(400), false},
+		{"bridge error", errors.New("invalid value, 600, for parameter, bri"), false},
+	}
+
+	for _, test := range tests {
+		if got := retryable(test.err); got != test.want {
+			t.Errorf("%s: retryable = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCallRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		errs     []error
+		attempts int
+		ok       bool
+		failed   bool
+	}{
+		{"success", []error{nil}, 1, true, false},
+		{"server error then success", []error{statusError(500), nil}, 2, true, false},
+		{"server errors", []error{statusError(500), statusError(502), statusError(503)}, 3, false, true},
+		{"client error", []error{statusError(404)}, 1, false, false},
+	}
+
+	for _, test := range tests {
+		f := newFakeBridge(t)
+		b, _, _ := startBridge(t, f, map[string]interface{}{"RetryAttempts": 3})
+
+		attempts := 0
+		err := b.call(func() error {
+			err := test.errs[attempts]
+			attempts++
+			return err
+		})
+		if attempts != test.attempts || (err == nil) != test.ok {
+			t.Errorf("%s: %d attempts returning %v, want %d attempts, ok %v",
+				test.name, attempts, err, test.attempts, test.ok)
+		}
+
+		// Only the server errors count against the breaker
+		b.breaker.m.Lock()
+		failures := b.breaker.failures
+		b.breaker.m.Unlock()
+		want := 0
+		if test.failed {
+			want = 1
+		}
+		if failures != want {
+			t.Errorf("%s: breaker counted %d failures, want %d", test.name, failures, want)
+		}
+	}
+}
+
+func TestBreakerIgnoresRequestErrors(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	b, client, _ := startBridge(t, f, map[string]interface{}{
+		"CircuitBreakerThreshold": 2,
+		"RetryAttempts":           1,
+	})
+
+	f.m.Lock()
+	f.intercept = func(r *http.Request) (int, string, bool) {
+		if r.Method == "PUT" {
+			return http.StatusOK, `[{"error":{"type":7,"address":"/lights/1/state/bri","description":"invalid value, 600, for parameter, bri"}}]`, true
+		}
+		return 0, "", false
+	}
+	f.m.Unlock()
+
+	for i := 0; i < 3; i++ {
+		client.send(deskTopic("Brightness")+"/Set", "50")
+		b.call(func() error { return statusError(400) })
+	}
+
+	if got, _ := client.last(testPath + "/Status"); got == "degraded" {
+		t.Error("Errors about the requests opened the breaker")
+	}
+	if err := b.call(func() error { return nil }); err != nil {
+		t.Error("Breaker failed a call after errors about the requests:", err)
+	}
+}
+
+func TestStopCancelsRetries(t *testing.T) {
+	f := newFakeBridge(t)
+	b, _, _ := startBridge(t, f, map[string]interface{}{
+		"RetryAttempts":    5,
+		"RetryBaseDelayMs": 60000,
+	})
+
+	done := make(chan error)
+	go func() {
+		done <- b.call(func() error { return statusError(500) })
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	err := b.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("Cancelled call returned %v, want context.Canceled", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stop didn't cancel the wait between retries")
+	}
+}
+
+func TestBreakerTransitions(t *testing.T) {
+	f := newFakeBridge(t)
+	b, client, _ := startBridge(t, f, map[string]interface{}{
+		"CircuitBreakerThreshold": 2,
+		"RetryAttempts":           1,
+	})
+
+	calls := 0
+	fail := func() error {
+		calls++
+		return statusError(500)
+	}
+	succeed := func() error {
+		calls++
+		return nil
+	}
+	elapse := func() {
+		b.breaker.m.Lock()
+		b.breaker.openedAt = time.Now().Add(-time.Hour)
+		b.breaker.m.Unlock()
+	}
+
+	// Closed until the threshold is reached
+	b.call(fail)
+	if err := b.call(succeed); err != nil {
+		t.Fatal("Breaker opened before the threshold:", err)
+	}
+	b.call(fail)
+	b.call(fail)
+	if got, _ := client.last(testPath + "/Status"); got != "degraded" {
+		t.Errorf("Status = %q once the breaker opened, want degraded", got)
+	}
+
+	// Open: calls fail without reaching the bridge
+	calls = 0
+	if err := b.call(succeed); err != ErrBridgeUnavailable || calls != 0 {
+		t.Errorf("Open breaker returned %v after %d calls", err, calls)
+	}
+
+	// A failed probe keeps it open for another reset period
+	elapse()
+	if err := b.call(fail); err == nil || calls != 1 {
+		t.Errorf("Probe returned %v after %d calls", err, calls)
+	}
+	if err := b.call(succeed); err != ErrBridgeUnavailable || calls != 1 {
+		t.Errorf("Breaker let a call through after a failed probe: %v", err)
+	}
+
+	// A successful probe closes it
+	elapse()
+	if err := b.call(succeed); err != nil {
+		t.Error("Probe failed:", err)
+	}
+	if got, _ := client.last(testPath + "/Status"); got != "online" {
+		t.Errorf("Status = %q once the breaker closed, want online", got)
+	}
+	if err := b.call(succeed); err != nil {
+		t.Error("Closed breaker failed a call:", err)
+	}
+}
@@ -0,0 +1,432 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/casaplatform/casa"
+	"github.com/inhies/GoHue"
+)
+
+// Scene is a scene stored on the Hue bridge, as listed by Group.Scenes
+type Scene struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+
+	// Hue IDs of the lights the scene sets
+	Lights []string `json:"lights"`
+
+	// When the scene was last changed, or the zero time if the bridge
+	// doesn't know
+	LastUpdated time.Time `json:"lastupdated"`
+
+	// The Hue ID of the group of a group scene, empty for light scenes
+	group string
+}
+
+// Layout of the times the bridge reports, which are in UTC
+const bridgeTimeLayout = "2006-01-02T15:04:05"
+
+// Parses the scenes out of the bridge's response to a request for all
+// scenes, sorted by name and then ID
+func parseScenes(body []byte) ([]Scene, error) {
+	var raw map[string]struct {
+		Name        string   `json:"name"`
+		Group       string   `json:"group"`
+		Lights      []string `json:"lights"`
+		LastUpdated string   `json:"lastupdated"`
+	}
+	err := json.Unmarshal(body, &raw)
+	if err != nil {
+		if aerr := apiError(body); aerr != nil {
+			return nil, aerr
+		}
+		return nil, err
+	}
+
+	scenes := make([]Scene, 0, len(raw))
+	for id, r := range raw {
+		// Scenes never saved report "none"
+		updated, _ := time.Parse(bridgeTimeLayout, r.LastUpdated)
+		scenes = append(scenes, Scene{
+			ID:          id,
+			Name:        r.Name,
+			Lights:      r.Lights,
+			LastUpdated: updated,
+			group:       r.Group,
+		})
+	}
+
+	sort.Slice(scenes, func(i, j int) bool {
+		if scenes[i].Name != scenes[j].Name {
+			return scenes[i].Name < scenes[j].Name
+		}
+		return scenes[i].ID < scenes[j].ID
+	})
+	return scenes, nil
+}
+
+// Returns every scene on the bridge, read from the bridge only when the list
+// isn't cached since the last rescan
+func (b *Bridge) allScenes() ([]Scene, error) {
+	b.sceneM.Lock()
+	defer b.sceneM.Unlock()
+
+	if b.sceneList != nil {
+		return b.sceneList, nil
+	}
+
+	var body []byte
+	err := b.guard(func() (err error) {
+		body, _, err = b.hueBridge().Get("/api/" + b.User + "/scenes")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	scenes, err := parseScenes(body)
+	if err != nil {
+		return nil, err
+	}
+	b.sceneList = scenes
+	return scenes, nil
+}
+
+// Drops the cached scene list so that the next Group.Scenes reads it again
+func (b *Bridge) invalidateScenes() {
+	b.sceneM.Lock()
+	b.sceneList = nil
+	b.sceneM.Unlock()
+}
+
+// Scenes returns the scenes that can be recalled on the group: its group
+// scenes, and the light scenes that only set lights of the group. The list is
+// cached until the bridge's lights or scenes are scanned again.
+func (g *Group) Scenes() ([]Scene, error) {
+	return g.bridge.groupScenes(g.Group)
+}
+
+// Returns the scenes for Group.Scenes
+func (b *Bridge) groupScenes(group *hue.Group) ([]Scene, error) {
+	all, err := b.allScenes()
+	if err != nil {
+		return nil, err
+	}
+
+	id := strconv.Itoa(group.Index)
+	members := make(map[string]bool, len(group.Lights))
+	for _, light := range group.Lights {
+		members[light] = true
+	}
+
+	scenes := []Scene{}
+	for _, scene := range all {
+		if scene.group != id && (scene.group != "" || !subset(scene.Lights, members)) {
+			continue
+		}
+		scene.Lights = append([]string(nil), scene.Lights...)
+		scenes = append(scenes, scene)
+	}
+	return scenes, nil
+}
+
+// Reports whether every one of ids is in set, and there is at least one
+func subset(ids []string, set map[string]bool) bool {
+	for _, id := range ids {
+		if !set[id] {
+			return false
+		}
+	}
+	return len(ids) > 0
+}
+
+// Returns the scenes of the group as the JSON array published to its Scenes
+// topic
+func (l *Light) sceneListing() (string, error) {
+	scenes, err := l.bridge.groupScenes(l.group)
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(scenes)
+	return string(payload), err
+}
+
+// Fetches the scenes from the bridge, keyed by name. When several scenes share
+// a name the first one returned by the bridge is used.
+func (b *Bridge) loadScenes() (map[string]*hue.Scene, error) {
+	var scenes []hue.Scene
+	err := b.guard(func() (err error) {
+		scenes, err = b.hueBridge().GetAllScenes()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]*hue.Scene, len(scenes))
+	for i := range scenes {
+		if byName[scenes[i].Name] == nil {
+			byName[scenes[i].Name] = &scenes[i]
+		}
+	}
+	return byName, nil
+}
+
+// Publishes the sorted scene names as a JSON array to the Scenes topic
+func (b *Bridge) publishScenes() error {
+	b.m.RLock()
+	names := make([]string, 0, len(b.scenes))
+	for name := range b.scenes {
+		names = append(names, name)
+	}
+	b.m.RUnlock()
+
+	sort.Strings(names)
+	payload, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+
+	return b.publish(casa.Message{
+		Topic:   b.path + "/Scenes",
+		Payload: payload,
+		Retain:  true,
+	})
+}
+
+// Publishes the sorted IDs of the scenes as a JSON array to the Scene/List
+// topic
+func (b *Bridge) publishSceneIDs() error {
+	b.m.RLock()
+	ids := make([]string, 0, len(b.scenes))
+	for _, scene := range b.scenes {
+		ids = append(ids, scene.ID)
+	}
+	b.m.RUnlock()
+
+	sort.Strings(ids)
+	payload, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+
+	return b.publish(casa.Message{
+		Topic:   b.path + "/Scene/List",
+		Payload: payload,
+		Retain:  true,
+	})
+}
+
+// Runs a scene command sent to Scene/Create/Set or Scene/{ID}/Delete/Set.
+// Returns false if the topic isn't a scene command.
+func (b *Bridge) sceneCommand(topic, payload string) (bool, error) {
+	prefix := b.path + "/Scene/"
+	if !strings.HasPrefix(topic, prefix) {
+		return false, nil
+	}
+
+	m := strings.Split(strings.TrimPrefix(topic, prefix), "/")
+	switch {
+	case len(m) == 2 && m[0] == "Create" && m[1] == "Set":
+		var req struct {
+			Name   string   `json:"name"`
+			Lights []string `json:"lights"`
+		}
+		err := json.Unmarshal([]byte(payload), &req)
+		if err != nil {
+			return true, err
+		}
+
+		id, err := b.CreateScene(req.Name, req.Lights)
+		if err != nil {
+			return true, err
+		}
+		return true, b.publish(casa.Message{
+			Topic:   b.path + "/Scene/Create/Result",
+			Payload: []byte(id),
+		})
+	case len(m) == 3 && m[1] == "Delete" && m[2] == "Set":
+		return true, b.DeleteScene(m[0])
+	}
+	return false, nil
+}
+
+// CreateScene adds a scene to the bridge that captures the current state of
+// the named lights, and returns its ID.
+func (b *Bridge) CreateScene(name string, lights []string) (string, error) {
+	if name == "" {
+		return "", errors.New("Scene name must be set")
+	}
+	if len(lights) == 0 {
+		return "", errors.New("No lights to add to the scene")
+	}
+
+	b.m.RLock()
+	ids := make([]string, 0, len(lights))
+	for _, light := range lights {
+		l := b.lightByName(light)
+		if l == nil {
+			b.m.RUnlock()
+			return "", errors.New("Invalid Hue device specified: " + light)
+		}
+		ids = append(ids, strconv.Itoa(l.Light.Index))
+	}
+	b.m.RUnlock()
+
+	var body []byte
+	err := b.call(func() (err error) {
+		body, _, err = b.hueBridge().Post("/api/"+b.User+"/scenes", hue.Scene{
+			Name:   name,
+			Lights: ids,
+		})
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	id, err := createdID(body)
+	if err != nil {
+		return "", err
+	}
+	return id, b.reloadScenes()
+}
+
+// DeleteScene removes the scene with the given ID from the bridge
+func (b *Bridge) DeleteScene(id string) error {
+	b.m.RLock()
+	found := false
+	for _, scene := range b.scenes {
+		if scene.ID == id {
+			found = true
+			break
+		}
+	}
+	b.m.RUnlock()
+	if !found {
+		return errors.New("Unknown scene: " + id)
+	}
+
+	err := b.call(func() error {
+		return b.hueBridge().Delete("/api/" + b.User + "/scenes/" + id)
+	})
+	if err != nil {
+		return err
+	}
+	return b.reloadScenes()
+}
+
+// Fetches the scenes from the bridge again and publishes them, including the
+// scenes of each group
+func (b *Bridge) reloadScenes() error {
+	scenes, err := b.loadScenes()
+	if err != nil {
+		return err
+	}
+
+	b.m.Lock()
+	b.scenes = scenes
+	b.m.Unlock()
+	b.invalidateScenes()
+
+	err = b.publishScenes()
+	if err != nil {
+		return err
+	}
+
+	err = b.publishSceneIDs()
+	if err != nil {
+		return err
+	}
+	return b.publishGroupScenes()
+}
+
+// Publishes the Scenes endpoint of every group
+func (b *Bridge) publishGroupScenes() error {
+	b.m.RLock()
+	defer b.m.RUnlock()
+
+	for _, group := range b.groups {
+		err := group.publishState("Scenes")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Recalls the named scene on the group and publishes it, along with the
+// state the scene gave each of its lights
+func (l *Light) recallScene(name string) error {
+	err := l.setScene(name)
+	if err != nil {
+		return err
+	}
+
+	l.m.Lock()
+	l.scene = name
+	l.m.Unlock()
+
+	err = l.publish("Scene", name)
+	if err != nil {
+		return err
+	}
+
+	l.bridge.refreshSceneMembers(l.bridge.scenes[name])
+	return nil
+}
+
+// Re-reads the lights set by scene from the bridge and publishes the endpoint
+// values that changed, so their topics don't wait for the next poll. Only the
+// scene's lights are read. b.m must be held for reading.
+func (b *Bridge) refreshSceneMembers(scene *hue.Scene) {
+	for _, id := range scene.Lights {
+		light := b.lights[id]
+		if light == nil {
+			continue
+		}
+
+		err := light.refreshState(light.pointNames()...)
+		if err != nil {
+			b.Log("Unable to refresh "+light.Light.Name+" after recalling "+scene.Name+":", err)
+		}
+	}
+}
+
+// Recalls the named scene on the group without publishing anything
+func (l *Light) setScene(name string) error {
+	if l.group == nil {
+		return errors.New("Scenes can only be recalled on groups")
+	}
+
+	scene := l.bridge.scenes[name]
+	if scene == nil {
+		return errors.New("Unknown scene: " + name)
+	}
+
+	return l.bridge.call(func() error {
+		return l.bridge.hueBridge().SetGroupState(l.group, &hue.Action{
+			Scene: scene.ID,
+		})
+	})
+}
@@ -0,0 +1,208 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inhies/GoHue"
+)
+
+func TestParseScenes(t *testing.T) {
+	body := `{
+		"4e1c6b20e-on-0": {
+			"name": "Relax",
+			"type": "GroupScene",
+			"group": "1",
+			"lights": ["1", "2"],
+			"owner": "ffffffffe0341b1b376a2389376a2389",
+			"recycle": false,
+			"locked": false,
+			"lastupdated": "2016-12-25T10:30:00",
+			"version": 2
+		},
+		"ab341ef24": {
+			"name": "Concentrate",
+			"type": "LightScene",
+			"lights": ["2"],
+			"lastupdated": "none",
+			"version": 1
+		},
+		"0a2b3c4d5": {
+			"name": "Relax",
+			"type": "LightScene",
+			"lights": ["3"],
+			"lastupdated": "2017-01-02T03:04:05"
+		}
+	}`
+
+	scenes, err := parseScenes([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Scene{
+		{ID: "ab341ef24", Name: "Concentrate", Lights: []string{"2"}},
+		{ID: "0a2b3c4d5", Name: "Relax", Lights: []string{"3"},
+			LastUpdated: time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{ID: "4e1c6b20e-on-0", Name: "Relax", Lights: []string{"1", "2"},
+			LastUpdated: time.Date(2016, 12, 25, 10, 30, 0, 0, time.UTC), group: "1"},
+	}
+	if !reflect.DeepEqual(scenes, want) {
+		t.Errorf("parseScenes =\n%+v\nwant\n%+v", scenes, want)
+	}
+}
+
+func TestParseScenesError(t *testing.T) {
+	tests := []string{
+		`[{"error":{"type":1,"address":"/scenes","description":"unauthorized user"}}]`,
+		`not json`,
+	}
+
+	for _, body := range tests {
+		if _, err := parseScenes([]byte(body)); err == nil {
+			t.Errorf("parseScenes(%s) succeeded", body)
+		}
+	}
+	if _, err := parseScenes([]byte(tests[0])); !strings.Contains(err.Error(), "unauthorized user") {
+		t.Errorf("parseScenes error %v doesn't say what the bridge reported", err)
+	}
+}
+
+func TestGroupScenes(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	f.addLight("2", "Lamp", "Extended color light")
+	f.addLight("3", "Porch", "Extended color light")
+	f.addGroup("1", "Living", "1", "2")
+	f.addGroup("2", "Outside", "3")
+
+	on := map[string]interface{}{"on": true}
+	f.addScene("s1", "Relax", "1", map[string]map[string]interface{}{"1": on, "2": on})
+	f.addScene("s2", "Reading", "", map[string]map[string]interface{}{"1": on})
+	f.addScene("s3", "Everywhere", "", map[string]map[string]interface{}{"1": on, "3": on})
+	f.addScene("s4", "Night", "2", map[string]map[string]interface{}{"3": on})
+
+	b, client, _ := startBridge(t, f, nil)
+	living := b.groups["Living"]
+
+	scenes, err := living.Scenes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, scene := range scenes {
+		names = append(names, scene.ID+" "+scene.Name)
+	}
+	if want := []string{"s2 Reading", "s1 Relax"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Living scenes = %q, want %q", names, want)
+	}
+	if want := time.Date(2016, 12, 25, 10, 30, 0, 0, time.UTC); !scenes[1].LastUpdated.Equal(want) {
+		t.Errorf("LastUpdated = %v, want %v", scenes[1].LastUpdated, want)
+	}
+
+	// The topic lists the same scenes
+	var listed []Scene
+	err = json.Unmarshal([]byte(client.waitFor(t, testPath+"/Group/Living/Scenes")), &listed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 2 || listed[0].ID != "s2" || listed[1].ID != "s1" {
+		t.Errorf("Living/Scenes = %+v", listed)
+	}
+
+	// The list is cached until the scenes are scanned again
+	reads := f.count("GET", "/api/test/scenes")
+	living.Scenes()
+	b.groups["Outside"].Scenes()
+	if n := f.count("GET", "/api/test/scenes"); n != reads {
+		t.Errorf("Cached scenes were read from the bridge %d more times", n-reads)
+	}
+
+	f.addScene("s5", "Bright", "1", map[string]map[string]interface{}{"1": on})
+	err = b.reloadScenes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal([]byte(client.waitFor(t, testPath+"/Group/Living/Scenes")), &listed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 3 || listed[0].Name != "Bright" {
+		t.Errorf("Living/Scenes = %+v after a rescan, want the new scene", listed)
+	}
+
+	// Callers can't change the cached list
+	scenes, _ = living.Scenes()
+	scenes[0].Lights[0] = "9"
+	if scenes, _ = living.Scenes(); scenes[0].Lights[0] != "1" {
+		t.Error("Changing a returned scene changed the cache")
+	}
+}
+
+func TestGroupScenesUnknownGroup(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addScene("s1", "Relax", "1", map[string]map[string]interface{}{"1": {"on": true}})
+	b, _, _ := startBridge(t, f, nil)
+
+	scenes, err := b.groupScenes(&hue.Group{Index: 7})
+	if err != nil || len(scenes) != 0 {
+		t.Errorf("Scenes of an empty group = %v, %v, want none", scenes, err)
+	}
+}
+
+func TestSceneRecallRefreshesMembers(t *testing.T) {
+	f := newFakeBridge(t)
+	f.addLight("1", "Desk", "Extended color light")
+	f.addLight("2", "Lamp", "Extended color light")
+	f.addLight("3", "Porch", "Extended color light")
+	f.addGroup("1", "Living", "1", "2", "3")
+	f.addScene("s1", "Relax", "1", map[string]map[string]interface{}{
+		"1": {"on": true, "bri": float64(200)},
+		"2": {"on": true, "ct": float64(300)},
+	})
+	_, client, _ := startBridge(t, f, nil)
+
+	f.m.Lock()
+	f.requests = nil
+	f.m.Unlock()
+
+	client.send(testPath+"/Group/Living/Scene/Set", "Relax")
+
+	if got, _ := client.last(testPath + "/Group/Living/Scene"); got != "Relax" {
+		t.Errorf("Living/Scene = %q, want Relax", got)
+	}
+	if got, _ := client.last(testPath + "/Light/Desk/Brightness"); got != "79" {
+		t.Errorf("Desk/Brightness = %q right after the recall, want 79", got)
+	}
+	if got, _ := client.last(testPath + "/Light/Lamp/Color_Temp"); got != "300" {
+		t.Errorf("Lamp/Color_Temp = %q right after the recall, want 300", got)
+	}
+	if got, _ := client.last(testPath + "/Light/Lamp/On"); got != "true" {
+		t.Errorf("Lamp/On = %q right after the recall, want true", got)
+	}
+
+	// Porch is in the group but not in the scene
+	if n := f.count("GET", "/api/test/lights/3"); n != 0 {
+		t.Errorf("Read Porch %d times, which the scene doesn't set", n)
+	}
+	if n := f.count("GET", "/api/test/lights"); n != 2 {
+		t.Errorf("Made %d light reads after the recall, want one per member", n)
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/casaplatform/casa"
+)
+
+// Schedule is a command the Hue bridge runs by itself at a set time, such as
+// turning a group off at night.
+type Schedule struct {
+	ID          string          `json:"id"`
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Time        string          `json:"time"`
+	Status      string          `json:"status,omitempty"`
+	Command     ScheduleCommand `json:"command"`
+}
+
+// ScheduleCommand is the bridge API request a schedule makes, for example
+// {"address":"/api/<user>/groups/0/action","method":"PUT","body":{"on":false}}
+type ScheduleCommand struct {
+	Address string          `json:"address"`
+	Method  string          `json:"method"`
+	Body    json.RawMessage `json:"body"`
+}
+
+// The form of a schedule used by the bridge API, which calls the time
+// localtime
+type apiSchedule struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	LocalTime   string          `json:"localtime"`
+	Status      string          `json:"status,omitempty"`
+	Command     ScheduleCommand `json:"command"`
+}
+
+// Returns the first error reported in the response to a bridge API request,
+// if any
+func apiError(body []byte) error {
+	var results []struct {
+		Error struct {
+			Description string `json:"description"`
+		} `json:"error"`
+	}
+	err := json.Unmarshal(body, &results)
+	if err != nil {
+		return err
+	}
+
+	for _, result := range results {
+		if result.Error.Description != "" {
+			return errors.New("Hue bridge error: " + result.Error.Description)
+		}
+	}
+	return nil
+}
+
+// Returns the ID of the resource created by a bridge API request, or the error
+// the bridge reported
+func createdID(body []byte) (string, error) {
+	err := apiError(body)
+	if err != nil {
+		return "", err
+	}
+
+	var results []struct {
+		Success struct {
+			ID string `json:"id"`
+		} `json:"success"`
+	}
+	err = json.Unmarshal(body, &results)
+	if err != nil {
+		return "", err
+	}
+
+	for _, result := range results {
+		if result.Success.ID != "" {
+			return result.Success.ID, nil
+		}
+	}
+	return "", errors.New("Hue bridge returned no ID")
+}
+
+// Runs a schedule command sent to Schedule/Create/Set, Schedule/List/Get or
+// Schedule/{ID}/Delete/Set. Returns false if the topic isn't a schedule
+// command.
+func (b *Bridge) scheduleCommand(topic, command, payload string) (bool, error) {
+	prefix := b.path + "/Schedule/"
+	if !strings.HasPrefix(topic, prefix) {
+		return false, nil
+	}
+
+	m := strings.Split(strings.TrimPrefix(topic, prefix), "/")
+	switch {
+	case len(m) == 2 && m[0] == "Create" && command == "Set":
+		var s Schedule
+		err := json.Unmarshal([]byte(payload), &s)
+		if err != nil {
+			return true, err
+		}
+		_, err = b.CreateSchedule(s)
+		return true, err
+	case len(m) == 2 && m[0] == "List" && command == "Get":
+		err := b.refreshSchedules()
+		if err != nil {
+			return true, err
+		}
+		return true, b.publishSchedules()
+	case len(m) == 3 && m[1] == "Delete" && command == "Set":
+		return true, b.DeleteSchedule(m[0])
+	}
+	return false, nil
+}
+
+// Schedules returns the schedules on the bridge as of the last poll, sorted by
+// ID.
+func (b *Bridge) Schedules() []*Schedule {
+	b.schedM.RLock()
+	defer b.schedM.RUnlock()
+
+	schedules := make([]*Schedule, 0, len(b.schedules))
+	for _, s := range b.schedules {
+		schedules = append(schedules, s)
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].ID < schedules[j].ID
+	})
+	return schedules
+}
+
+// Reads the schedules from the bridge
+func (b *Bridge) refreshSchedules() error {
+	var body []byte
+	err := b.guard(func() (err error) {
+		body, _, err = b.hueBridge().Get("/api/" + b.User + "/schedules")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	var found map[string]apiSchedule
+	err = json.Unmarshal(body, &found)
+	if err != nil {
+		return err
+	}
+
+	schedules := make(map[string]*Schedule, len(found))
+	for id, s := range found {
+		schedules[id] = &Schedule{
+			ID:          id,
+			Name:        s.Name,
+			Description: s.Description,
+			Time:        s.LocalTime,
+			Status:      s.Status,
+			Command:     s.Command,
+		}
+	}
+
+	b.schedM.Lock()
+	b.schedules = schedules
+	b.schedM.Unlock()
+	return nil
+}
+
+// CreateSchedule adds s to the bridge and returns the ID it was given. The ID
+// of s is ignored.
+func (b *Bridge) CreateSchedule(s Schedule) (string, error) {
+	if s.Time == "" {
+		return "", errors.New("Schedule time must be set")
+	}
+	if s.Command.Address == "" || s.Command.Method == "" {
+		return "", errors.New("Schedule command needs an address and method")
+	}
+
+	var body []byte
+	err := b.call(func() (err error) {
+		body, _, err = b.hueBridge().Post("/api/"+b.User+"/schedules", apiSchedule{
+			Name:        s.Name,
+			Description: s.Description,
+			LocalTime:   s.Time,
+			Status:      s.Status,
+			Command:     s.Command,
+		})
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	id, err := createdID(body)
+	if err != nil {
+		return "", err
+	}
+
+	err = b.refreshSchedules()
+	if err != nil {
+		return id, err
+	}
+	return id, b.publishSchedules()
+}
+
+// DeleteSchedule removes the schedule with the given ID from the bridge
+func (b *Bridge) DeleteSchedule(id string) error {
+	b.schedM.RLock()
+	_, ok := b.schedules[id]
+	b.schedM.RUnlock()
+	if !ok {
+		return errors.New("Unknown schedule: " + id)
+	}
+
+	err := b.call(func() error {
+		return b.hueBridge().Delete("/api/" + b.User + "/schedules/" + id)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = b.refreshSchedules()
+	if err != nil {
+		return err
+	}
+	return b.publishSchedules()
+}
+
+// Publishes the schedules as a JSON array to the Schedule/List topic
+func (b *Bridge) publishSchedules() error {
+	payload, err := json.Marshal(b.Schedules())
+	if err != nil {
+		return err
+	}
+
+	return b.publish(casa.Message{
+		Topic:   b.path + "/Schedule/List",
+		Payload: payload,
+		Retain:  true,
+	})
+}
@@ -0,0 +1,266 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/casaplatform/casa"
+	"github.com/inhies/GoHue"
+	"github.com/spf13/viper"
+)
+
+// Default battery percentage below which a sensor's battery is logged as low
+const defaultLowBatteryPercent = 15
+
+// Sensor wraps a Hue motion, daylight, temperature or light level sensor.
+// Its readings are published to {Path}/{Field}, along with the battery
+// percentage to {Path}/Battery for battery powered sensors.
+type Sensor struct {
+	Name string
+	Path string
+	Type string
+
+	// The last value published for each field, guarded by m
+	m     sync.Mutex
+	State map[string]string
+
+	// The battery percentage, or nil for sensors without a battery, and
+	// whether it was last below LowBatteryPercent. Guarded by m.
+	battery    *int
+	lowBattery bool
+
+	sensor *hue.Sensor
+	bridge *Bridge
+}
+
+// Returns the published fields of a Hue sensor and their values, or nil if
+// the sensor type isn't supported.
+func sensorFields(s *hue.Sensor) map[string]string {
+	switch s.Type {
+	case "ZLLPresence", "CLIPPresence":
+		return map[string]string{"Presence": strconv.FormatBool(s.State.Presence)}
+	case "Daylight", "CLIPDaylight":
+		return map[string]string{"Daylight": strconv.FormatBool(s.State.Daylight)}
+	case "ZLLTemperature", "CLIPTemperature":
+		// Reported in hundredths of a degree Celsius
+		celsius := float64(s.State.Temperature) / 100
+		return map[string]string{"Temperature": strconv.FormatFloat(celsius, 'f', 2, 64)}
+	case "ZLLLightLevel", "CLIPLightLevel":
+		// Reported as 10000 * log10(lux) + 1
+		lux := math.Pow(10, float64(s.State.LightLevel-1)/10000)
+		return map[string]string{"Lux": strconv.FormatFloat(lux, 'f', 0, 64)}
+	}
+	return nil
+}
+
+// Returns the LowBatteryPercent setting from config
+func lowBatteryPercent(config *viper.Viper) int {
+	if !config.IsSet("LowBatteryPercent") {
+		return defaultLowBatteryPercent
+	}
+	return config.GetInt("LowBatteryPercent")
+}
+
+// Reads every sensor from the bridge, along with the battery percentage of
+// those that report one, keyed by Hue sensor ID. GoHue doesn't read the
+// sensor config holding the battery.
+func readSensors(bridge *hue.Bridge, user string) ([]hue.Sensor, map[string]int, error) {
+	body, _, err := bridge.Get("/api/" + user + "/sensors")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var raw map[string]json.RawMessage
+	err = json.Unmarshal(body, &raw)
+	if err != nil {
+		if aerr := apiError(body); aerr != nil {
+			return nil, nil, aerr
+		}
+		return nil, nil, err
+	}
+
+	sensors := make([]hue.Sensor, 0, len(raw))
+	batteries := make(map[string]int)
+	for id, data := range raw {
+		var sensor hue.Sensor
+		var config struct {
+			Config struct {
+				Battery *int `json:"battery"`
+			} `json:"config"`
+		}
+		err := json.Unmarshal(data, &sensor)
+		if err == nil {
+			err = json.Unmarshal(data, &config)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		sensor.Index, _ = strconv.Atoi(id)
+		sensor.Bridge = bridge
+		sensors = append(sensors, sensor)
+
+		// Sensors powered from the mains report a null battery
+		if config.Config.Battery != nil {
+			batteries[id] = *config.Config.Battery
+		}
+	}
+
+	sort.Slice(sensors, func(i, j int) bool {
+		return sensors[i].Index < sensors[j].Index
+	})
+	return sensors, batteries, nil
+}
+
+// Creates the Sensors for the supported sensors on the bridge, keyed by Hue
+// sensor ID
+func (b *Bridge) loadSensors(sensors []hue.Sensor, batteries map[string]int) map[string]*Sensor {
+	loaded := make(map[string]*Sensor)
+	for i := range sensors {
+		s := &sensors[i]
+		if sensorFields(s) == nil {
+			continue
+		}
+
+		id := strconv.Itoa(s.Index)
+		sensor := &Sensor{
+			Name:   s.Name,
+			Path:   b.lightPath("Sensor", s.Name),
+			Type:   s.Type,
+			State:  make(map[string]string),
+			sensor: s,
+			bridge: b,
+		}
+		if battery, ok := batteries[id]; ok {
+			sensor.battery = &battery
+		}
+		loaded[id] = sensor
+	}
+	return loaded
+}
+
+// Returns the published fields of the sensor and their values
+func (s *Sensor) fields() map[string]string {
+	fields := sensorFields(s.sensor)
+	if s.battery != nil {
+		fields["Battery"] = strconv.Itoa(*s.battery)
+	}
+	return fields
+}
+
+// Replaces the sensor's readings with those of fresh and its battery with
+// battery, and publishes the fields that changed. Motion starting is also
+// published to Motion/Event.
+func (s *Sensor) update(fresh *hue.Sensor, battery *int) error {
+	motion := fresh.State.Presence && !s.sensor.State.Presence
+	s.sensor.State = fresh.State
+
+	s.m.Lock()
+	s.battery = battery
+	s.m.Unlock()
+
+	err := s.publishChanged()
+	if err != nil || !motion {
+		return err
+	}
+
+	return s.bridge.publish(casa.Message{
+		Topic:   s.Path + "/Motion/Event",
+		Payload: []byte(time.Now().Format(time.RFC3339)),
+	})
+}
+
+// Publishes the fields whose value differs from the last one published, and
+// logs a warning when the battery drops below LowBatteryPercent
+func (s *Sensor) publishChanged() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.battery != nil {
+		low := *s.battery < s.bridge.lowBatteryPercent
+		if low && !s.lowBattery {
+			s.bridge.Log("Battery low on Hue sensor " + s.Name + ": " +
+				strconv.Itoa(*s.battery) + "%")
+		}
+		s.lowBattery = low
+	}
+
+	for field, value := range s.fields() {
+		if last, ok := s.State[field]; ok && last == value {
+			continue
+		}
+
+		err := s.bridge.publish(casa.Message{
+			Topic:   s.Path + "/" + field,
+			Payload: []byte(value),
+			Retain:  true,
+		})
+		if err != nil {
+			return err
+		}
+		s.State[field] = value
+	}
+	return nil
+}
+
+// Publishes every field of the sensor
+func (s *Sensor) publishAll() error {
+	s.m.Lock()
+	s.State = make(map[string]string)
+	s.m.Unlock()
+	return s.publishChanged()
+}
+
+// Reads every sensor from the bridge and publishes the readings that changed
+func (b *Bridge) refreshSensors() error {
+	var (
+		sensors   []hue.Sensor
+		batteries map[string]int
+	)
+	err := b.guard(func() (err error) {
+		sensors, batteries, err = readSensors(b.hueBridge(), b.User)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	b.m.RLock()
+	defer b.m.RUnlock()
+
+	for i := range sensors {
+		id := strconv.Itoa(sensors[i].Index)
+		sensor := b.sensors[id]
+		if sensor == nil {
+			continue
+		}
+
+		var battery *int
+		if level, ok := batteries[id]; ok {
+			battery = &level
+		}
+		err := sensor.update(&sensors[i], battery)
+		if err != nil {
+			b.Log(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSensorBattery(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings map[string]interface{}
+		warnAt   int
+	}{
+		{"default threshold", nil, 14},
+		{"configured threshold", map[string]interface{}{"LowBatteryPercent": 30}, 29},
+	}
+
+	for _, test := range tests {
+		f := newFakeBridge(t)
+		motion := f.addSensor("1", "Hall", "ZLLPresence", 80)
+		f.addSensor("2", "Daylight", "Daylight", -1)
+		b, client, logger := startBridge(t, f, test.settings)
+
+		path := testPath + "/Sensor/Hall/Battery"
+		if got, _ := client.last(path); got != "80" {
+			t.Errorf("%s: Battery = %q, want 80", test.name, got)
+		}
+		if _, ok := client.last(testPath + "/Sensor/Daylight/Battery"); ok {
+			t.Errorf("%s: Battery published for a sensor without one", test.name)
+		}
+
+		// Each level is read on the next poll, and the warning is only
+		// logged as the battery drops below the threshold
+		for _, level := range []int{test.warnAt + 1, test.warnAt, test.warnAt - 1} {
+			f.m.Lock()
+			motion["config"].(map[string]interface{})["battery"] = float64(level)
+			f.m.Unlock()
+
+			err := b.refreshSensors()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := client.last(path); got != strconv.Itoa(level) {
+				t.Errorf("%s: Battery = %q after a poll, want %d", test.name, got, level)
+			}
+		}
+
+		logger.m.Lock()
+		warnings := 0
+		for _, line := range logger.lines {
+			if strings.Contains(line, "Battery low on Hue sensor Hall") {
+				warnings++
+			}
+		}
+		logger.m.Unlock()
+		if warnings != 1 {
+			t.Errorf("%s: logged %d low battery warnings, want 1", test.name, warnings)
+		}
+	}
+}
+
+func TestValidateLowBatteryPercent(t *testing.T) {
+	for _, value := range []interface{}{-1, 101, "low"} {
+		err := ValidateConfig(testConfig(map[string]interface{}{"LowBatteryPercent": value}))
+		if err == nil || !strings.Contains(err.Error(), "LowBatteryPercent") {
+			t.Errorf("ValidateConfig accepted LowBatteryPercent %v: %v", value, err)
+		}
+	}
+}
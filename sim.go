@@ -0,0 +1,507 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/inhies/GoHue"
+	"github.com/spf13/viper"
+)
+
+// Defaults for the simulation settings
+const (
+	defaultSimStep          = time.Second
+	defaultSimMinBrightness = 10
+	defaultSimMaxBrightness = 100
+	defaultSimMinInterval   = time.Minute
+	defaultSimMaxInterval   = 15 * time.Minute
+)
+
+// Settings used by simulations such as Sunrise and Simulate
+type simSettings struct {
+	// Time between the steps of gradual simulations
+	step time.Duration
+
+	// Range of brightness percentages and of times between changes used by
+	// Simulate
+	minBrightness, maxBrightness int
+	minInterval, maxInterval     time.Duration
+}
+
+// Returns the SimStepMs, SimMinBrightnessPercent, SimMaxBrightnessPercent,
+// SimMinIntervalSeconds and SimMaxIntervalSeconds settings from config
+func loadSimSettings(config *viper.Viper) simSettings {
+	s := simSettings{
+		step:          defaultSimStep,
+		minBrightness: defaultSimMinBrightness,
+		maxBrightness: defaultSimMaxBrightness,
+		minInterval:   defaultSimMinInterval,
+		maxInterval:   defaultSimMaxInterval,
+	}
+
+	if ms := config.GetInt("SimStepMs"); ms > 0 {
+		s.step = time.Duration(ms) * time.Millisecond
+	}
+	if p := config.GetInt("SimMinBrightnessPercent"); p > 0 && p <= 100 {
+		s.minBrightness = p
+	}
+	if p := config.GetInt("SimMaxBrightnessPercent"); p > 0 && p <= 100 {
+		s.maxBrightness = p
+	}
+	if seconds := config.GetInt("SimMinIntervalSeconds"); seconds > 0 {
+		s.minInterval = time.Duration(seconds) * time.Second
+	}
+	if seconds := config.GetInt("SimMaxIntervalSeconds"); seconds > 0 {
+		s.maxInterval = time.Duration(seconds) * time.Second
+	}
+
+	if s.maxBrightness < s.minBrightness {
+		s.maxBrightness = s.minBrightness
+	}
+	if s.maxInterval < s.minInterval {
+		s.maxInterval = s.minInterval
+	}
+	return s
+}
+
+// Returns the bridge's current simulation settings
+func (b *Bridge) simConfig() simSettings {
+	b.simM.RLock()
+	defer b.simM.RUnlock()
+	return b.sim
+}
+
+// Color temperatures a sunrise moves between, in Kelvin
+const (
+	sunriseStartKelvin = 2000
+	sunriseEndKelvin   = 5500
+)
+
+// Runs run in a background worker as the light's simulation, once the one
+// already running has been stopped.
+func (l *Light) startSim(run func(ctx context.Context)) {
+	l.stopSim()
+
+	ctx, cancel := context.WithCancel(l.bridge.workerContext())
+	done := make(chan struct{})
+
+	l.m.Lock()
+	l.activeSim = cancel
+	l.simDone = done
+	l.m.Unlock()
+
+	l.bridge.goWorker(func() {
+		defer close(done)
+		defer cancel()
+		run(ctx)
+	})
+}
+
+// Cancels the light's running simulation, if any, and waits for it to finish
+// so that any state it restores is applied before what follows.
+func (l *Light) stopSim() {
+	l.m.Lock()
+	cancel, done := l.activeSim, l.simDone
+	l.activeSim, l.simDone = nil, nil
+	l.m.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+// Stops the simulations running on every light and group
+func (b *Bridge) stopSims() {
+	b.m.RLock()
+	lights := make([]*Light, 0, len(b.lights)+len(b.groups))
+	for _, light := range b.lights {
+		lights = append(lights, light)
+	}
+	for _, group := range b.groups {
+		lights = append(lights, group.Light)
+	}
+	b.m.RUnlock()
+
+	for _, light := range lights {
+		light.stopSim()
+	}
+}
+
+// Parses a simulation duration given in minutes
+func parseMinutes(payload string) (time.Duration, error) {
+	minutes, err := strconv.ParseFloat(payload, 64)
+	if err != nil || minutes <= 0 {
+		return 0, errors.New("Duration must be a number of minutes greater than 0")
+	}
+	return time.Duration(minutes * float64(time.Minute)), nil
+}
+
+// Applies a state every SimStepMs over duration until ctx is done, passing
+// apply the progress from 0-1. The progress percentage is published to
+// {Path}/{name}Progress after each step. Returns false if cancelled.
+func (l *Light) ramp(ctx context.Context, name string, duration time.Duration,
+	apply func(progress float64) hue.LightState) bool {
+	interval := l.bridge.simConfig().step
+
+	steps := int(duration / interval)
+	if steps < 1 {
+		steps = 1
+	}
+
+	// Each step fades into the next
+	transition := strconv.FormatInt(int64(interval/(100*time.Millisecond)), 10)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for step := 1; step <= steps; step++ {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+
+		progress := float64(step) / float64(steps)
+		state := apply(progress)
+		state.TransitionTime = transition
+
+		err := l.setState(state)
+		if err != nil {
+			l.bridge.Log("Unable to run "+name+" on "+l.Light.Name+":", err)
+			continue
+		}
+
+		l.changeState(func(cur *hue.Light) {
+			cur.State.On = state.On
+			if state.Bri != 0 {
+				cur.State.Bri = state.Bri
+			}
+			if state.CT != 0 {
+				cur.State.CT = state.CT
+			}
+		})
+
+		err = l.publish(name+"Progress", strconv.Itoa(int(math.Floor(progress*100))))
+		if err != nil {
+			l.bridge.Log(err)
+		}
+	}
+	return true
+}
+
+// Brightens the light from its dimmest to full over duration while moving
+// from a warm to a daylight color temperature.
+func (l *Light) sunrise(ctx context.Context, duration time.Duration) {
+	min, max := l.ctRange()
+	clamp := func(ct uint16) float64 {
+		return math.Max(float64(min), math.Min(float64(max), float64(ct)))
+	}
+	warm := clamp(KelvinToMireds(sunriseStartKelvin))
+	day := clamp(KelvinToMireds(sunriseEndKelvin))
+
+	l.ramp(ctx, "Sunrise", duration, func(progress float64) hue.LightState {
+		return hue.LightState{
+			On:  true,
+			Bri: uint8(1 + 253*progress),
+			CT:  uint16(warm + (day-warm)*progress),
+		}
+	})
+
+	err := l.publishState("On", "Brightness", "Color Temp", "ColorTempKelvin")
+	if err != nil {
+		l.bridge.Log(err)
+	}
+}
+
+// Dims the light from its current brightness over duration, then turns it
+// off.
+func (l *Light) sunset(ctx context.Context, duration time.Duration) {
+	start := float64(l.current().State.Bri)
+	if !l.current().State.On {
+		start = 0
+	}
+
+	l.ramp(ctx, "Sunset", duration, func(progress float64) hue.LightState {
+		if progress >= 1 {
+			return hue.LightState{On: false}
+		}
+		return hue.LightState{
+			On:  true,
+			Bri: uint8(math.Max(1, start*(1-progress))),
+		}
+	})
+
+	err := l.publishState("On", "Brightness")
+	if err != nil {
+		l.bridge.Log(err)
+	}
+}
+
+// Shortest time a color is shown by CycleColors
+const minCycleStep = 100 * time.Millisecond
+
+// Parses a CycleColors payload of color names followed by the time each is
+// shown in milliseconds, as in "Red,Blue,Green,500". Every name must be in
+// Colors.
+func parseCycle(payload string) ([]string, time.Duration, error) {
+	parts := strings.Split(payload, ",")
+	if len(parts) < 2 {
+		return nil, 0, errors.New("CycleColors needs at least one color and a step in milliseconds")
+	}
+
+	ms, err := strconv.Atoi(strings.TrimSpace(parts[len(parts)-1]))
+	step := time.Duration(ms) * time.Millisecond
+	if err != nil || step < minCycleStep {
+		return nil, 0, errors.New("CycleColors step must be at least " +
+			strconv.Itoa(int(minCycleStep/time.Millisecond)) + "ms")
+	}
+
+	names := make([]string, len(parts)-1)
+	for i, part := range parts[:len(parts)-1] {
+		name, _, err := lookupColor(strings.TrimSpace(part))
+		if err != nil {
+			return nil, 0, err
+		}
+		names[i] = name
+	}
+	return names, step, nil
+}
+
+// Shows each of the named colors for step in turn, over and over until ctx
+// is done. The color being shown is published to CycleColors/Current.
+func (l *Light) cycleColors(ctx context.Context, names []string, step time.Duration) {
+	ticker := time.NewTicker(step)
+	defer ticker.Stop()
+
+	for i := 0; ; i = (i + 1) % len(names) {
+		_, xy, err := lookupColor(names[i])
+		if err == nil {
+			err = l.setState(hue.LightState{
+				XY: xy,
+				On: true,
+			})
+		}
+
+		if err != nil {
+			l.bridge.Log("Unable to cycle colors on "+l.Light.Name+":", err)
+		} else {
+			l.changeState(func(cur *hue.Light) {
+				cur.State.On = true
+				cur.State.XY = *xy
+			})
+
+			err = l.publish("CycleColors/Current", names[i])
+			if err != nil {
+				l.bridge.Log(err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			err = l.publishState("On", "XY Color", "Color Name")
+			if err != nil {
+				l.bridge.Log(err)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Limits of the Strobe endpoint
+const (
+	maxStrobeCount    = 100
+	minStrobeInterval = 100 * time.Millisecond
+)
+
+// Parses a Strobe payload of a flash count and the interval between on and
+// off in milliseconds, as in "10,200".
+func parseStrobe(payload string) (int, time.Duration, error) {
+	parts := strings.Split(payload, ",")
+	if len(parts) != 2 {
+		return 0, 0, errors.New("Invalid payload " + payload)
+	}
+
+	count, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || count < 1 || count > maxStrobeCount {
+		return 0, 0, errors.New("Strobe count must be from 1-" + strconv.Itoa(maxStrobeCount))
+	}
+
+	ms, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	interval := time.Duration(ms) * time.Millisecond
+	if err != nil || interval < minStrobeInterval {
+		return 0, 0, errors.New("Strobe interval must be at least " +
+			strconv.Itoa(int(minStrobeInterval/time.Millisecond)) + "ms")
+	}
+	return count, interval, nil
+}
+
+// Flashes the light count times, switching between on and off every
+// interval, then restores whether it was on. Only the restored state is
+// published.
+func (l *Light) strobe(ctx context.Context, count int, interval time.Duration) {
+	wasOn := l.current().State.On
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+flash:
+	for i := 0; i < count*2; i++ {
+		err := l.setState(hue.LightState{
+			On:             i%2 == 0,
+			TransitionTime: "0",
+		})
+		if err != nil {
+			l.bridge.Log("Unable to strobe "+l.Light.Name+":", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			break flash
+		case <-ticker.C:
+		}
+	}
+
+	err := l.setState(hue.LightState{
+		On:             wasOn,
+		TransitionTime: "0",
+	})
+	if err != nil {
+		l.bridge.Log("Unable to restore "+l.Light.Name+" after strobe:", err)
+		return
+	}
+
+	l.changeState(func(cur *hue.Light) { cur.State.On = wasOn })
+	err = l.publishState("On")
+	if err != nil {
+		l.bridge.Log(err)
+	}
+}
+
+// The parts of a light's state that Simulate changes and restores
+type simSnapshot struct {
+	on        bool
+	bri       uint8
+	colorMode string
+	ct        uint16
+	xy        [2]float32
+	hue       uint16
+	sat       uint8
+}
+
+// Mimics someone being home for duration by switching the light on and off
+// and changing its brightness and color temperature at random intervals, then
+// restores the state it had before.
+func (l *Light) simulate(ctx context.Context, duration time.Duration) {
+	settings := l.bridge.simConfig()
+	current := l.current().State
+	before := simSnapshot{current.On, current.Bri, current.ColorMode,
+		current.CT, current.XY, current.Hue, current.Saturation}
+	_, hasCT := l.endpoints["Color Temp"]
+	min, max := l.ctRange()
+
+	end := time.NewTimer(duration)
+	defer end.Stop()
+
+simulate:
+	for {
+		wait := settings.minInterval +
+			time.Duration(rand.Int63n(int64(settings.maxInterval-settings.minInterval)+1))
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			break simulate
+		case <-end.C:
+			timer.Stop()
+			break simulate
+		case <-timer.C:
+		}
+
+		// Lights are on more often than off, as when someone is home
+		state := hue.LightState{On: rand.Intn(3) > 0}
+		if state.On {
+			percent := settings.minBrightness +
+				rand.Intn(settings.maxBrightness-settings.minBrightness+1)
+			state.Bri = percentToBri(percent)
+			if hasCT {
+				state.CT = min + uint16(rand.Intn(int(max-min)+1))
+			}
+		}
+
+		err := l.setState(state)
+		if err != nil {
+			l.bridge.Log("Unable to simulate presence on "+l.Light.Name+":", err)
+			continue
+		}
+
+		l.changeState(func(cur *hue.Light) {
+			cur.State.On = state.On
+			if state.Bri != 0 {
+				cur.State.Bri = state.Bri
+			}
+			if state.CT != 0 {
+				cur.State.CT = state.CT
+			}
+		})
+	}
+
+	err := l.restore(before)
+	if err != nil {
+		l.bridge.Log("Unable to restore "+l.Light.Name+" after simulation:", err)
+	}
+}
+
+// Returns the light to the state in snapshot and publishes it
+func (l *Light) restore(snapshot simSnapshot) error {
+	state := hue.LightState{
+		On:  snapshot.on,
+		Bri: snapshot.bri,
+	}
+	switch snapshot.colorMode {
+	case "ct":
+		state.CT = snapshot.ct
+	case "xy":
+		xy := snapshot.xy
+		state.XY = &xy
+	case "hs":
+		state.Hue = snapshot.hue
+		state.Sat = snapshot.sat
+	}
+
+	err := l.setState(state)
+	if err != nil {
+		return err
+	}
+
+	l.changeState(func(cur *hue.Light) {
+		cur.State.On = snapshot.on
+		cur.State.Bri = snapshot.bri
+		cur.State.CT = snapshot.ct
+		cur.State.XY = snapshot.xy
+		cur.State.Hue = snapshot.hue
+		cur.State.Saturation = snapshot.sat
+	})
+	return l.publishState(l.pointNames()...)
+}
@@ -0,0 +1,146 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// SnapshotState returns the value of every endpoint of every light as JSON,
+// keyed by light name and then endpoint, for RestoreState.
+func (b *Bridge) SnapshotState() ([]byte, error) {
+	b.m.RLock()
+	defer b.m.RUnlock()
+
+	snapshot := make(map[string]map[string]string, len(b.lights))
+	for _, light := range b.lights {
+		values := make(map[string]string)
+		for point, data := range light.endpoints {
+			if data.GetState == nil || data.Metadata {
+				continue
+			}
+
+			value, err := data.GetState(light, light.topic(point))
+			if err != nil {
+				return nil, err
+			}
+			values[point] = value
+		}
+		snapshot[light.name] = values
+	}
+	return json.Marshal(snapshot)
+}
+
+// The endpoints that return a light to a snapshot, in the order they are set.
+// Only the endpoints for the light's color mode are set, so the light doesn't
+// pass through other colors on the way.
+func restoreOrder(values map[string]string) []string {
+	if values["On"] == "false" {
+		return []string{"TransitionTime", "On"}
+	}
+
+	points := []string{"TransitionTime", "On", "Brightness"}
+	switch values["Color Mode"] {
+	case "ct":
+		points = append(points, "Color Temp")
+	case "xy":
+		points = append(points, "XY Color")
+	case "hs":
+		points = append(points, "Hue", "Saturation")
+	}
+	return append(points, "Effect")
+}
+
+// RestoreState returns the lights to a snapshot taken by SnapshotState,
+// through the endpoints of each light. Every light is restored even if some
+// fail, and the failures are returned together. The restore may briefly
+// exceed the rate limit.
+func (b *Bridge) RestoreState(data []byte) error {
+	var snapshot map[string]map[string]string
+	err := json.Unmarshal(data, &snapshot)
+	if err != nil {
+		return err
+	}
+
+	b.m.RLock()
+	defer b.m.RUnlock()
+
+	var (
+		failed   []string
+		lights   []*Light
+		names    []string
+		requests int
+	)
+	for name, values := range snapshot {
+		light := b.lightByName(name)
+		if light == nil {
+			failed = append(failed, "Unknown light "+name)
+			continue
+		}
+		lights = append(lights, light)
+		names = append(names, name)
+		requests += len(restoreOrder(values))
+	}
+
+	b.withBurst(lights, requests, func() {
+		for i, light := range lights {
+			name, values := names[i], snapshot[names[i]]
+			for _, point := range restoreOrder(values) {
+				value, ok := values[point]
+				if !ok || light.endpoints[point] == nil {
+					continue
+				}
+
+				err := light.setEndpointState(point, value)
+				if err != nil {
+					failed = append(failed, name+" "+point+": "+err.Error())
+				}
+			}
+		}
+	})
+
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return errors.New("Unable to restore Hue lights: " + strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// Writes a snapshot of the lights to the SnapshotFile
+func (b *Bridge) saveSnapshot(path string) error {
+	data, err := b.SnapshotState()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// Restores the lights from the SnapshotFile, if there is one
+func (b *Bridge) loadSnapshot(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		b.Log("No Hue snapshot to restore at " + path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return b.RestoreState(data)
+}
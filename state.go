@@ -0,0 +1,201 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"encoding/json"
+
+	"github.com/inhies/GoHue"
+)
+
+// A partial light state as accepted by the State endpoint. Every field is a
+// pointer so that fields missing from the JSON can be told apart from zero
+// values.
+type jsonState struct {
+	On     *bool       `json:"on"`
+	Bri    *uint8      `json:"bri"`
+	Hue    *uint16     `json:"hue"`
+	Sat    *uint8      `json:"sat"`
+	XY     *[2]float32 `json:"xy"`
+	CT     *uint16     `json:"ct"`
+	Effect *string     `json:"effect"`
+	Alert  *string     `json:"alert"`
+}
+
+// Merges a JSON encoded partial state onto the light's current state and
+// applies the result with a single call to the bridge. Fields left out of the
+// payload keep their current value instead of being reset, so {"on":true}
+// turns the light on without touching its brightness or color. The topics of
+// the changed endpoints are published once the bridge accepts the state.
+func (l *Light) applyJSONState(payload string) error {
+	var s jsonState
+	err := json.Unmarshal([]byte(payload), &s)
+	if err != nil {
+		return err
+	}
+	return l.applyState(s)
+}
+
+// Merges s onto the light's current state and applies it, see applyJSONState.
+func (l *Light) applyState(s jsonState) error {
+	current := l.current().State
+	state := hue.LightState{
+		On: current.On,
+	}
+	var changed []string
+
+	if s.On != nil {
+		state.On = *s.On
+		current.On = *s.On
+		changed = append(changed, "On")
+	}
+	if s.Bri != nil {
+		state.Bri = *s.Bri
+		current.Bri = *s.Bri
+		changed = append(changed, "Brightness")
+	}
+	if s.Hue != nil {
+		state.Hue = *s.Hue
+		current.Hue = *s.Hue
+		changed = append(changed, "Hue")
+	}
+	if s.Sat != nil {
+		state.Sat = *s.Sat
+		current.Saturation = *s.Sat
+		changed = append(changed, "Saturation")
+	}
+	if s.XY != nil {
+		state.XY = s.XY
+		current.XY = *s.XY
+		changed = append(changed, "XY Color")
+	}
+	if s.CT != nil {
+		state.CT = *s.CT
+		current.CT = *s.CT
+		changed = append(changed, "Color Temp")
+	}
+	if s.Effect != nil {
+		effect, err := effectValue(*s.Effect)
+		if err != nil {
+			return err
+		}
+		state.Effect = effect
+		current.Effect = effect
+		changed = append(changed, "Effect")
+	}
+	if s.Alert != nil {
+		alert, err := alertValue(*s.Alert)
+		if err != nil {
+			return err
+		}
+		state.Alert = alert
+		current.Alert = alert
+		changed = append(changed, "Alert")
+	}
+
+	err := l.setState(state)
+	if err != nil {
+		return err
+	}
+
+	l.changeState(func(cur *hue.Light) { cur.State = current })
+	return l.publishState(append(changed, "State")...)
+}
+
+// Returns the light's current state in the format accepted by the State
+// endpoint.
+func (l *Light) jsonState() (string, error) {
+	current := l.current().State
+	data, err := json.Marshal(jsonState{
+		On:     &current.On,
+		Bri:    &current.Bri,
+		Hue:    &current.Hue,
+		Sat:    &current.Saturation,
+		XY:     &current.XY,
+		CT:     &current.CT,
+		Effect: &current.Effect,
+		Alert:  &current.Alert,
+	})
+	return string(data), err
+}
+
+// Transaction accumulates changes to a light so they can be applied with a
+// single call to the bridge. Start one with Light.Begin, chain the changes and
+// apply them with Commit:
+//
+//	err := light.Begin().On(true).Brightness(127).ColorTemp(370).Commit()
+type Transaction struct {
+	light *Light
+	state jsonState
+}
+
+// Begin starts a new transaction on the light
+func (l *Light) Begin() *Transaction {
+	return &Transaction{light: l}
+}
+
+// On turns the light on or off
+func (t *Transaction) On(on bool) *Transaction {
+	t.state.On = &on
+	return t
+}
+
+// Brightness sets the brightness from 1-254
+func (t *Transaction) Brightness(bri uint8) *Transaction {
+	t.state.Bri = &bri
+	return t
+}
+
+// Hue sets the hue from 0-65535
+func (t *Transaction) Hue(hue uint16) *Transaction {
+	t.state.Hue = &hue
+	return t
+}
+
+// Saturation sets the saturation from 0-254
+func (t *Transaction) Saturation(sat uint8) *Transaction {
+	t.state.Sat = &sat
+	return t
+}
+
+// XY sets the color to the x,y coordinates
+func (t *Transaction) XY(x, y float32) *Transaction {
+	t.state.XY = &[2]float32{x, y}
+	return t
+}
+
+// ColorTemp sets the mired color temperature
+func (t *Transaction) ColorTemp(ct uint16) *Transaction {
+	t.state.CT = &ct
+	return t
+}
+
+// Effect sets the effect mode
+func (t *Transaction) Effect(effect string) *Transaction {
+	t.state.Effect = &effect
+	return t
+}
+
+// Alert sets the alert state
+func (t *Transaction) Alert(alert string) *Transaction {
+	t.state.Alert = &alert
+	return t
+}
+
+// Commit applies every change in the transaction with a single call to the
+// bridge, then publishes the topics of the changed endpoints.
+func (t *Transaction) Commit() error {
+	return t.light.applyState(t.state)
+}
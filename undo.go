@@ -0,0 +1,74 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"errors"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Number of changes Undo can revert on each light when UndoDepth isn't set
+const defaultUndoDepth = 10
+
+// A change made through an endpoint, recorded so that Undo can revert it
+type undoEntry struct {
+	Endpoint string
+	Old      string
+	Time     time.Time
+}
+
+// Returns the UndoDepth setting from config
+func undoDepth(config *viper.Viper) int {
+	if !config.IsSet("UndoDepth") {
+		return defaultUndoDepth
+	}
+	return config.GetInt("UndoDepth")
+}
+
+// Records a change to the endpoint from old for Undo, dropping the oldest
+// change once UndoDepth of them are kept. Changes to Lock aren't undone.
+func (l *Light) recordChange(endpoint, old string) {
+	if endpoint == "Lock" || l.bridge.undoDepth == 0 {
+		return
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	l.changes = append(l.changes, undoEntry{
+		Endpoint: endpoint,
+		Old:      old,
+		Time:     time.Now(),
+	})
+	if over := len(l.changes) - l.bridge.undoDepth; over > 0 {
+		l.changes = append(l.changes[:0], l.changes[over:]...)
+	}
+}
+
+// Reverts the most recent change made through an endpoint
+func (l *Light) undo() error {
+	l.m.Lock()
+	if len(l.changes) == 0 {
+		l.m.Unlock()
+		return errors.New("Nothing to undo on " + l.Light.Name)
+	}
+	entry := l.changes[len(l.changes)-1]
+	l.changes = l.changes[:len(l.changes)-1]
+	l.m.Unlock()
+
+	return l.applyEndpointState(entry.Endpoint, entry.Old, false)
+}
@@ -0,0 +1,97 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import "errors"
+
+// Number of changes queued for a watcher before further changes are dropped
+const watchQueue = 16
+
+// A function registered by Bridge.Watch with the queue of values waiting to be
+// passed to it
+type watcher struct {
+	fn     func(value string)
+	values chan string
+}
+
+// Watch calls fn with each new value published to the endpoint of the named
+// light. Values are passed to fn in order from a goroutine of its own. If fn
+// falls more than a few values behind, values are dropped until it catches
+// up. Calling cancel stops fn being called.
+func (b *Bridge) Watch(lightName, endpoint string, fn func(value string)) (cancel func(), err error) {
+	b.m.RLock()
+	light := b.lightByName(lightName)
+	b.m.RUnlock()
+	if light == nil {
+		return nil, errors.New("Invalid Hue device specified: " + lightName)
+	}
+
+	point := light.endpoints[endpoint]
+	if point == nil {
+		return nil, errors.New("Unknown endpoint: " + endpoint)
+	}
+	if point.GetState == nil {
+		return nil, errors.New("Endpoint is write only: " + endpoint)
+	}
+
+	w := &watcher{
+		fn:     fn,
+		values: make(chan string, watchQueue),
+	}
+	go func() {
+		for value := range w.values {
+			w.fn(value)
+		}
+	}()
+
+	light.m.Lock()
+	if light.watchers == nil {
+		light.watchers = make(map[string][]*watcher)
+	}
+	light.watchers[endpoint] = append(light.watchers[endpoint], w)
+	light.m.Unlock()
+
+	return func() { light.unwatch(endpoint, w) }, nil
+}
+
+// Removes w from the watchers of the endpoint and stops its goroutine. Safe to
+// call more than once.
+func (l *Light) unwatch(endpoint string, w *watcher) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	watchers := l.watchers[endpoint]
+	for i := range watchers {
+		if watchers[i] == w {
+			l.watchers[endpoint] = append(watchers[:i:i], watchers[i+1:]...)
+			close(w.values)
+			return
+		}
+	}
+}
+
+// Queues value for each watcher of the endpoint
+func (l *Light) notify(endpoint, value string) {
+	l.m.RLock()
+	defer l.m.RUnlock()
+
+	for _, w := range l.watchers[endpoint] {
+		select {
+		case w.values <- value:
+		default:
+			l.bridge.Log("Dropped change to "+l.topic(endpoint), "for a slow watcher")
+		}
+	}
+}
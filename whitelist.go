@@ -0,0 +1,142 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/casaplatform/casa"
+)
+
+// WhitelistEntry is an application registered with the Hue bridge. The key
+// of the entry is a credential for the bridge, so it is never published.
+type WhitelistEntry struct {
+	Name     string `json:"name"`
+	Created  string `json:"created"`
+	LastUsed string `json:"lastused"`
+
+	key string
+}
+
+// Parses the whitelist out of a bridge configuration response, sorted by name
+func parseWhitelist(body []byte) ([]WhitelistEntry, error) {
+	var config struct {
+		Whitelist map[string]struct {
+			Name     string `json:"name"`
+			Created  string `json:"create date"`
+			LastUsed string `json:"last use date"`
+		} `json:"whitelist"`
+	}
+	err := json.Unmarshal(body, &config)
+	if err != nil {
+		return nil, err
+	}
+	if config.Whitelist == nil {
+		return nil, ErrUnauthorized
+	}
+
+	entries := make([]WhitelistEntry, 0, len(config.Whitelist))
+	for key, e := range config.Whitelist {
+		entries = append(entries, WhitelistEntry{
+			Name:     e.Name,
+			Created:  e.Created,
+			LastUsed: e.LastUsed,
+			key:      key,
+		})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	return entries, nil
+}
+
+// Whitelist returns the applications registered with the Hue bridge so stale
+// registrations can be found and removed.
+func (b *Bridge) Whitelist() ([]WhitelistEntry, error) {
+	var body []byte
+	err := b.guard(func() (err error) {
+		body, _, err = b.hueBridge().Get("/api/" + b.User + "/config")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return parseWhitelist(body)
+}
+
+// DeleteWhitelistEntry removes the application registered as name from the
+// Hue bridge. It is only allowed when AllowWhitelistDelete is set in the
+// config, and refuses names shared by several entries or used by this
+// service.
+func (b *Bridge) DeleteWhitelistEntry(name string) error {
+	b.m.RLock()
+	allowed := b.allowWhitelistDelete
+	b.m.RUnlock()
+
+	if !allowed {
+		return errors.New("Whitelist deletion is disabled, set AllowWhitelistDelete to enable it")
+	}
+
+	entries, err := b.Whitelist()
+	if err != nil {
+		return err
+	}
+
+	var matches []WhitelistEntry
+	for _, e := range entries {
+		if e.Name == name {
+			matches = append(matches, e)
+		}
+	}
+
+	switch {
+	case len(matches) == 0:
+		return errors.New("No whitelist entry named " + name)
+	case len(matches) > 1:
+		return errors.New("Several whitelist entries are named " + name)
+	case matches[0].key == b.User:
+		return errors.New("Refusing to delete the whitelist entry used by this service")
+	}
+
+	err = b.guard(func() error {
+		return b.hueBridge().Delete("/api/" + b.User + "/config/whitelist/" + matches[0].key)
+	})
+	if err != nil {
+		return err
+	}
+	return b.publishWhitelist()
+}
+
+// Publishes the whitelist as a JSON array to the Whitelist topic
+func (b *Bridge) publishWhitelist() error {
+	entries, err := b.Whitelist()
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	return b.publish(casa.Message{
+		Topic:   b.path + "/Whitelist",
+		Payload: payload,
+		Retain:  true,
+	})
+}
@@ -0,0 +1,69 @@
+// Copyright © 2016 Casa Platform
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hue
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestPublishWhitelist(t *testing.T) {
+	f := newFakeBridge(t)
+	b, client, _ := startBridge(t, f, nil)
+
+	client.send(testPath+"/Whitelist/Set", "")
+
+	payload := client.waitFor(t, testPath+"/Whitelist")
+	if strings.Contains(payload, testUser) {
+		t.Errorf("Whitelist %s includes the key of an entry", payload)
+	}
+
+	var entries []WhitelistEntry
+	err := json.Unmarshal([]byte(payload), &entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name != "casa#hue" || entries[0].LastUsed != "2016-01-02T00:00:00" {
+		t.Errorf("Whitelist = %+v", entries)
+	}
+
+	err = b.DeleteWhitelistEntry("casa#hue")
+	if err == nil || !strings.Contains(err.Error(), "disabled") {
+		t.Errorf("Deleted a whitelist entry without AllowWhitelistDelete: %v", err)
+	}
+}
+
+func TestDeleteWhitelistEntry(t *testing.T) {
+	f := newFakeBridge(t)
+	b, _, _ := startBridge(t, f, map[string]interface{}{"AllowWhitelistDelete": true})
+
+	tests := []struct {
+		name, want string
+	}{
+		{"casa#hue", "used by this service"},
+		{"stranger", "No whitelist entry"},
+	}
+
+	for _, test := range tests {
+		err := b.DeleteWhitelistEntry(test.name)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("Deleting %s returned %v, want it to mention %q", test.name, err, test.want)
+		}
+	}
+	if f.count("DELETE", "/api/test/config/whitelist") != 0 {
+		t.Error("Whitelist entry was deleted")
+	}
+}